@@ -1,6 +1,6 @@
 module github.com/picatz/doh
 
-go 1.23.0
+go 1.24
 
 toolchain go1.24.0
 
@@ -8,15 +8,19 @@ require (
 	github.com/hashicorp/go-cleanhttp v0.5.2
 	github.com/hashicorp/go-retryablehttp v0.7.7
 	github.com/miekg/dns v1.1.65
+	github.com/quic-go/quic-go v0.59.1
 	github.com/spf13/cobra v1.9.1
-	golang.org/x/sync v0.13.0
+	github.com/spf13/pflag v1.0.6
+	golang.org/x/sync v0.16.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.6 // indirect
-	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.39.0 // indirect
-	golang.org/x/sys v0.32.0 // indirect
-	golang.org/x/tools v0.32.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
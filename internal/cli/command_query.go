@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/miekg/dns"
 	"github.com/picatz/doh/pkg/dj"
 	"github.com/picatz/doh/pkg/doh"
 	"github.com/spf13/cobra"
@@ -19,12 +22,78 @@ import (
 )
 
 type result struct {
-	Server string       `json:"server"`
-	Resp   *dj.Response `json:"resp"`
+	Server     string            `json:"server"`
+	Resp       *dj.Response      `json:"resp"`
+	Validation *validationResult `json:"validation,omitempty"`
+}
+
+// validationResult is the DNSSEC validation of a response, when queries
+// are validated locally.
+type validationResult struct {
+	Status  string                   `json:"status"`
+	Error   string                   `json:"error,omitempty"`
+	Answers []answerValidationResult `json:"answers,omitempty"`
+}
+
+// answerValidationResult is the DNSSEC validation of an answer RRset.
+type answerValidationResult struct {
+	Name   string `json:"name"`
+	Type   int    `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newValidationResult converts a validation into its JSON output.
+func newValidationResult(validation *doh.Validation) *validationResult {
+	result := &validationResult{
+		Status: validation.Status.String(),
+	}
+
+	if validation.Err != nil {
+		result.Error = validation.Err.Error()
+	}
+
+	for _, answer := range validation.Answers {
+		answerResult := answerValidationResult{
+			Name:   answer.Name,
+			Type:   int(answer.Type),
+			Status: answer.Status.String(),
+		}
+
+		if answer.Err != nil {
+			answerResult.Error = answer.Err.Error()
+		}
+
+		result.Answers = append(result.Answers, answerResult)
+	}
+
+	return result
+}
+
+// readTrustAnchors reads the DS or DNSKEY records in the given files.
+func readTrustAnchors(files []string) ([]dns.RR, error) {
+	var anchors []dns.RR
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		fileAnchors, err := doh.ParseTrustAnchors(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		anchors = append(anchors, fileAnchors...)
+	}
+
+	return anchors, nil
 }
 
 // newHTTPClient returns a new HTTP client, or an error if one occurs.
-func newHTTPClient(retryMax int, insecureSkipVerify bool) (*http.Client, error) {
+func newHTTPClient(retryMax int, insecureSkipVerify, useHTTP3 bool) (*http.Client, error) {
 	retryClient := retryablehttp.NewClient()
 
 	retryClient.RetryMax = retryMax
@@ -43,6 +112,15 @@ func newHTTPClient(retryMax int, insecureSkipVerify bool) (*http.Client, error)
 		retryClient.HTTPClient.Transport = transport
 	}
 
+	if useHTTP3 {
+		// A single query can't discover HTTP/3 support from an Alt-Svc
+		// header, so HTTP/3 is tried first, falling back to HTTP/2.
+		retryClient.HTTPClient.Transport = &doh.HTTP3Transport{
+			Fallback:    retryClient.HTTPClient.Transport,
+			AssumeHTTP3: true,
+		}
+	}
+
 	retryClient.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
 		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 	}
@@ -60,6 +138,16 @@ func newHTTPClient(retryMax int, insecureSkipVerify bool) (*http.Client, error)
 	return httpClient, nil
 }
 
+// parseMethod returns the DoH client method for the given flag value.
+func parseMethod(s string) (doh.Method, error) {
+	switch method := doh.Method(strings.ToUpper(s)); method {
+	case doh.MethodGet, doh.MethodPost, doh.MethodAuto:
+		return method, nil
+	default:
+		return "", fmt.Errorf("unknown method %q, must be one of get, post, or auto", s)
+	}
+}
+
 var CommandQuery = &cobra.Command{
 	Use:   "query domains... [flags]",
 	Short: "Query DNS records from DoH servers",
@@ -93,7 +181,60 @@ which can be piped to other commands (e.g. jq) or redirected to a file.`,
 			return fmt.Errorf("invalid insecure skip verify: %w", err)
 		}
 
-		httpClient, err := newHTTPClient(retryMax, insecureSkipVerify)
+		method, err := parseMethod(cmd.Flag("method").Value.String())
+		if err != nil {
+			return fmt.Errorf("invalid method: %w", err)
+		}
+
+		padding, err := cmd.Flags().GetBool("padding")
+		if err != nil {
+			return fmt.Errorf("invalid padding: %w", err)
+		}
+
+		ecs, err := cmd.Flags().GetString("ecs")
+		if err != nil {
+			return fmt.Errorf("invalid ecs: %w", err)
+		}
+
+		var clientSubnet netip.Prefix
+		if ecs != "" {
+			clientSubnet, err = netip.ParsePrefix(ecs)
+			if err != nil {
+				return fmt.Errorf("invalid ecs: %w", err)
+			}
+		}
+
+		dnssec, err := cmd.Flags().GetBool("dnssec")
+		if err != nil {
+			return fmt.Errorf("invalid dnssec: %w", err)
+		}
+
+		checkingDisabled, err := cmd.Flags().GetBool("checking-disabled")
+		if err != nil {
+			return fmt.Errorf("invalid checking disabled: %w", err)
+		}
+
+		validate, err := cmd.Flags().GetBool("validate")
+		if err != nil {
+			return fmt.Errorf("invalid validate: %w", err)
+		}
+
+		trustAnchorFiles, err := cmd.Flags().GetStringSlice("trust-anchor")
+		if err != nil {
+			return fmt.Errorf("invalid trust anchor: %w", err)
+		}
+
+		trustAnchors, err := readTrustAnchors(trustAnchorFiles)
+		if err != nil {
+			return fmt.Errorf("invalid trust anchor: %w", err)
+		}
+
+		useHTTP3, err := cmd.Flags().GetBool("http3")
+		if err != nil {
+			return fmt.Errorf("invalid http3: %w", err)
+		}
+
+		httpClient, err := newHTTPClient(retryMax, insecureSkipVerify, useHTTP3)
 		if err != nil {
 			return fmt.Errorf("error creating http client: %w", err)
 		}
@@ -153,8 +294,39 @@ which can be piped to other commands (e.g. jq) or redirected to a file.`,
 
 			for _, server := range servers {
 				server := strings.TrimSpace(server)
+				opts := []doh.ClientOption{
+					doh.WithHTTPClient(httpClient),
+					doh.WithServers(server),
+					doh.WithMethod(method),
+					doh.WithPadding(padding),
+					doh.WithClientSubnet(clientSubnet),
+				}
+				if dnssec {
+					opts = append(opts, doh.WithDNSSEC())
+				}
+				if checkingDisabled {
+					opts = append(opts, doh.WithCheckingDisabled())
+				}
+				client := doh.NewClient(opts...)
 				eg.Go(func() error {
-					resp, err := doh.SimpleQuery(gtx, httpClient, server, req)
+					if validate {
+						validator := doh.NewValidator(client, doh.ValidatorOptions{
+							TrustAnchors: trustAnchors,
+						})
+
+						resp, validation, err := validator.SimpleQuery(gtx, req)
+						if err != nil {
+							return err
+						}
+
+						return output.Encode(&result{
+							Server:     server,
+							Resp:       resp,
+							Validation: newValidationResult(validation),
+						})
+					}
+
+					resp, err := client.SimpleQuery(gtx, req)
 					if err != nil {
 						return err
 					}
@@ -184,7 +356,15 @@ func init() {
 	}
 
 	CommandQuery.Flags().String("type", "A", "dns record type to query for each domain, such as A, AAAA, MX, etc.")
+	CommandQuery.Flags().String("method", "get", "http method used for queries (get, post, or auto to use post for large queries)")
 	CommandQuery.Flags().StringSlice("servers", defaultServers, "servers to query")
+	CommandQuery.Flags().Bool("padding", true, "pad queries with EDNS(0) padding (RFC 7830) to hide the length of the queried names")
+	CommandQuery.Flags().String("ecs", "", "EDNS Client Subnet (RFC 7871) to query as, such as 203.0.113.0/24, or 0.0.0.0/0 to opt out")
+	CommandQuery.Flags().Bool("dnssec", false, "set the DNSSEC OK bit, to include DNSSEC records (RRSIG, NSEC, etc.) in answers")
+	CommandQuery.Flags().Bool("checking-disabled", false, "set the checking disabled bit, to get answers even if they fail DNSSEC validation")
+	CommandQuery.Flags().Bool("validate", false, "validate DNSSEC answers locally, from the root trust anchor down, instead of trusting the server's AD bit")
+	CommandQuery.Flags().StringSlice("trust-anchor", nil, "files of DS or DNSKEY records to validate DNSSEC answers with, instead of the root trust anchor")
+	CommandQuery.Flags().Bool("http3", false, "query servers over HTTP/3, falling back to HTTP/2 if it fails")
 	CommandQuery.Flags().Duration("timeout", 30*time.Second, "timeout for query, 0s for no timeout")
 	CommandQuery.Flags().String("resolver-addr", "", "address of a DNS resolver to use for resolving DoH server names (e.g. 8.8.8.8:53)")
 	CommandQuery.Flags().String("resolver-network", "udp", "protocol to use for resolving DoH server names (e.g. udp, tcp)")
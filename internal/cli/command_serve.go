@@ -0,0 +1,613 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/picatz/doh/pkg/doh"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/spf13/cobra"
+)
+
+// selfSignedCertificate returns a new self-signed TLS certificate, valid
+// for localhost and the loopback addresses, for local development.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating serial number: %w", err)
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"doh"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error creating certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// serverTLSConfig returns the TLS configuration for the serve command, from
+// either the given certificate and key files, or a self-signed certificate.
+func serverTLSConfig(certFile, keyFile string, selfSigned bool) (*tls.Config, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+
+	switch {
+	case selfSigned:
+		cert, err = selfSignedCertificate()
+	case certFile != "" && keyFile != "":
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	default:
+		return nil, errors.New("either --cert and --key, --self-signed, or --plain-http must be given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// loadFilter returns a filter with the domains of the given blocklist and
+// allowlist files.
+func loadFilter(blocklists, allowlists []string) (*doh.Filter, error) {
+	filter := doh.NewFilter()
+
+	load := func(path string, loadList func(io.Reader) error) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := loadList(f); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		return nil
+	}
+
+	for _, path := range blocklists {
+		if err := load(path, filter.LoadBlocklist); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range allowlists {
+		if err := load(path, filter.LoadAllowlist); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// loadZones returns the zones of the given zone files and hosts files.
+func loadZones(zoneFiles, hostsFiles []string) ([]*doh.Zone, error) {
+	var zones []*doh.Zone
+
+	load := func(path string, parse func(io.Reader) (*doh.Zone, error)) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		zone, err := parse(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		zones = append(zones, zone)
+
+		return nil
+	}
+
+	for _, path := range zoneFiles {
+		err := load(path, func(r io.Reader) (*doh.Zone, error) {
+			return doh.ParseZone(r, "", path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range hostsFiles {
+		if err := load(path, doh.ParseHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	return zones, nil
+}
+
+// parseRoutes parses routes given as "suffix=url", returning the upstream
+// URLs of each domain suffix, in order.
+func parseRoutes(routes []string) (map[string][]string, error) {
+	parsed := make(map[string][]string, len(routes))
+
+	for _, route := range routes {
+		suffix, upstream, ok := strings.Cut(route, "=")
+
+		suffix, upstream = strings.TrimSpace(suffix), strings.TrimSpace(upstream)
+		if !ok || suffix == "" || upstream == "" {
+			return nil, fmt.Errorf("route %q must be in the form suffix=url", route)
+		}
+
+		if _, err := doh.ParseUpstream(upstream, nil); err != nil {
+			return nil, fmt.Errorf("route %q: %w", route, err)
+		}
+
+		parsed[suffix] = append(parsed[suffix], upstream)
+	}
+
+	return parsed, nil
+}
+
+// checkUpstreams returns an error if any of the upstream URLs is invalid, so
+// that typos fail the command, rather than every query forwarded to them.
+func checkUpstreams(upstreams []string) error {
+	for _, upstream := range upstreams {
+		if _, err := doh.ParseUpstream(upstream, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var CommandServe = &cobra.Command{
+	Use:   "serve [flags]",
+	Short: "Run a DoH server forwarding queries to upstream DoH servers",
+	Long: `Run a DNS-over-HTTPS (DoH) server that forwards queries to upstream DoH servers.
+
+The server listens for RFC 8484 GET and POST requests, forwarding each query to the upstream servers
+using the given strategy, which by default tries each upstream in order until one succeeds. TLS is
+configured with the --cert and --key flags, or with a generated self-signed certificate for local
+development using --self-signed. Use --plain-http to serve without TLS when running behind a TLS
+terminating proxy. The server shuts down gracefully on interrupt.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, err := cmd.Flags().GetString("listen")
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %w", err)
+		}
+
+		path, err := cmd.Flags().GetString("path")
+		if err != nil {
+			return fmt.Errorf("invalid path: %w", err)
+		}
+
+		upstreams, err := cmd.Flags().GetStringSlice("upstream")
+		if err != nil {
+			return fmt.Errorf("invalid upstreams: %w", err)
+		}
+
+		for i, upstream := range upstreams {
+			upstreams[i] = strings.TrimSpace(upstream)
+		}
+
+		if err := checkUpstreams(upstreams); err != nil {
+			return fmt.Errorf("invalid upstreams: %w", err)
+		}
+
+		routeFlags, err := cmd.Flags().GetStringArray("route")
+		if err != nil {
+			return fmt.Errorf("invalid routes: %w", err)
+		}
+
+		routes, err := parseRoutes(routeFlags)
+		if err != nil {
+			return fmt.Errorf("invalid routes: %w", err)
+		}
+
+		upstreamTimeout, err := cmd.Flags().GetDuration("upstream-timeout")
+		if err != nil {
+			return fmt.Errorf("invalid upstream timeout: %w", err)
+		}
+
+		strategyName, err := cmd.Flags().GetString("strategy")
+		if err != nil {
+			return fmt.Errorf("invalid strategy: %w", err)
+		}
+
+		strategy, ok := doh.ParseStrategy(strategyName)
+		if !ok {
+			return fmt.Errorf("invalid strategy: unknown strategy %q", strategyName)
+		}
+
+		attemptTimeout, err := cmd.Flags().GetDuration("attempt-timeout")
+		if err != nil {
+			return fmt.Errorf("invalid attempt timeout: %w", err)
+		}
+
+		coalesce, err := cmd.Flags().GetBool("coalesce")
+		if err != nil {
+			return fmt.Errorf("invalid coalesce: %w", err)
+		}
+
+		cacheSize, err := cmd.Flags().GetInt("cache-size")
+		if err != nil {
+			return fmt.Errorf("invalid cache size: %w", err)
+		}
+
+		serveStale, err := cmd.Flags().GetBool("serve-stale")
+		if err != nil {
+			return fmt.Errorf("invalid serve stale: %w", err)
+		}
+
+		blocklists, err := cmd.Flags().GetStringSlice("blocklist")
+		if err != nil {
+			return fmt.Errorf("invalid blocklists: %w", err)
+		}
+
+		allowlists, err := cmd.Flags().GetStringSlice("allowlist")
+		if err != nil {
+			return fmt.Errorf("invalid allowlists: %w", err)
+		}
+
+		blockModeName, err := cmd.Flags().GetString("block-mode")
+		if err != nil {
+			return fmt.Errorf("invalid block mode: %w", err)
+		}
+
+		blockMode, ok := doh.ParseBlockMode(blockModeName)
+		if !ok {
+			return fmt.Errorf("invalid block mode: unknown block mode %q", blockModeName)
+		}
+
+		zoneFiles, err := cmd.Flags().GetStringSlice("zone")
+		if err != nil {
+			return fmt.Errorf("invalid zones: %w", err)
+		}
+
+		hostsFiles, err := cmd.Flags().GetStringSlice("hosts")
+		if err != nil {
+			return fmt.Errorf("invalid hosts files: %w", err)
+		}
+
+		doqListen, err := cmd.Flags().GetString("doq-listen")
+		if err != nil {
+			return fmt.Errorf("invalid doq listen address: %w", err)
+		}
+
+		ecsModeName, err := cmd.Flags().GetString("ecs")
+		if err != nil {
+			return fmt.Errorf("invalid ecs mode: %w", err)
+		}
+
+		var (
+			ecsMode doh.ClientSubnetMode
+			ecs     = ecsModeName != ""
+		)
+
+		if ecs {
+			ecsMode, ok = doh.ParseClientSubnetMode(ecsModeName)
+			if !ok {
+				return fmt.Errorf("invalid ecs mode: unknown ecs mode %q", ecsModeName)
+			}
+		}
+
+		padding, err := cmd.Flags().GetBool("padding")
+		if err != nil {
+			return fmt.Errorf("invalid padding: %w", err)
+		}
+
+		enableHTTP3, err := cmd.Flags().GetBool("http3")
+		if err != nil {
+			return fmt.Errorf("invalid http3: %w", err)
+		}
+
+		statusPath, err := cmd.Flags().GetString("status-path")
+		if err != nil {
+			return fmt.Errorf("invalid status path: %w", err)
+		}
+
+		plainHTTP, err := cmd.Flags().GetBool("plain-http")
+		if err != nil {
+			return fmt.Errorf("invalid plain http: %w", err)
+		}
+
+		selfSigned, err := cmd.Flags().GetBool("self-signed")
+		if err != nil {
+			return fmt.Errorf("invalid self signed: %w", err)
+		}
+
+		certFile, err := cmd.Flags().GetString("cert")
+		if err != nil {
+			return fmt.Errorf("invalid cert: %w", err)
+		}
+
+		keyFile, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+
+		shutdownTimeout, err := cmd.Flags().GetDuration("shutdown-timeout")
+		if err != nil {
+			return fmt.Errorf("invalid shutdown timeout: %w", err)
+		}
+
+		if doqListen != "" && plainHTTP {
+			return errors.New("--doq-listen requires TLS, and can't be used with --plain-http")
+		}
+
+		if enableHTTP3 && plainHTTP {
+			return errors.New("--http3 requires TLS, and can't be used with --plain-http")
+		}
+
+		logger := slog.New(slog.NewTextHandler(cmd.ErrOrStderr(), nil))
+
+		upstreamClient := cleanhttp.DefaultPooledClient()
+		upstreamClient.Timeout = upstreamTimeout
+
+		proxyOpts := doh.ProxyOptions{
+			HTTPClient:     upstreamClient,
+			Strategy:       strategy,
+			AttemptTimeout: attemptTimeout,
+			Coalesce:       coalesce,
+		}
+
+		proxy := doh.NewProxy(proxyOpts, upstreams...)
+
+		forwarder := proxy.Handler()
+
+		if len(routes) > 0 {
+			routeHandlers := make(map[string]doh.Handler, len(routes))
+			for suffix, routeUpstreams := range routes {
+				routeHandlers[suffix] = doh.NewProxy(proxyOpts, routeUpstreams...).Handler()
+			}
+
+			forwarder = doh.RouteHandler(routeHandlers, forwarder)
+		}
+
+		middlewares := []doh.Middleware{doh.Recover(logger)}
+
+		// The client subnet is handled before the cache, so that cached
+		// responses are keyed by the subnet that is forwarded upstream.
+		if ecs {
+			middlewares = append(middlewares, func(next doh.Handler) doh.Handler {
+				return doh.ClientSubnetHandler(next, doh.ClientSubnetOptions{Mode: ecsMode})
+			})
+		}
+
+		if len(blocklists) > 0 {
+			filter, err := loadFilter(blocklists, allowlists)
+			if err != nil {
+				return fmt.Errorf("error loading blocklists: %w", err)
+			}
+
+			logger.Info("loaded blocklists", "domains", filter.Len())
+
+			middlewares = append(middlewares, func(next doh.Handler) doh.Handler {
+				return doh.FilterHandler(next, doh.FilterOptions{
+					Filter: filter,
+					Mode:   blockMode,
+				})
+			})
+		}
+
+		if len(zoneFiles) > 0 || len(hostsFiles) > 0 {
+			zones, err := loadZones(zoneFiles, hostsFiles)
+			if err != nil {
+				return fmt.Errorf("error loading zones: %w", err)
+			}
+
+			middlewares = append(middlewares, func(next doh.Handler) doh.Handler {
+				return doh.ZoneHandler(next, zones...)
+			})
+		}
+
+		if cacheSize > 0 {
+			middlewares = append(middlewares, func(next doh.Handler) doh.Handler {
+				return doh.CacheHandler(next, doh.CacheOptions{
+					Size:       cacheSize,
+					ServeStale: serveStale,
+				})
+			})
+		}
+
+		handler := doh.Chain(forwarder, middlewares...)
+
+		mux := http.NewServeMux()
+		mux.Handle(path, doh.NewHandler(handler, doh.ServerOptions{
+			Path:           path,
+			Logger:         logger,
+			DisablePadding: !padding,
+		}))
+
+		if statusPath != "" {
+			mux.Handle(statusPath, proxy.StatusHandler())
+		}
+
+		server := &http.Server{
+			Addr:              listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		if !plainHTTP {
+			server.TLSConfig, err = serverTLSConfig(certFile, keyFile, selfSigned)
+			if err != nil {
+				return fmt.Errorf("error configuring tls: %w", err)
+			}
+		}
+
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return fmt.Errorf("error listening: %w", err)
+		}
+
+		logger.Info("serving doh", "addr", ln.Addr().String(), "path", path, "tls", !plainHTTP, "upstreams", upstreams)
+
+		serveErr := make(chan error, 3)
+
+		var h3Server *http3.Server
+
+		if enableHTTP3 {
+			// Serve HTTP/3 on the same port over UDP, advertised to clients
+			// with an Alt-Svc header on HTTPS responses.
+			pc, err := net.ListenPacket("udp", ln.Addr().String())
+			if err != nil {
+				ln.Close()
+				return fmt.Errorf("error listening for http3: %w", err)
+			}
+			defer pc.Close()
+
+			h3Server = doh.NewHTTP3Server(mux, server.TLSConfig)
+			server.Handler = doh.AltSvcHandler(mux, h3Server)
+
+			logger.Info("serving doh over http3", "addr", pc.LocalAddr().String())
+
+			go func() {
+				if err := h3Server.Serve(pc); !errors.Is(err, http.ErrServerClosed) {
+					serveErr <- fmt.Errorf("http3: %w", err)
+				}
+			}()
+		}
+
+		go func() {
+			if plainHTTP {
+				serveErr <- server.Serve(ln)
+			} else {
+				serveErr <- server.ServeTLS(ln, "", "")
+			}
+		}()
+
+		doqCtx, stopDoQ := context.WithCancel(context.Background())
+		defer stopDoQ()
+
+		doqDone := make(chan struct{})
+
+		if doqListen != "" {
+			doqLn, err := doh.ListenQUIC(doqListen, server.TLSConfig)
+			if err != nil {
+				server.Close()
+				return fmt.Errorf("error listening for doq: %w", err)
+			}
+
+			logger.Info("serving doq", "addr", doqLn.Addr().String())
+
+			doqServer := doh.NewQUICServer(handler, doh.QUICServerOptions{Logger: logger})
+
+			go func() {
+				defer close(doqDone)
+
+				if err := doqServer.Serve(doqCtx, doqLn); err != nil {
+					serveErr <- fmt.Errorf("doq: %w", err)
+				}
+			}()
+		} else {
+			close(doqDone)
+		}
+
+		select {
+		case err := <-serveErr:
+			stopDoQ()
+			server.Close()
+			if h3Server != nil {
+				h3Server.Close()
+			}
+			return fmt.Errorf("error serving: %w", err)
+		case <-cmd.Context().Done():
+		}
+
+		logger.Info("shutting down doh server")
+
+		stopDoQ()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("error shutting down: %w", err)
+		}
+
+		if h3Server != nil {
+			if err := h3Server.Shutdown(ctx); err != nil {
+				return fmt.Errorf("error shutting down http3: %w", err)
+			}
+		}
+
+		<-doqDone
+
+		return nil
+	},
+}
+
+func init() {
+	defaultUpstreams := []string{
+		doh.Google,
+		doh.Cloudflare,
+		doh.Quad9,
+	}
+
+	CommandServe.Flags().String("listen", ":443", "address to listen on for DoH requests")
+	CommandServe.Flags().String("path", doh.DefaultPath, "url path of the DoH endpoint")
+	CommandServe.Flags().StringSlice("upstream", defaultUpstreams, "upstream servers to forward queries to, as DoH URLs or udp://, tcp://, tls:// (DoT), or quic:// (DoQ) addresses")
+	CommandServe.Flags().StringArray("route", nil, "forward queries for a domain suffix to a different upstream, as suffix=url (e.g. corp.example=https://10.0.0.1/dns-query), longest suffix wins")
+	CommandServe.Flags().String("strategy", doh.StrategySequential.String(), "upstream selection strategy (sequential, race, round-robin, random, or fastest)")
+	CommandServe.Flags().Duration("attempt-timeout", 0, "timeout for each attempt against a single upstream before trying the next, 0s for no timeout")
+	CommandServe.Flags().Bool("coalesce", true, "merge concurrent identical queries into a single upstream query")
+	CommandServe.Flags().Int("cache-size", doh.DefaultCacheSize, "maximum number of cached responses, 0 to disable caching")
+	CommandServe.Flags().Bool("serve-stale", false, "serve expired cached responses when all upstreams fail (RFC 8767)")
+	CommandServe.Flags().StringSlice("blocklist", nil, "hosts, domain, or adblock-style list files of domains to block")
+	CommandServe.Flags().StringSlice("allowlist", nil, "list files of domains to never block, overriding the blocklists")
+	CommandServe.Flags().String("block-mode", doh.BlockNXDomain.String(), "how to answer blocked queries (nxdomain, null, or refused)")
+	CommandServe.Flags().StringSlice("zone", nil, "RFC 1035 zone files to answer queries from instead of forwarding them")
+	CommandServe.Flags().StringSlice("hosts", nil, "hosts files to answer queries from instead of forwarding them (e.g. /etc/hosts)")
+	CommandServe.Flags().String("doq-listen", "", "UDP address to also serve DNS over QUIC (RFC 9250) on, disabled if empty (e.g. :853)")
+	CommandServe.Flags().String("ecs", "", "how to handle EDNS Client Subnet (RFC 7871) in queries (strip, truncate to /24 and /56, or synthesize from the client address), forwarded unchanged if empty")
+	CommandServe.Flags().Bool("padding", true, "pad responses to padded queries with EDNS(0) padding (RFC 7830) to hide the length of the answers")
+	CommandServe.Flags().Bool("http3", false, "also serve HTTP/3 on the same port over UDP, advertised to clients with an Alt-Svc header")
+	CommandServe.Flags().String("status-path", "", "url path of a JSON endpoint reporting upstream health, disabled if empty (e.g. /status)")
+	CommandServe.Flags().Duration("upstream-timeout", 10*time.Second, "timeout for each upstream query")
+	CommandServe.Flags().String("cert", "", "path to a PEM encoded TLS certificate file")
+	CommandServe.Flags().String("key", "", "path to a PEM encoded TLS private key file")
+	CommandServe.Flags().Bool("self-signed", false, "use a generated self-signed TLS certificate for local development")
+	CommandServe.Flags().Bool("plain-http", false, "serve plain HTTP without TLS (e.g. behind a TLS terminating proxy)")
+	CommandServe.Flags().Duration("shutdown-timeout", 10*time.Second, "maximum time to wait for in-flight requests on shutdown")
+
+	CommandRoot.AddCommand(CommandServe)
+}
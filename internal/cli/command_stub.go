@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/picatz/doh/pkg/doh"
+	"github.com/spf13/cobra"
+)
+
+var CommandStub = &cobra.Command{
+	Use:   "stub [flags]",
+	Short: "Run a local DNS stub resolver forwarding queries to upstream DoH servers",
+	Long: `Run a plain DNS stub resolver that forwards queries to upstream DoH servers.
+
+The stub resolver listens for DNS queries over both UDP and TCP, so that local applications which only
+speak plain DNS can use encrypted DNS, forwarding each query to the upstream servers using the given
+strategy, which by default tries each upstream in order until one succeeds. UDP responses that are
+too large for the client are truncated, so it can retry over TCP. The stub resolver shuts down
+gracefully on interrupt.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		listen, err := cmd.Flags().GetString("listen")
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %w", err)
+		}
+
+		upstreams, err := cmd.Flags().GetStringSlice("upstream")
+		if err != nil {
+			return fmt.Errorf("invalid upstreams: %w", err)
+		}
+
+		for i, upstream := range upstreams {
+			upstreams[i] = strings.TrimSpace(upstream)
+		}
+
+		if err := checkUpstreams(upstreams); err != nil {
+			return fmt.Errorf("invalid upstreams: %w", err)
+		}
+
+		strategyName, err := cmd.Flags().GetString("strategy")
+		if err != nil {
+			return fmt.Errorf("invalid strategy: %w", err)
+		}
+
+		strategy, ok := doh.ParseStrategy(strategyName)
+		if !ok {
+			return fmt.Errorf("invalid strategy: unknown strategy %q", strategyName)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+
+		cacheSize, err := cmd.Flags().GetInt("cache-size")
+		if err != nil {
+			return fmt.Errorf("invalid cache size: %w", err)
+		}
+
+		logger := slog.New(slog.NewTextHandler(cmd.ErrOrStderr(), nil))
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			HTTPClient: cleanhttp.DefaultPooledClient(),
+			Strategy:   strategy,
+			Coalesce:   true,
+		}, upstreams...)
+
+		middlewares := []doh.Middleware{doh.Recover(logger)}
+
+		if cacheSize > 0 {
+			middlewares = append(middlewares, func(next doh.Handler) doh.Handler {
+				return doh.CacheHandler(next, doh.CacheOptions{Size: cacheSize})
+			})
+		}
+
+		stub := doh.NewStubResolver(doh.Chain(proxy.Handler(), middlewares...), doh.StubOptions{
+			Timeout: timeout,
+			Logger:  logger,
+		})
+
+		logger.Info("serving dns", "addr", listen, "upstreams", upstreams)
+
+		if err := stub.ListenAndServe(cmd.Context(), listen); err != nil {
+			return fmt.Errorf("error serving: %w", err)
+		}
+
+		logger.Info("shut down dns stub resolver")
+
+		return nil
+	},
+}
+
+func init() {
+	defaultUpstreams := []string{
+		doh.Google,
+		doh.Cloudflare,
+		doh.Quad9,
+	}
+
+	CommandStub.Flags().String("listen", "127.0.0.1:53", "address to listen on for UDP and TCP DNS queries")
+	CommandStub.Flags().StringSlice("upstream", defaultUpstreams, "upstream servers to forward queries to, as DoH URLs or udp://, tcp://, tls:// (DoT), or quic:// (DoQ) addresses")
+	CommandStub.Flags().String("strategy", doh.StrategySequential.String(), "upstream selection strategy (sequential, race, round-robin, random, or fastest)")
+	CommandStub.Flags().Duration("timeout", doh.DefaultStubTimeout, "maximum time to answer each query")
+	CommandStub.Flags().Int("cache-size", doh.DefaultCacheSize, "maximum number of cached responses, 0 to disable caching")
+
+	CommandRoot.AddCommand(CommandStub)
+}
@@ -2,20 +2,75 @@ package cli_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/miekg/dns"
 	"github.com/picatz/doh/internal/cli"
 	"github.com/picatz/doh/pkg/doh"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/spf13/pflag"
 )
 
+// resetFlags resets all of the CLI subcommands' changed flags back to their
+// default values, since commands (and their flags) are shared package-level
+// variables that would otherwise leak state between test cases.
+func resetFlags(t *testing.T) {
+	t.Helper()
+
+	for _, cmd := range cli.CommandRoot.Commands() {
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if !f.Changed {
+				return
+			}
+
+			f.Changed = false
+
+			// Slice flags append on each subsequent Set call, so they need
+			// a fresh value instead of re-setting the default value.
+			switch f.Value.Type() {
+			case "stringSlice":
+				var defaults []string
+				if def := strings.Trim(f.DefValue, "[]"); def != "" {
+					defaults = strings.Split(def, ",")
+				}
+
+				fs := pflag.NewFlagSet(f.Name, pflag.ContinueOnError)
+				fs.StringSlice(f.Name, defaults, f.Usage)
+				f.Value = fs.Lookup(f.Name).Value
+				return
+			case "stringArray":
+				fs := pflag.NewFlagSet(f.Name, pflag.ContinueOnError)
+				fs.StringArray(f.Name, nil, f.Usage)
+				f.Value = fs.Lookup(f.Name).Value
+				return
+			}
+
+			if err := f.Value.Set(f.DefValue); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func testCommand(t *testing.T, args ...string) io.Reader {
 	t.Helper()
 
+	t.Cleanup(func() { resetFlags(t) })
+
 	cli.CommandRoot.SetArgs(args)
 
 	output := bytes.NewBuffer(nil)
@@ -128,3 +183,441 @@ func TestCommand_Query_InsecureSkipVerify(t *testing.T) {
 
 	t.Log(string(b))
 }
+
+func TestCommand_Query_Method(t *testing.T) {
+	var gotMethod string
+
+	mux := doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		gotMethod = httpReq.Method
+
+		return new(dns.Msg).SetReply(dnsReq), nil
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	dohServerURL := server.URL + "/dns-query"
+
+	testCommand(t, "query", "google.com", "--method", "post", "--servers", dohServerURL)
+
+	if gotMethod != http.MethodPost {
+		t.Fatalf("got method %s, want %s", gotMethod, http.MethodPost)
+	}
+}
+
+func TestCommand_Query_DNSSEC(t *testing.T) {
+	var gotDO, gotCD bool
+
+	mux := doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		gotDO = dnsReq.IsEdns0() != nil && dnsReq.IsEdns0().Do()
+		gotCD = dnsReq.CheckingDisabled
+
+		return new(dns.Msg).SetReply(dnsReq), nil
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	testCommand(t, "query", "google.com", "--dnssec", "--checking-disabled", "--servers", server.URL+"/dns-query")
+
+	if !gotDO || !gotCD {
+		t.Fatalf("got DO %v and CD %v, want both set", gotDO, gotCD)
+	}
+}
+
+func TestCommand_Query_Validate(t *testing.T) {
+	// The server answers without any DNSSEC records, which are bogus under
+	// the signed root zone of the trust anchor.
+	mux := doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		dnsResp := new(dns.Msg).SetReply(dnsReq)
+
+		if dnsReq.Question[0].Qtype == dns.TypeA {
+			dnsResp.Answer = append(dnsResp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   dnsReq.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.ParseIP("8.8.8.8"),
+			})
+		}
+
+		return dnsResp, nil
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	trustAnchor := filepath.Join(t.TempDir(), "root.key")
+
+	err := os.WriteFile(trustAnchor, []byte(". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := testCommand(t, "query", "google.com", "--validate", "--trust-anchor", trustAnchor, "--servers", server.URL+"/dns-query")
+
+	var result struct {
+		Validation struct {
+			Status  string `json:"status"`
+			Answers []struct {
+				Status string `json:"status"`
+			} `json:"answers"`
+		} `json:"validation"`
+	}
+
+	if err := json.NewDecoder(output).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Validation.Status != "bogus" {
+		t.Errorf("got validation status %q, want %q", result.Validation.Status, "bogus")
+	}
+
+	if len(result.Validation.Answers) != 1 || result.Validation.Answers[0].Status != "bogus" {
+		t.Errorf("got answer validations %+v, want one bogus answer", result.Validation.Answers)
+	}
+}
+
+func TestCommand_Query_HTTP3(t *testing.T) {
+	var gotProto atomic.Int32
+
+	mux := doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		gotProto.Store(int32(httpReq.ProtoMajor))
+
+		return new(dns.Msg).SetReply(dnsReq), nil
+	})
+
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	// Serve HTTP/3 on the same port as the HTTPS server, over UDP.
+	pc, err := net.ListenPacket("udp", server.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("can't listen on the server's port over udp: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	h3Server := doh.NewHTTP3Server(mux, server.TLS)
+	go h3Server.Serve(pc)
+	t.Cleanup(func() { h3Server.Close() })
+
+	testCommand(t, "query", "google.com", "--http3", "--insecure-skip-verify", "--servers", server.URL+"/dns-query")
+
+	if proto := gotProto.Load(); proto != 3 {
+		t.Fatalf("got HTTP/%d, want HTTP/3", proto)
+	}
+}
+
+// freeAddr returns a local TCP address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestCommand_Serve(t *testing.T) {
+	upstream := httptest.NewServer(doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		dnsResp := new(dns.Msg).SetReply(dnsReq)
+		dnsResp.Answer = append(dnsResp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   dnsReq.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			A: net.ParseIP("8.8.8.8"),
+		})
+
+		return dnsResp, nil
+	}))
+	t.Cleanup(upstream.Close)
+
+	// The routed upstream answers with no records, to tell it apart from
+	// the default upstream.
+	routed := httptest.NewServer(doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		return new(dns.Msg).SetReply(dnsReq), nil
+	}))
+	t.Cleanup(routed.Close)
+
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(blocklist, []byte("0.0.0.0 google.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		args        []string
+		scheme      string
+		doq         bool
+		http3       bool
+		wantAnswers int
+	}{
+		{
+			name:        "plain http",
+			args:        []string{"--plain-http"},
+			scheme:      "http",
+			wantAnswers: 1,
+		},
+		{
+			name:        "self signed",
+			args:        []string{"--self-signed"},
+			scheme:      "https",
+			wantAnswers: 1,
+		},
+		{
+			name:        "doq",
+			args:        []string{"--self-signed"},
+			scheme:      "https",
+			doq:         true,
+			wantAnswers: 1,
+		},
+		{
+			name:        "http3",
+			args:        []string{"--self-signed", "--http3"},
+			scheme:      "https",
+			http3:       true,
+			wantAnswers: 1,
+		},
+		{
+			name:        "blocklist",
+			args:        []string{"--plain-http", "--blocklist", blocklist},
+			scheme:      "http",
+			wantAnswers: 0,
+		},
+		{
+			name:        "route",
+			args:        []string{"--plain-http", "--route", "google.com=" + routed.URL + "/dns-query"},
+			scheme:      "http",
+			wantAnswers: 0,
+		},
+		{
+			name:        "other route",
+			args:        []string{"--plain-http", "--route", "example.com=" + routed.URL + "/dns-query"},
+			scheme:      "http",
+			wantAnswers: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() { resetFlags(t) })
+
+			addr := freeAddr(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			args := append([]string{"serve", "--listen", addr, "--upstream", upstream.URL + "/dns-query"}, test.args...)
+			if test.doq {
+				args = append(args, "--doq-listen", addr)
+			}
+
+			cli.CommandRoot.SetArgs(args)
+			cli.CommandRoot.SetErr(io.Discard)
+
+			// Cobra only passes the root context to a subcommand once, so
+			// it has to be set directly for each test case.
+			cli.CommandServe.SetContext(ctx)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- cli.CommandRoot.ExecuteContext(ctx)
+			}()
+
+			httpClient := cleanhttp.DefaultClient()
+			httpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
+
+			serverURL := test.scheme + "://" + addr + "/dns-query"
+
+			var (
+				resp *dns.Msg
+				err  error
+			)
+
+			// Wait for the server to start listening.
+			for range 50 {
+				resp, err = doh.Query(ctx, httpClient, serverURL, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+				if err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(resp.Answer) != test.wantAnswers {
+				t.Errorf("got %d answers, want %d", len(resp.Answer), test.wantAnswers)
+			}
+
+			if test.http3 {
+				h3Client := &http.Client{Transport: &http3.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}}
+
+				resp, err = doh.Query(ctx, h3Client, serverURL, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(resp.Answer) != test.wantAnswers {
+					t.Errorf("got %d http3 answers, want %d", len(resp.Answer), test.wantAnswers)
+				}
+			}
+
+			if test.doq {
+				doqUpstream := &doh.QUICUpstream{
+					Addr:      addr,
+					TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				}
+				defer doqUpstream.Close()
+
+				// Wait for the DoQ listener, which starts after the DoH one.
+				for range 50 {
+					resp, err = doqUpstream.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+					if err == nil {
+						break
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(resp.Answer) != test.wantAnswers {
+					t.Errorf("got %d doq answers, want %d", len(resp.Answer), test.wantAnswers)
+				}
+			}
+
+			cancel()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not shut down")
+			}
+		})
+	}
+}
+
+func TestCommand_InvalidUpstream(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "serve upstream scheme",
+			args: []string{"serve", "--plain-http", "--upstream", "htps://dns.google/dns-query"},
+		},
+		{
+			name: "serve upstream without scheme",
+			args: []string{"serve", "--plain-http", "--upstream", "8.8.8.8:53"},
+		},
+		{
+			name: "serve route",
+			args: []string{"serve", "--plain-http", "--route", "corp.example=dns.google"},
+		},
+		{
+			name: "stub upstream",
+			args: []string{"stub", "--upstream", "udp://"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() { resetFlags(t) })
+
+			cli.CommandRoot.SetArgs(append(test.args, "--listen", freeAddr(t)))
+			cli.CommandRoot.SetOut(io.Discard)
+			cli.CommandRoot.SetErr(io.Discard)
+
+			err := cli.CommandRoot.Execute()
+			if !errors.Is(err, doh.ErrUnsupportedUpstream) {
+				t.Fatalf("got error %v, want %v", err, doh.ErrUnsupportedUpstream)
+			}
+		})
+	}
+}
+
+func TestCommand_Stub(t *testing.T) {
+	upstream := httptest.NewServer(doh.NewServerMux(func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error) {
+		dnsResp := new(dns.Msg).SetReply(dnsReq)
+		dnsResp.Answer = append(dnsResp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   dnsReq.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			A: net.ParseIP("8.8.8.8"),
+		})
+
+		return dnsResp, nil
+	}))
+	t.Cleanup(upstream.Close)
+
+	t.Cleanup(func() { resetFlags(t) })
+
+	addr := freeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cli.CommandRoot.SetArgs([]string{"stub", "--listen", addr, "--upstream", upstream.URL + "/dns-query"})
+	cli.CommandRoot.SetErr(io.Discard)
+	cli.CommandStub.SetContext(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.CommandRoot.ExecuteContext(ctx)
+	}()
+
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network, Timeout: time.Second}
+
+		var (
+			resp *dns.Msg
+			err  error
+		)
+
+		// Wait for the stub resolver to start listening.
+		for range 50 {
+			resp, _, err = client.Exchange(new(dns.Msg).SetQuestion("google.com.", dns.TypeA), addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Errorf("got %d answers over %s, want 1", len(resp.Answer), network)
+		}
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stub resolver did not shut down")
+	}
+}
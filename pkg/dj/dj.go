@@ -10,7 +10,10 @@ package dj
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Request is a DNS query to a DoH server using the JSON API.
@@ -31,12 +34,122 @@ type Response struct {
 		Name string `json:"name"`
 		Type int    `json:"type"`
 	} `json:"Question"`
-	Answer []struct {
-		Name string `json:"name"`
-		Type int    `json:"type"`
-		TTL  int    `json:"TTL"`
-		Data string `json:"data"`
-	} `json:"Answer"`
+	Answer     []Record `json:"Answer"`
+	Authority  []Record `json:"Authority,omitempty"`  // e.g. the SOA of negative answers
+	Additional []Record `json:"Additional,omitempty"` // e.g. glue of referrals
+
+	// Comment is a diagnostic message of the server, such as why an answer
+	// failed DNSSEC validation, if any.
+	Comment string `json:"Comment,omitempty"`
+
+	// EDNSClientSubnet is the EDNS Client Subnet of the response, as the
+	// address and scope prefix length (e.g. 203.0.113.0/24), if any.
+	EDNSClientSubnet string `json:"edns_client_subnet,omitempty"`
+}
+
+// UnmarshalJSON decodes a response, accepting a Comment given as a list of
+// messages, as some servers do, which are joined into one.
+func (r *Response) UnmarshalJSON(data []byte) error {
+	type response Response
+
+	aux := struct {
+		*response
+		Comment json.RawMessage `json:"Comment"`
+	}{
+		response: (*response)(r),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	r.Comment = ""
+
+	if len(aux.Comment) == 0 || string(aux.Comment) == "null" {
+		return nil
+	}
+
+	if err := json.Unmarshal(aux.Comment, &r.Comment); err == nil {
+		return nil
+	}
+
+	var comments []string
+
+	if err := json.Unmarshal(aux.Comment, &comments); err != nil {
+		return fmt.Errorf("invalid Comment: %w", err)
+	}
+
+	r.Comment = strings.Join(comments, "; ")
+
+	return nil
+}
+
+// Record is a DNS resource record in a [Response].
+//
+// DNSSEC records also carry their fields in structured form, as one of
+// RRSIG, DNSKEY, DS, NSEC, or NSEC3, which DoH JSON API servers don't
+// provide, but are set by clients converting DNS messages.
+type Record struct {
+	Name string `json:"name"` // owner name (e.g. google.com.)
+	Type int    `json:"type"` // record type (e.g. 1 for A)
+	TTL  int    `json:"TTL"`  // time to live, in seconds
+	Data string `json:"data"` // record data in presentation format
+
+	RRSIG  *RRSIG  `json:"rrsig,omitempty"`
+	DNSKEY *DNSKEY `json:"dnskey,omitempty"`
+	DS     *DS     `json:"ds,omitempty"`
+	NSEC   *NSEC   `json:"nsec,omitempty"`
+	NSEC3  *NSEC3  `json:"nsec3,omitempty"`
+}
+
+// RRSIG is the data of an RRSIG record, a DNSSEC signature over the
+// records of the covered type with the same owner name.
+type RRSIG struct {
+	TypeCovered string    `json:"type_covered"` // signed record type (e.g. A)
+	Algorithm   int       `json:"algorithm"`    // signing algorithm (e.g. 13 for ECDSAP256SHA256)
+	Labels      int       `json:"labels"`       // labels in the original owner name
+	OriginalTTL int       `json:"original_ttl"` // TTL of the signed records
+	Expiration  time.Time `json:"expiration"`   // signature is not valid after
+	Inception   time.Time `json:"inception"`    // signature is not valid before
+	KeyTag      int       `json:"key_tag"`      // key tag of the signing DNSKEY
+	SignerName  string    `json:"signer_name"`  // zone of the signing DNSKEY
+	Signature   string    `json:"signature"`    // base64 encoded signature
+}
+
+// DNSKEY is the data of a DNSKEY record, a public key of a signed zone.
+type DNSKEY struct {
+	Flags     int    `json:"flags"`      // 256 for a zone signing key, 257 for a key signing key
+	Protocol  int    `json:"protocol"`   // always 3
+	Algorithm int    `json:"algorithm"`  // key algorithm (e.g. 13 for ECDSAP256SHA256)
+	PublicKey string `json:"public_key"` // base64 encoded public key
+	KeyTag    int    `json:"key_tag"`    // key tag, as referenced by RRSIG and DS records
+}
+
+// DS is the data of a DS record, a digest of a child zone's DNSKEY, which
+// is published by its parent zone.
+type DS struct {
+	KeyTag     int    `json:"key_tag"`     // key tag of the DNSKEY
+	Algorithm  int    `json:"algorithm"`   // algorithm of the DNSKEY
+	DigestType int    `json:"digest_type"` // digest algorithm (e.g. 2 for SHA-256)
+	Digest     string `json:"digest"`      // hex encoded digest
+}
+
+// NSEC is the data of an NSEC record, proving that no names exist between
+// its owner name and the next domain name, and which types the owner has.
+type NSEC struct {
+	NextDomain string   `json:"next_domain"` // next owner name in the zone
+	Types      []string `json:"types"`       // record types of the owner name
+}
+
+// NSEC3 is the data of an NSEC3 record, which is like an NSEC record, but
+// proves non-existence over hashed owner names.
+type NSEC3 struct {
+	HashAlgorithm int      `json:"hash_algorithm"` // always 1 for SHA-1
+	Flags         int      `json:"flags"`          // 1 if the opt-out flag is set
+	Iterations    int      `json:"iterations"`     // additional hash iterations
+	Salt          string   `json:"salt"`           // hex encoded salt, or "-" for none
+	NextDomain    string   `json:"next_domain"`    // next hashed owner name, base32hex encoded
+	Types         []string `json:"types"`          // record types of the owner name
 }
 
 // KnownServer is a known DoH server URL.
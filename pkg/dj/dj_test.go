@@ -2,6 +2,7 @@ package dj_test
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 
 	"github.com/hashicorp/go-cleanhttp"
@@ -59,3 +60,58 @@ func TestQuery(t *testing.T) {
 		}
 	})
 }
+
+func TestResponse_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantComment string
+		wantErr     bool
+	}{
+		{
+			name: "no comment",
+			data: `{"Status": 0, "Answer": [{"name": "example.com.", "type": 1, "TTL": 300, "data": "192.0.2.1"}]}`,
+		},
+		{
+			name:        "comment string",
+			data:        `{"Status": 2, "Comment": "DNSSEC validation failure."}`,
+			wantComment: "DNSSEC validation failure.",
+		},
+		{
+			name:        "comment list",
+			data:        `{"Status": 2, "Comment": ["EDE(9): DNSKEY Missing", "EDE(22): No Reachable Authority"]}`,
+			wantComment: "EDE(9): DNSKEY Missing; EDE(22): No Reachable Authority",
+		},
+		{
+			name:    "invalid comment",
+			data:    `{"Status": 2, "Comment": 1}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var resp dj.Response
+
+			err := json.Unmarshal([]byte(test.data), &resp)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			if resp.Comment != test.wantComment {
+				t.Errorf("got comment %q, want %q", resp.Comment, test.wantComment)
+			}
+		})
+	}
+
+	var resp dj.Response
+
+	err := json.Unmarshal([]byte(`{"Status": 3, "Authority": [{"name": "example.com.", "type": 6, "TTL": 300, "data": "ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"}]}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status != 3 || len(resp.Authority) != 1 || resp.Authority[0].Type != 6 {
+		t.Errorf("got response %+v, want status 3 with one SOA authority record", resp)
+	}
+}
@@ -6,12 +6,8 @@ package doh
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
-	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/picatz/doh/pkg/dj"
@@ -67,47 +63,11 @@ var (
 )
 
 // Query performs a DNS query using a DoH server URL and a DNS message.
+//
+// It is a thin wrapper around [Client.Exchange], and a reusable [Client]
+// should be preferred when performing many queries with the same settings.
 func Query(ctx context.Context, httpClient *http.Client, serverURL string, dnsReq *dns.Msg) (*dns.Msg, error) {
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFailedHTTPRequest, err)
-	}
-
-	httpReq.Header.Set("Accept", "application/dns-message")
-
-	q := httpReq.URL.Query()
-
-	dnsReqBytes, err := dnsReq.Pack()
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFailedDNSRequestPack, err)
-	}
-
-	q.Set("dns", base64.RawURLEncoding.EncodeToString(dnsReqBytes))
-
-	httpReq.URL.RawQuery = q.Encode()
-
-	httpResp, err := httpClient.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFailedHTTPRequest, err)
-	}
-	defer httpResp.Body.Close()
-
-	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%w: %s", ErrFailedHTTPRequest, httpResp.Status)
-	}
-
-	body, err := io.ReadAll(httpResp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFailedHTTPResponseRead, err)
-	}
-
-	dnsResp := &dns.Msg{}
-	err = dnsResp.Unpack(body)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %w", ErrFailedDNSResponseUnpack, err)
-	}
-
-	return dnsResp, nil
+	return NewClient(WithHTTPClient(httpClient), WithServers(serverURL)).Exchange(ctx, dnsReq)
 }
 
 // SimpleQuery performs a DNS query using a DoH server using the
@@ -120,87 +80,5 @@ func Query(ctx context.Context, httpClient *http.Client, serverURL string, dnsRe
 //
 // [RFC 8484]: https://tools.ietf.org/html/rfc8484
 func SimpleQuery(ctx context.Context, httpClient *http.Client, server string, req *dj.Request) (*dj.Response, error) {
-	var qClass uint16
-	switch req.Type {
-	case "ANY":
-		qClass = dns.ClassANY
-	default:
-		qClass = dns.ClassINET
-	}
-
-	dnsResp, err := Query(ctx, httpClient, server, &dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			RecursionDesired: true,
-		},
-		Question: []dns.Question{
-			{
-				Name:   dns.Fqdn(req.Name),
-				Qtype:  dns.StringToType[req.Type],
-				Qclass: qClass,
-			},
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	resp := &dj.Response{
-		Status: int(dnsResp.Rcode),
-		TC:     dnsResp.Truncated,
-		RD:     dnsResp.RecursionDesired,
-		RA:     dnsResp.RecursionAvailable,
-		AD:     dnsResp.AuthenticatedData,
-		CD:     dnsResp.CheckingDisabled,
-	}
-
-	for _, question := range dnsResp.Question {
-		resp.Question = append(resp.Question, struct {
-			Name string `json:"name"`
-			Type int    `json:"type"`
-		}{
-			Name: question.Name,
-			Type: int(question.Qtype),
-		})
-	}
-
-	for _, answer := range dnsResp.Answer {
-		var data string
-
-		// Extract main information from the answer (IP address, etc.)
-		// and add it to the response.
-		switch answer := answer.(type) {
-		case *dns.A:
-			data = answer.A.String()
-		case *dns.AAAA:
-			data = answer.AAAA.String()
-		case *dns.CNAME:
-			data = answer.Target
-		case *dns.MX:
-			data = answer.Mx
-		case *dns.NS:
-			data = answer.Ns
-		case *dns.PTR:
-			data = answer.Ptr
-		case *dns.SOA:
-			data = answer.Ns
-		case *dns.TXT:
-			data = strings.Join(answer.Txt, " ")
-		default:
-			data = answer.String()
-		}
-
-		resp.Answer = append(resp.Answer, struct {
-			Name string `json:"name"`
-			Type int    `json:"type"`
-			TTL  int    `json:"TTL"`
-			Data string `json:"data"`
-		}{
-			Name: answer.Header().Name,
-			Type: int(answer.Header().Rrtype),
-			TTL:  int(answer.Header().Ttl),
-			Data: data,
-		})
-	}
-
-	return resp, nil
+	return NewClient(WithHTTPClient(httpClient), WithServers(server)).SimpleQuery(ctx, req)
 }
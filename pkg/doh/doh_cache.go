@@ -0,0 +1,268 @@
+package doh
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultCacheSize is the default maximum number of entries held by a
+// [MemoryCache].
+const DefaultCacheSize = 4096
+
+// CacheEntry is a cached DNS response.
+type CacheEntry struct {
+	// Msg is the cached DNS response, with the TTLs it had when stored.
+	Msg *dns.Msg
+
+	// Stored is the time the response was stored in the cache.
+	Stored time.Time
+
+	// Expires is the time the response stops being fresh.
+	Expires time.Time
+}
+
+// Fresh reports whether the entry is still fresh at the given time.
+func (e *CacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Response returns a copy of the cached DNS response for the given request,
+// with the request's message ID, and with each record's TTL decremented by
+// the time elapsed since the entry was stored.
+func (e *CacheEntry) Response(req *dns.Msg, now time.Time) *dns.Msg {
+	resp := e.Msg.Copy()
+	resp.Id = req.Id
+
+	elapsed := uint32(0)
+	if d := now.Sub(e.Stored); d > 0 {
+		elapsed = uint32(min(d/time.Second, math.MaxUint32))
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return resp
+}
+
+// Cache is a pluggable cache of DNS responses, keyed by [CacheKey].
+//
+// Implementations must be safe for concurrent use. Get may return expired
+// entries, leaving it up to the caller to check [CacheEntry.Fresh].
+type Cache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+}
+
+// MemoryCache is an in-memory [Cache] bounded to a maximum number of
+// entries, evicting the least recently used entry when full.
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+// memoryCacheItem is an element of the MemoryCache LRU list.
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// NewMemoryCache returns a new in-memory cache holding up to size entries.
+// If size is not positive, [DefaultCacheSize] is used.
+func NewMemoryCache(size int) *MemoryCache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	return &MemoryCache{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry for the given key, if any.
+func (c *MemoryCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+
+	return elem.Value.(*memoryCacheItem).entry, true
+}
+
+// Set stores the entry for the given key, evicting the least recently
+// used entry if the cache is full.
+func (c *MemoryCache) Set(key string, entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*memoryCacheItem).entry = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&memoryCacheItem{key: key, entry: entry})
+
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheItem).key)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// CacheKey returns the cache key for the given DNS request, made up of its
+// question name (case-insensitive), type, class, DO and CD bits, and EDNS
+// Client Subnet source prefix, if any, so that answers tailored to one
+// client subnet aren't returned for another. It
+// returns false if the request can't be cached, such as when it doesn't
+// have exactly one question.
+func CacheKey(req *dns.Msg) (string, bool) {
+	if len(req.Question) != 1 {
+		return "", false
+	}
+
+	q := req.Question[0]
+
+	var do bool
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	b.WriteByte('/')
+	b.WriteString(strconv.FormatBool(do))
+	b.WriteByte('/')
+	b.WriteString(strconv.FormatBool(req.CheckingDisabled))
+
+	if prefix, ok := clientSubnetPrefix(clientSubnet(req)); ok {
+		b.WriteByte('/')
+		b.WriteString(prefix.Masked().String())
+	}
+
+	return b.String(), true
+}
+
+// ResponseTTL returns how long the given DNS response may be cached, and
+// whether it may be cached at all.
+//
+// Positive answers use the smallest TTL of all records in the response.
+// Negative answers (NXDOMAIN, or NOERROR without answers) use the SOA
+// record in the authority section, following [RFC 2308 section 5]. Other
+// responses, such as SERVFAIL or truncated responses, are not cacheable.
+//
+// [RFC 2308 section 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func ResponseTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return 0, false
+	}
+
+	if resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0 {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second, true
+			}
+		}
+
+		return 0, false
+	}
+
+	ttl, ok := uint32(math.MaxUint32), false
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			ttl, ok = min(ttl, hdr.Ttl), true
+		}
+	}
+
+	return time.Duration(ttl) * time.Second, ok
+}
+
+// httpFreshness returns the remaining HTTP freshness lifetime of a response
+// from its Cache-Control max-age directive and Age header, following
+// [RFC 9111 section 4.2]. It returns false if the headers don't specify a
+// lifetime, and a zero lifetime if the response must not be cached.
+//
+// [RFC 9111 section 4.2]: https://datatracker.ietf.org/doc/html/rfc9111#section-4.2
+func httpFreshness(header http.Header) (time.Duration, bool) {
+	var (
+		maxAge time.Duration
+		found  bool
+	)
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+
+			maxAge, found = time.Duration(seconds)*time.Second, true
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		maxAge -= time.Duration(age) * time.Second
+	}
+
+	return max(maxAge, 0), true
+}
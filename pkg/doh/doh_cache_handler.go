@@ -0,0 +1,270 @@
+package doh
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultStaleTTL is the default duration past expiry for which a
+	// [CacheHandler] may serve stale responses, following the suggested
+	// maximum stale timer in [RFC 8767 section 5].
+	//
+	// [RFC 8767 section 5]: https://datatracker.ietf.org/doc/html/rfc8767#section-5
+	DefaultStaleTTL = 24 * time.Hour
+
+	// DefaultPrefetchTimeout is the default maximum duration of a
+	// [CacheHandler]'s background refresh of an entry.
+	DefaultPrefetchTimeout = 10 * time.Second
+
+	// staleAnswerTTL is the TTL of records in stale responses, as
+	// recommended by RFC 8767 section 4.
+	staleAnswerTTL = 30
+)
+
+// CacheOptions configures a [CacheHandler].
+type CacheOptions struct {
+	// Cache stores the responses. If nil, a MemoryCache with Size entries
+	// is used.
+	Cache Cache
+
+	// Size is the maximum number of entries of the default MemoryCache. If
+	// zero, DefaultCacheSize is used.
+	Size int
+
+	// MinTTL and MaxTTL clamp how long responses are cached, including
+	// the TTLs of their records. Zero means no clamping.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// PrefetchThreshold is the fraction of an entry's lifetime, between 0
+	// and 1, below which a cache hit triggers a background refresh, so that
+	// popular names are refreshed before they expire. Zero disables
+	// prefetching.
+	PrefetchThreshold float64
+
+	// PrefetchTimeout limits how long a background refresh may take, since
+	// it outlives the request that triggered it. If zero,
+	// DefaultPrefetchTimeout is used.
+	PrefetchTimeout time.Duration
+
+	// ServeStale enables serving expired responses when the next handler
+	// fails, as described in [RFC 8767], with an Extended DNS Error
+	// marking the response as stale.
+	//
+	// [RFC 8767]: https://datatracker.ietf.org/doc/html/rfc8767
+	ServeStale bool
+
+	// StaleTTL is how long past expiry a response may be served stale. If
+	// zero, DefaultStaleTTL is used.
+	StaleTTL time.Duration
+}
+
+// cacheHandler is the state of a handler returned by CacheHandler.
+type cacheHandler struct {
+	next        Handler
+	opts        CacheOptions
+	prefetching sync.Map
+}
+
+// CacheHandler returns a DoH handler that caches the positive and negative
+// responses of the next handler for as long as their TTLs allow, answering
+// repeated questions from the cache.
+func CacheHandler(next Handler, opts CacheOptions) Handler {
+	if opts.Cache == nil {
+		opts.Cache = NewMemoryCache(opts.Size)
+	}
+
+	if opts.StaleTTL <= 0 {
+		opts.StaleTTL = DefaultStaleTTL
+	}
+
+	if opts.PrefetchTimeout <= 0 {
+		opts.PrefetchTimeout = DefaultPrefetchTimeout
+	}
+
+	h := &cacheHandler{
+		next: next,
+		opts: opts,
+	}
+
+	return h.handle
+}
+
+// handle implements the Handler function type.
+func (h *cacheHandler) handle(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+	key, ok := CacheKey(req)
+	if !ok {
+		return h.next(w, r, req)
+	}
+
+	now := time.Now()
+
+	entry, found := h.opts.Cache.Get(key)
+	if found && entry.Fresh(now) {
+		if h.shouldPrefetch(entry, now) {
+			h.prefetch(r, key, req)
+		}
+
+		return entry.Response(req, now), nil
+	}
+
+	resp, err := h.next(w, r, req)
+
+	if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure {
+		h.store(key, resp)
+		return resp, nil
+	}
+
+	if found && h.opts.ServeStale && now.Before(entry.Expires.Add(h.opts.StaleTTL)) {
+		return staleResponse(entry, req, now), nil
+	}
+
+	return resp, err
+}
+
+// shouldPrefetch reports whether the entry is close enough to expiry to
+// be refreshed in the background.
+func (h *cacheHandler) shouldPrefetch(entry *CacheEntry, now time.Time) bool {
+	if h.opts.PrefetchThreshold <= 0 {
+		return false
+	}
+
+	lifetime := entry.Expires.Sub(entry.Stored)
+	remaining := entry.Expires.Sub(now)
+
+	return float64(remaining) < h.opts.PrefetchThreshold*float64(lifetime)
+}
+
+// prefetch refreshes the cache entry for the given key in the background,
+// unless a refresh for it is already in progress. The refresh isn't canceled
+// with the request, but is limited by the configured prefetch timeout.
+func (h *cacheHandler) prefetch(r *http.Request, key string, req *dns.Msg) {
+	if _, loaded := h.prefetching.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), h.opts.PrefetchTimeout)
+
+	req = req.Copy()
+	r = r.Clone(ctx)
+
+	go func() {
+		defer h.prefetching.Delete(key)
+		defer cancel()
+
+		resp, err := h.next(&discardResponseWriter{}, r, req)
+		if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure {
+			h.store(key, resp)
+		}
+	}()
+}
+
+// store adds the response to the cache, if it is cacheable, with its
+// lifetime and record TTLs clamped to the configured limits.
+func (h *cacheHandler) store(key string, resp *dns.Msg) {
+	ttl, ok := ResponseTTL(resp)
+	if !ok {
+		return
+	}
+
+	clamped := ttl
+	if h.opts.MinTTL > 0 {
+		clamped = max(clamped, h.opts.MinTTL)
+	}
+	if h.opts.MaxTTL > 0 {
+		clamped = min(clamped, h.opts.MaxTTL)
+	}
+
+	if clamped <= 0 {
+		return
+	}
+
+	msg := resp.Copy()
+
+	if clamped != ttl {
+		clampTTLs(msg, uint32(h.opts.MinTTL/time.Second), uint32(h.opts.MaxTTL/time.Second))
+	}
+
+	now := time.Now()
+
+	h.opts.Cache.Set(key, &CacheEntry{
+		Msg:     msg,
+		Stored:  now,
+		Expires: now.Add(clamped),
+	})
+}
+
+// clampTTLs clamps the TTLs of all records in the message, except OPT, to
+// the given limits, where a zero limit means no limit.
+func clampTTLs(msg *dns.Msg, minTTL, maxTTL uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if minTTL > 0 {
+				hdr.Ttl = max(hdr.Ttl, minTTL)
+			}
+			if maxTTL > 0 {
+				hdr.Ttl = min(hdr.Ttl, maxTTL)
+			}
+		}
+	}
+}
+
+// staleResponse returns the expired cache entry's response for the given
+// request, with short record TTLs and a "Stale Answer" Extended DNS Error,
+// as described in RFC 8767.
+func staleResponse(entry *CacheEntry, req *dns.Msg, now time.Time) *dns.Msg {
+	resp := entry.Response(req, now)
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = staleAnswerTTL
+			}
+		}
+	}
+
+	if reqOpt := req.IsEdns0(); reqOpt != nil && resp.IsEdns0() == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+	}
+
+	infoCode := dns.ExtendedErrorCodeStaleAnswer
+	if resp.Rcode == dns.RcodeNameError {
+		infoCode = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+	}
+
+	setExtendedError(resp, infoCode, "")
+
+	return resp
+}
+
+// discardResponseWriter is an http.ResponseWriter that discards everything
+// written to it, used when calling handlers outside of an HTTP request.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *discardResponseWriter) WriteHeader(int) {}
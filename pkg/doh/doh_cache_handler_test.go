@@ -0,0 +1,390 @@
+package doh_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// countingHandler wraps the handler, counting how many times it is called.
+func countingHandler(handler doh.Handler, calls *atomic.Int64) doh.Handler {
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		calls.Add(1)
+		return handler(w, r, req)
+	}
+}
+
+func testCacheHandlerCall(t *testing.T, handler doh.Handler, req *dns.Msg) *dns.Msg {
+	t.Helper()
+
+	resp, err := handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dns-query", nil), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestCacheHandler(t *testing.T) {
+	nxdomainHandler := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetRcode(req, dns.RcodeNameError)
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Minttl: 60,
+		}}
+		return resp, nil
+	}
+
+	failingHandler := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("upstream down")
+	}
+
+	t.Run("positive", func(t *testing.T) {
+		var calls atomic.Int64
+
+		handler := doh.CacheHandler(countingHandler(testAnswerHandler, &calls), doh.CacheOptions{})
+
+		for range 3 {
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+			resp := testCacheHandlerCall(t, handler, req)
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(resp.Answer))
+			}
+		}
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("got %d calls, want 1", got)
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		var calls atomic.Int64
+
+		handler := doh.CacheHandler(countingHandler(nxdomainHandler, &calls), doh.CacheOptions{})
+
+		for range 2 {
+			resp := testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion("missing.example.", dns.TypeA))
+			if resp.Rcode != dns.RcodeNameError {
+				t.Errorf("got rcode %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+			}
+		}
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("got %d calls, want 1", got)
+		}
+	})
+
+	t.Run("uncacheable", func(t *testing.T) {
+		var calls atomic.Int64
+
+		servfail := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure), nil
+		}
+
+		handler := doh.CacheHandler(countingHandler(servfail, &calls), doh.CacheOptions{})
+
+		for range 2 {
+			testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		}
+
+		if got := calls.Load(); got != 2 {
+			t.Errorf("got %d calls, want 2", got)
+		}
+	})
+
+	t.Run("clamp", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			opts    doh.CacheOptions
+			handler doh.Handler
+			wantTTL uint32
+			wantExp time.Duration
+		}{
+			{
+				name:    "max",
+				opts:    doh.CacheOptions{MaxTTL: time.Minute},
+				handler: testAnswerHandler,
+				wantTTL: 60,
+				wantExp: time.Minute,
+			},
+			{
+				name:    "min",
+				opts:    doh.CacheOptions{MinTTL: time.Hour},
+				handler: testAnswerHandler,
+				wantTTL: 3600,
+				wantExp: time.Hour,
+			},
+			{
+				name:    "within",
+				opts:    doh.CacheOptions{MinTTL: time.Second, MaxTTL: time.Hour},
+				handler: testAnswerHandler,
+				wantTTL: 300,
+				wantExp: 300 * time.Second,
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				cache := doh.NewMemoryCache(0)
+				test.opts.Cache = cache
+
+				handler := doh.CacheHandler(test.handler, test.opts)
+
+				req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+				testCacheHandlerCall(t, handler, req)
+
+				key, _ := doh.CacheKey(req)
+
+				entry, ok := cache.Get(key)
+				if !ok {
+					t.Fatal("response was not cached")
+				}
+
+				if got := entry.Expires.Sub(entry.Stored); got != test.wantExp {
+					t.Errorf("got lifetime %s, want %s", got, test.wantExp)
+				}
+
+				resp := testCacheHandlerCall(t, handler, req)
+				if ttl := resp.Answer[0].Header().Ttl; ttl != test.wantTTL {
+					t.Errorf("got ttl %d, want %d", ttl, test.wantTTL)
+				}
+			})
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		var calls atomic.Int64
+
+		handler := doh.CacheHandler(countingHandler(testAnswerHandler, &calls), doh.CacheOptions{Size: 1})
+
+		for _, name := range []string{"a.example.", "b.example.", "a.example."} {
+			testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		}
+
+		if got := calls.Load(); got != 3 {
+			t.Errorf("got %d calls, want 3", got)
+		}
+	})
+
+	staleEntry := func(cache doh.Cache, req *dns.Msg, rcode int, expired time.Duration) {
+		msg := new(dns.Msg).SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			msg.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+			}
+		}
+
+		key, _ := doh.CacheKey(req)
+
+		now := time.Now()
+
+		cache.Set(key, &doh.CacheEntry{
+			Msg:     msg,
+			Stored:  now.Add(-300*time.Second - expired),
+			Expires: now.Add(-expired),
+		})
+	}
+
+	t.Run("serve stale", func(t *testing.T) {
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(failingHandler, doh.CacheOptions{Cache: cache, ServeStale: true})
+
+		req := new(dns.Msg).SetQuestion("stale.example.", dns.TypeA)
+		req.SetEdns0(1232, false)
+
+		staleEntry(cache, req, dns.RcodeSuccess, time.Minute)
+
+		resp := testCacheHandlerCall(t, handler, req)
+
+		if len(resp.Answer) != 1 {
+			t.Fatalf("got %d answers, want 1", len(resp.Answer))
+		}
+
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 30 {
+			t.Errorf("got ttl %d, want 30", ttl)
+		}
+
+		var ede *dns.EDNS0_EDE
+		if opt := resp.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if e, ok := option.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+		}
+
+		if ede == nil {
+			t.Fatal("missing extended dns error")
+		}
+
+		if ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+			t.Errorf("got extended error %d, want %d", ede.InfoCode, dns.ExtendedErrorCodeStaleAnswer)
+		}
+	})
+
+	t.Run("serve stale nxdomain", func(t *testing.T) {
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(failingHandler, doh.CacheOptions{Cache: cache, ServeStale: true})
+
+		req := new(dns.Msg).SetQuestion("stale.example.", dns.TypeA)
+		req.SetEdns0(1232, false)
+
+		staleEntry(cache, req, dns.RcodeNameError, time.Minute)
+
+		resp := testCacheHandlerCall(t, handler, req)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Errorf("got rcode %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+		}
+
+		ede, ok := resp.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+		if !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleNXDOMAINAnswer {
+			t.Errorf("got option %v, want stale nxdomain extended error", resp.IsEdns0().Option)
+		}
+	})
+
+	t.Run("stale too old", func(t *testing.T) {
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(failingHandler, doh.CacheOptions{Cache: cache, ServeStale: true, StaleTTL: time.Minute})
+
+		req := new(dns.Msg).SetQuestion("stale.example.", dns.TypeA)
+
+		staleEntry(cache, req, dns.RcodeSuccess, time.Hour)
+
+		_, err := handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dns-query", nil), req)
+		if err == nil {
+			t.Fatal("got no error for a response past the stale ttl")
+		}
+	})
+
+	t.Run("stale disabled", func(t *testing.T) {
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(failingHandler, doh.CacheOptions{Cache: cache})
+
+		req := new(dns.Msg).SetQuestion("stale.example.", dns.TypeA)
+
+		staleEntry(cache, req, dns.RcodeSuccess, time.Minute)
+
+		_, err := handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dns-query", nil), req)
+		if err == nil {
+			t.Fatal("got no error with serve stale disabled")
+		}
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		var calls atomic.Int64
+
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(countingHandler(testAnswerHandler, &calls), doh.CacheOptions{
+			Cache:             cache,
+			PrefetchThreshold: 0.1,
+		})
+
+		req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		key, _ := doh.CacheKey(req)
+
+		msg := new(dns.Msg).SetReply(req)
+		msg.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+		}
+
+		now := time.Now()
+
+		cache.Set(key, &doh.CacheEntry{
+			Msg:     msg,
+			Stored:  now.Add(-295 * time.Second),
+			Expires: now.Add(5 * time.Second),
+		})
+
+		resp := testCacheHandlerCall(t, handler, req)
+		if ttl := resp.Answer[0].Header().Ttl; ttl > 5 {
+			t.Errorf("got ttl %d, want at most 5", ttl)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			entry, _ := cache.Get(key)
+			if entry.Expires.Sub(time.Now()) > time.Minute {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("entry was not prefetched")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("got %d calls, want 1", got)
+		}
+	})
+
+	t.Run("prefetch timeout", func(t *testing.T) {
+		done := make(chan error, 1)
+
+		cache := doh.NewMemoryCache(0)
+
+		handler := doh.CacheHandler(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			<-r.Context().Done()
+			done <- r.Context().Err()
+			return nil, r.Context().Err()
+		}, doh.CacheOptions{
+			Cache:             cache,
+			PrefetchThreshold: 0.1,
+			PrefetchTimeout:   10 * time.Millisecond,
+		})
+
+		req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		key, _ := doh.CacheKey(req)
+
+		now := time.Now()
+
+		cache.Set(key, &doh.CacheEntry{
+			Msg:     testCacheHandlerCall(t, testAnswerHandler, req),
+			Stored:  now.Add(-295 * time.Second),
+			Expires: now.Add(5 * time.Second),
+		})
+
+		testCacheHandlerCall(t, handler, req)
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got prefetch error %v, want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("prefetch did not time out")
+		}
+	})
+
+	t.Run("nil response", func(t *testing.T) {
+		handler := doh.CacheHandler(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			return nil, nil
+		}, doh.CacheOptions{})
+
+		resp := testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if resp != nil {
+			t.Errorf("got response %v, want nil", resp)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package doh_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestMemoryCache(t *testing.T) {
+	cache := doh.NewMemoryCache(2)
+
+	for _, key := range []string{"a", "b"} {
+		cache.Set(key, &doh.CacheEntry{Msg: new(dns.Msg)})
+	}
+
+	// Use "a" so that "b" is the least recently used entry.
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("missing entry a")
+	}
+
+	cache.Set("c", &doh.CacheEntry{Msg: new(dns.Msg)})
+
+	if cache.Len() != 2 {
+		t.Fatalf("got %d entries, want 2", cache.Len())
+	}
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("entry b was not evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("missing entry %s", key)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("Example.COM.", dns.TypeA)
+
+	key, ok := doh.CacheKey(req)
+	if !ok {
+		t.Fatal("got uncacheable request")
+	}
+
+	lower, _ := doh.CacheKey(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if key != lower {
+		t.Errorf("got different keys %q and %q for names differing in case", key, lower)
+	}
+
+	withDO := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	withDO.SetEdns0(1232, true)
+
+	doKey, _ := doh.CacheKey(withDO)
+	if key == doKey {
+		t.Error("got same key with and without DO bit")
+	}
+
+	withCD := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	withCD.CheckingDisabled = true
+
+	cdKey, _ := doh.CacheKey(withCD)
+	if key == cdKey {
+		t.Error("got same key with and without CD bit")
+	}
+
+	withECS := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	withECS.SetEdns0(1232, false)
+	withECS.IsEdns0().Option = append(withECS.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IPv4(203, 0, 113, 0),
+	})
+
+	ecsKey, _ := doh.CacheKey(withECS)
+	if key == ecsKey {
+		t.Error("got same key with and without client subnet")
+	}
+
+	if _, ok := doh.CacheKey(new(dns.Msg)); ok {
+		t.Error("got cacheable request without a question")
+	}
+}
+
+func TestResponseTTL(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 60,
+	}
+
+	tests := []struct {
+		name   string
+		resp   func() *dns.Msg
+		want   time.Duration
+		wantOK bool
+	}{
+		{
+			name: "positive",
+			resp: func() *dns.Msg {
+				resp := new(dns.Msg).SetReply(req)
+				resp.Answer = []dns.RR{
+					&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+					&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}, A: net.IPv4(192, 0, 2, 2)},
+				}
+				return resp
+			},
+			want:   100 * time.Second,
+			wantOK: true,
+		},
+		{
+			name: "nxdomain",
+			resp: func() *dns.Msg {
+				resp := new(dns.Msg).SetRcode(req, dns.RcodeNameError)
+				resp.Ns = []dns.RR{soa}
+				return resp
+			},
+			want:   60 * time.Second,
+			wantOK: true,
+		},
+		{
+			name: "nodata without soa",
+			resp: func() *dns.Msg {
+				return new(dns.Msg).SetReply(req)
+			},
+			wantOK: false,
+		},
+		{
+			name: "servfail",
+			resp: func() *dns.Msg {
+				return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+			},
+			wantOK: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := doh.ResponseTTL(test.resp())
+			if ok != test.wantOK {
+				t.Fatalf("got cacheable %v, want %v", ok, test.wantOK)
+			}
+
+			if got != test.want {
+				t.Errorf("got ttl %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClient_Cache(t *testing.T) {
+	ctx := testContext(t)
+
+	var (
+		queries      atomic.Int64
+		cacheControl atomic.Value
+	)
+
+	cacheControl.Store("")
+
+	mux := doh.NewServerMux(testAnswerHandler)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if v := cacheControl.Load().(string); v != "" {
+			w.Header().Set("Cache-Control", v)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL := server.URL + "/dns-query"
+
+	t.Run("hit", func(t *testing.T) {
+		queries.Store(0)
+
+		client := doh.NewClient(doh.WithServers(serverURL), doh.WithCache(doh.NewMemoryCache(0)))
+
+		for range 3 {
+			req := new(dns.Msg).SetQuestion("google.com.", dns.TypeA)
+
+			resp, err := client.Exchange(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+		}
+
+		if got := queries.Load(); got != 1 {
+			t.Errorf("got %d upstream queries, want 1", got)
+		}
+	})
+
+	t.Run("no-store", func(t *testing.T) {
+		queries.Store(0)
+		cacheControl.Store("no-store")
+		t.Cleanup(func() { cacheControl.Store("") })
+
+		client := doh.NewClient(doh.WithServers(serverURL), doh.WithCache(doh.NewMemoryCache(0)))
+
+		for range 2 {
+			_, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := queries.Load(); got != 2 {
+			t.Errorf("got %d upstream queries, want 2", got)
+		}
+	})
+
+	t.Run("max-age zero", func(t *testing.T) {
+		queries.Store(0)
+		cacheControl.Store("max-age=0")
+		t.Cleanup(func() { cacheControl.Store("") })
+
+		client := doh.NewClient(doh.WithServers(serverURL), doh.WithCache(doh.NewMemoryCache(0)))
+
+		for range 2 {
+			_, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := queries.Load(); got != 2 {
+			t.Errorf("got %d upstream queries, want 2", got)
+		}
+	})
+
+	t.Run("ttl decremented", func(t *testing.T) {
+		queries.Store(0)
+
+		cache := doh.NewMemoryCache(0)
+
+		req := new(dns.Msg).SetQuestion("cached.example.", dns.TypeA)
+
+		key, _ := doh.CacheKey(req)
+
+		cached := new(dns.Msg).SetReply(req)
+		cached.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "cached.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+		}
+
+		now := time.Now()
+
+		cache.Set(key, &doh.CacheEntry{
+			Msg:     cached,
+			Stored:  now.Add(-10 * time.Second),
+			Expires: now.Add(290 * time.Second),
+		})
+
+		client := doh.NewClient(doh.WithServers(serverURL), doh.WithCache(cache))
+
+		resp, err := client.Exchange(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := queries.Load(); got != 0 {
+			t.Errorf("got %d upstream queries, want 0", got)
+		}
+
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 290 {
+			t.Errorf("got ttl %d, want 290", ttl)
+		}
+
+		if cached.Answer[0].Header().Ttl != 300 {
+			t.Error("cached message was modified")
+		}
+	})
+}
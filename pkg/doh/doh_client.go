@@ -0,0 +1,625 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+)
+
+var (
+	// ErrNoServers is returned when a client has no DoH server URLs configured.
+	ErrNoServers = errors.New("doh: no servers configured")
+
+	// ErrResponseTooLarge is returned when an HTTP response body exceeds the
+	// configured maximum response size.
+	ErrResponseTooLarge = errors.New("doh: response too large")
+)
+
+// Method is the HTTP method used by a [Client] to send DoH requests,
+// as defined in [RFC 8484 section 4.1].
+//
+// [RFC 8484 section 4.1]: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+type Method string
+
+const (
+	// MethodGet sends the DNS message base64url encoded in the "dns"
+	// query parameter, which is the most cache friendly option.
+	MethodGet Method = http.MethodGet
+
+	// MethodPost sends the DNS message as the request body.
+	MethodPost Method = http.MethodPost
+
+	// MethodAuto uses GET for small DNS messages, and POST for messages
+	// larger than the client's POST threshold, avoiding URL length limits
+	// at some proxies.
+	MethodAuto Method = "AUTO"
+)
+
+// DefaultPostThreshold is the default packed DNS message size, in bytes,
+// above which [MethodAuto] switches from GET to POST.
+const DefaultPostThreshold = 512
+
+// Client is a reusable DNS-over-HTTPS (DoH) client, following [RFC 8484].
+//
+// A Client is safe for concurrent use by multiple goroutines, and should
+// be created once and reused, instead of re-plumbing the same settings
+// for every query.
+//
+// [RFC 8484]: https://tools.ietf.org/html/rfc8484
+type Client struct {
+	httpClient       *http.Client
+	servers          []string
+	method           Method
+	postThreshold    int
+	timeout          time.Duration
+	userAgent        string
+	ednsUDPSize      uint16
+	maxResponseSize  int64
+	requestHook      func(*http.Request)
+	responseHook     func(*http.Response)
+	cache            Cache
+	http3            bool
+	padding          bool
+	clientSubnet     netip.Prefix
+	dnssec           bool
+	checkingDisabled bool
+}
+
+// ClientOption configures a [Client].
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to send DoH requests.
+//
+// If not set, a [cleanhttp.DefaultPooledClient] is used.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithServers sets the DoH server URLs used by the client. Servers are
+// tried in order until one succeeds.
+func WithServers(serverURLs ...string) ClientOption {
+	return func(c *Client) {
+		c.servers = serverURLs
+	}
+}
+
+// WithMethod sets the HTTP method used to send DoH requests. The
+// default is [MethodGet].
+func WithMethod(method Method) ClientOption {
+	return func(c *Client) {
+		c.method = method
+	}
+}
+
+// WithPostThreshold sets the packed DNS message size, in bytes, above
+// which [MethodAuto] switches from GET to POST. The default is
+// [DefaultPostThreshold].
+func WithPostThreshold(n int) ClientOption {
+	return func(c *Client) {
+		c.postThreshold = n
+	}
+}
+
+// WithTimeout sets the maximum duration of a single exchange, including
+// failover across all configured servers. Zero means no timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with each DoH request.
+func WithUserAgent(userAgent string) ClientOption {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithEDNS0 adds an EDNS(0) OPT record advertising the given UDP payload
+// size to queries that don't already carry one.
+func WithEDNS0(udpSize uint16) ClientOption {
+	return func(c *Client) {
+		c.ednsUDPSize = udpSize
+	}
+}
+
+// WithPadding sets whether queries are padded with an [RFC 7830] EDNS(0)
+// padding option to a multiple of [QueryPaddingBlockSize] bytes, following
+// the [RFC 8467] block-length policy, so that the length of encrypted
+// queries doesn't reveal the names they contain. Padding is enabled by
+// default, and adds an OPT record to queries that don't already carry one.
+// Queries that are already padded are sent unchanged.
+//
+// [RFC 7830]: https://datatracker.ietf.org/doc/html/rfc7830
+// [RFC 8467]: https://datatracker.ietf.org/doc/html/rfc8467
+func WithPadding(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.padding = enabled
+	}
+}
+
+// WithClientSubnet adds an [RFC 7871] EDNS Client Subnet (ECS) option with
+// the given source prefix, such as 203.0.113.0/24, to queries that don't
+// already carry one, which lets resolvers answer as if the query came from
+// that subnet. A prefix length of 0, such as 0.0.0.0/0, asks resolvers not
+// to use the client's own address, as described in RFC 7871 section 7.1.2.
+//
+// [RFC 7871]: https://datatracker.ietf.org/doc/html/rfc7871
+func WithClientSubnet(prefix netip.Prefix) ClientOption {
+	return func(c *Client) {
+		c.clientSubnet = prefix
+	}
+}
+
+// WithMaxResponseSize sets the maximum number of bytes read from an HTTP
+// response body. Larger responses fail with [ErrResponseTooLarge]. The
+// default is [DefaultMaxMessageSize], and zero or less means no limit.
+func WithMaxResponseSize(n int64) ClientOption {
+	return func(c *Client) {
+		c.maxResponseSize = n
+	}
+}
+
+// WithRequestHook sets a function called with each HTTP request right
+// before it is sent, which can be used to add headers or for logging.
+func WithRequestHook(hook func(*http.Request)) ClientOption {
+	return func(c *Client) {
+		c.requestHook = hook
+	}
+}
+
+// WithResponseHook sets a function called with each HTTP response right
+// after it is received, before the body is read.
+func WithResponseHook(hook func(*http.Response)) ClientOption {
+	return func(c *Client) {
+		c.responseHook = hook
+	}
+}
+
+// WithCache sets a cache used to store DNS responses, which are reused for
+// identical questions (including the DO and CD bits) for as long as they
+// remain fresh.
+//
+// The freshness lifetime of a response is the smallest TTL of its records
+// (or the SOA minimum for negative answers), further limited by the HTTP
+// Cache-Control max-age directive and Age header, as described in
+// [RFC 8484 section 5.1]. Cached responses have their TTLs decremented
+// by the time spent in the cache.
+//
+// [RFC 8484 section 5.1]: https://datatracker.ietf.org/doc/html/rfc8484#section-5.1
+func WithCache(cache Cache) ClientOption {
+	return func(c *Client) {
+		c.cache = cache
+	}
+}
+
+// NewClient returns a new DoH client configured with the given options.
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		method:          MethodGet,
+		postThreshold:   DefaultPostThreshold,
+		maxResponseSize: DefaultMaxMessageSize,
+		padding:         true,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.httpClient == nil {
+		c.httpClient = cleanhttp.DefaultPooledClient()
+	}
+
+	if c.http3 {
+		httpClient := *c.httpClient
+		httpClient.Transport = &HTTP3Transport{Fallback: httpClient.Transport}
+		c.httpClient = &httpClient
+	}
+
+	return c
+}
+
+// String returns the client's DoH server URLs, separated by commas.
+func (c *Client) String() string {
+	return strings.Join(c.servers, ",")
+}
+
+// Exchange performs a DNS query using the client's DoH servers, trying each
+// server in order until one succeeds. If all servers fail, the errors from
+// each are joined together.
+//
+// The given DNS message is not modified.
+func (c *Client) Exchange(ctx context.Context, dnsReq *dns.Msg) (*dns.Msg, error) {
+	if len(c.servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	dnsReq = c.prepare(dnsReq)
+
+	var (
+		cacheKey  string
+		cacheable bool
+	)
+
+	if c.cache != nil {
+		cacheKey, cacheable = CacheKey(dnsReq)
+	}
+
+	if cacheable {
+		now := time.Now()
+		if entry, ok := c.cache.Get(cacheKey); ok && entry.Fresh(now) {
+			return entry.Response(dnsReq, now), nil
+		}
+	}
+
+	var errs []error
+
+	for _, serverURL := range c.servers {
+		dnsResp, header, err := c.exchange(ctx, serverURL, dnsReq)
+		if err == nil {
+			if cacheable {
+				c.store(cacheKey, dnsResp, header)
+			}
+			return dnsResp, nil
+		}
+
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// prepare returns the DNS message to send, applying the client's defaults
+// to a copy of the given message if needed.
+func (c *Client) prepare(dnsReq *dns.Msg) *dns.Msg {
+	addEDNS0 := c.ednsUDPSize > 0 && dnsReq.IsEdns0() == nil
+	addSubnet := c.clientSubnet.IsValid() && clientSubnet(dnsReq) == nil
+	setDO := c.dnssec && (dnsReq.IsEdns0() == nil || !dnsReq.IsEdns0().Do())
+	setAD := c.dnssec && !dnsReq.AuthenticatedData
+	setCD := c.checkingDisabled && !dnsReq.CheckingDisabled
+
+	// Queries that are already padded are sent as they are.
+	pad := c.padding && !hasPadding(dnsReq)
+
+	if !addEDNS0 && !addSubnet && !setDO && !setAD && !setCD && !pad {
+		return dnsReq
+	}
+
+	dnsReq = dnsReq.Copy()
+
+	udpSize := c.ednsUDPSize
+	if udpSize == 0 {
+		udpSize = dns.DefaultMsgSize
+	}
+
+	if addEDNS0 {
+		dnsReq.SetEdns0(udpSize, false)
+	}
+
+	if addSubnet {
+		setClientSubnet(dnsReq, newClientSubnet(c.clientSubnet), udpSize)
+	}
+
+	if setDO {
+		if dnsReq.IsEdns0() == nil {
+			dnsReq.SetEdns0(udpSize, true)
+		}
+		dnsReq.IsEdns0().SetDo()
+	}
+
+	dnsReq.AuthenticatedData = dnsReq.AuthenticatedData || setAD
+	dnsReq.CheckingDisabled = dnsReq.CheckingDisabled || setCD
+
+	// Padding is added last, since it depends on the length of the query.
+	if pad {
+		padMsg(dnsReq, QueryPaddingBlockSize, udpSize)
+	}
+
+	return dnsReq
+}
+
+// store adds the DNS response to the client's cache, if it is cacheable
+// according to both its records and HTTP response headers.
+func (c *Client) store(key string, dnsResp *dns.Msg, header http.Header) {
+	ttl, ok := ResponseTTL(dnsResp)
+	if !ok {
+		return
+	}
+
+	if freshness, ok := httpFreshness(header); ok {
+		ttl = min(ttl, freshness)
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.cache.Set(key, &CacheEntry{
+		Msg:     dnsResp.Copy(),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	})
+}
+
+// exchange performs a single DoH request against the given server URL,
+// returning the DNS response and the HTTP response headers.
+func (c *Client) exchange(ctx context.Context, serverURL string, dnsReq *dns.Msg) (*dns.Msg, http.Header, error) {
+	dnsReqBytes, err := dnsReq.Pack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrFailedDNSRequestPack, err)
+	}
+
+	httpReq, err := c.newHTTPRequest(ctx, serverURL, dnsReqBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrFailedHTTPRequest, err)
+	}
+
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	if c.userAgent != "" {
+		httpReq.Header.Set("User-Agent", c.userAgent)
+	}
+
+	if c.requestHook != nil {
+		c.requestHook(httpReq)
+	}
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrFailedHTTPRequest, err)
+	}
+	defer httpResp.Body.Close()
+
+	if c.responseHook != nil {
+		c.responseHook(httpResp)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: %s", ErrFailedHTTPRequest, httpResp.Status)
+	}
+
+	body, err := c.readBody(httpResp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dnsResp := &dns.Msg{}
+	err = dnsResp.Unpack(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrFailedDNSResponseUnpack, err)
+	}
+
+	return dnsResp, httpResp.Header, nil
+}
+
+// newHTTPRequest returns an HTTP request carrying the packed DNS message,
+// using the client's configured method.
+func (c *Client) newHTTPRequest(ctx context.Context, serverURL string, dnsReqBytes []byte) (*http.Request, error) {
+	method := c.method
+	if method == MethodAuto {
+		method = MethodGet
+		if len(dnsReqBytes) > c.postThreshold {
+			method = MethodPost
+		}
+	}
+
+	switch method {
+	case MethodGet:
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		q := httpReq.URL.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(dnsReqBytes))
+		httpReq.URL.RawQuery = q.Encode()
+
+		return httpReq, nil
+	case MethodPost:
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL, bytes.NewReader(dnsReqBytes))
+		if err != nil {
+			return nil, err
+		}
+
+		httpReq.Header.Set("Content-Type", "application/dns-message")
+
+		return httpReq, nil
+	default:
+		return nil, fmt.Errorf("unsupported method %q", c.method)
+	}
+}
+
+// readBody reads an HTTP response body, enforcing the client's maximum
+// response size if one is configured.
+func (c *Client) readBody(r io.Reader) ([]byte, error) {
+	if c.maxResponseSize <= 0 {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFailedHTTPResponseRead, err)
+		}
+		return body, nil
+	}
+
+	// Read one byte past the limit to detect oversized responses.
+	body, err := io.ReadAll(io.LimitReader(r, c.maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailedHTTPResponseRead, err)
+	}
+
+	if int64(len(body)) > c.maxResponseSize {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrResponseTooLarge, c.maxResponseSize)
+	}
+
+	return body, nil
+}
+
+// Lookup performs a DNS query for the given name and record type, with
+// recursion desired, returning the full DNS response.
+func (c *Client) Lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	dnsReq := new(dns.Msg)
+	dnsReq.SetQuestion(dns.Fqdn(name), qtype)
+
+	if qtype == dns.TypeANY {
+		dnsReq.Question[0].Qclass = dns.ClassANY
+	}
+
+	return c.Exchange(ctx, dnsReq)
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses for the given name.
+func (c *Client) LookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	var ips []net.IP
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		dnsResp, err := c.Lookup(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, answer := range dnsResp.Answer {
+			switch answer := answer.(type) {
+			case *dns.A:
+				ips = append(ips, answer.A)
+			case *dns.AAAA:
+				ips = append(ips, answer.AAAA)
+			}
+		}
+	}
+
+	return ips, nil
+}
+
+// LookupTXT returns the TXT records for the given name.
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	dnsResp, err := c.Lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var txts []string
+
+	for _, answer := range dnsResp.Answer {
+		if txt, ok := answer.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(txt.Txt, ""))
+		}
+	}
+
+	return txts, nil
+}
+
+// SimpleQuery performs a DNS query using the dj (DNS JSON) format types
+// to represent the request and response.
+func (c *Client) SimpleQuery(ctx context.Context, req *dj.Request) (*dj.Response, error) {
+	dnsResp, err := c.Exchange(ctx, newDNSRequest(req))
+	if err != nil {
+		return nil, err
+	}
+
+	return newDJResponse(dnsResp), nil
+}
+
+// newDNSRequest converts a dj (DNS JSON) request into a DNS message, with
+// recursion desired.
+func newDNSRequest(req *dj.Request) *dns.Msg {
+	var qClass uint16
+	switch req.Type {
+	case "ANY":
+		qClass = dns.ClassANY
+	default:
+		qClass = dns.ClassINET
+	}
+
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{
+			{
+				Name:   dns.Fqdn(req.Name),
+				Qtype:  dns.StringToType[req.Type],
+				Qclass: qClass,
+			},
+		},
+	}
+}
+
+// newDJResponse converts a DNS message into a dj (DNS JSON) response.
+func newDJResponse(dnsResp *dns.Msg) *dj.Response {
+	resp := &dj.Response{
+		Status: int(dnsResp.Rcode),
+		TC:     dnsResp.Truncated,
+		RD:     dnsResp.RecursionDesired,
+		RA:     dnsResp.RecursionAvailable,
+		AD:     dnsResp.AuthenticatedData,
+		CD:     dnsResp.CheckingDisabled,
+	}
+
+	for _, question := range dnsResp.Question {
+		resp.Question = append(resp.Question, struct {
+			Name string `json:"name"`
+			Type int    `json:"type"`
+		}{
+			Name: question.Name,
+			Type: int(question.Qtype),
+		})
+	}
+
+	for _, answer := range dnsResp.Answer {
+		resp.Answer = append(resp.Answer, newDJRecord(answer))
+	}
+
+	for _, authority := range dnsResp.Ns {
+		resp.Authority = append(resp.Authority, newDJRecord(authority))
+	}
+
+	for _, additional := range dnsResp.Extra {
+		// The OPT pseudo-record is not a record of the additional section,
+		// its options are reported as fields of the response instead.
+		if additional.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		resp.Additional = append(resp.Additional, newDJRecord(additional))
+	}
+
+	resp.Comment = extendedErrorComment(dnsResp)
+
+	if subnet := clientSubnet(dnsResp); subnet != nil {
+		if prefix, ok := clientSubnetPrefix(subnet); ok {
+			resp.EDNSClientSubnet = prefix.Masked().Addr().String() + "/" + strconv.Itoa(int(subnet.SourceScope))
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,451 @@
+package doh_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testAnswerHandler is a DoH handler that answers every A query with
+// 8.8.8.8, and every TXT query with "hello world".
+func testAnswerHandler(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+	dnsResp := new(dns.Msg).SetReply(req)
+
+	hdr := dns.RR_Header{
+		Name:   req.Question[0].Name,
+		Rrtype: req.Question[0].Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    300,
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeA:
+		dnsResp.Answer = append(dnsResp.Answer, &dns.A{Hdr: hdr, A: net.IPv4(8, 8, 8, 8)})
+	case dns.TypeTXT:
+		dnsResp.Answer = append(dnsResp.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"hello world"}})
+	}
+
+	return dnsResp, nil
+}
+
+// testServerURL starts a DoH test server for the given handler, returning
+// the URL of its DNS query endpoint.
+func testServerURL(t *testing.T, handler doh.Handler) string {
+	t.Helper()
+
+	server := httptest.NewServer(doh.NewServerMux(handler))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/dns-query"
+}
+
+func TestClient_Exchange(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL := testServerURL(t, testAnswerHandler)
+
+	t.Run("success", func(t *testing.T) {
+		client := doh.NewClient(doh.WithServers(serverURL))
+
+		resp, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Fatalf("got %d answers, want 1", len(resp.Answer))
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}))
+		t.Cleanup(failing.Close)
+
+		client := doh.NewClient(doh.WithServers(failing.URL, serverURL))
+
+		resp, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Fatalf("got %d answers, want 1", len(resp.Answer))
+		}
+	})
+
+	t.Run("all servers fail", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}))
+		t.Cleanup(failing.Close)
+
+		client := doh.NewClient(doh.WithServers(failing.URL, failing.URL))
+
+		_, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if !errors.Is(err, doh.ErrFailedHTTPRequest) {
+			t.Fatalf("got error %v, want %v", err, doh.ErrFailedHTTPRequest)
+		}
+	})
+
+	t.Run("no servers", func(t *testing.T) {
+		_, err := doh.NewClient().Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if !errors.Is(err, doh.ErrNoServers) {
+			t.Fatalf("got error %v, want %v", err, doh.ErrNoServers)
+		}
+	})
+
+	t.Run("user agent and hooks", func(t *testing.T) {
+		var (
+			gotUserAgent string
+			gotStatus    int
+		)
+
+		client := doh.NewClient(
+			doh.WithServers(serverURL),
+			doh.WithUserAgent("doh-test"),
+			doh.WithRequestHook(func(r *http.Request) {
+				gotUserAgent = r.Header.Get("User-Agent")
+			}),
+			doh.WithResponseHook(func(r *http.Response) {
+				gotStatus = r.StatusCode
+			}),
+		)
+
+		_, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gotUserAgent != "doh-test" {
+			t.Errorf("got user agent %q, want %q", gotUserAgent, "doh-test")
+		}
+
+		if gotStatus != http.StatusOK {
+			t.Errorf("got status %d, want %d", gotStatus, http.StatusOK)
+		}
+	})
+
+	t.Run("edns0", func(t *testing.T) {
+		var gotOpt *dns.OPT
+
+		ednsURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			gotOpt = req.IsEdns0()
+			return testAnswerHandler(w, r, req)
+		})
+
+		client := doh.NewClient(doh.WithServers(ednsURL), doh.WithEDNS0(1232))
+
+		req := new(dns.Msg).SetQuestion("google.com.", dns.TypeA)
+
+		_, err := client.Exchange(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gotOpt == nil || gotOpt.UDPSize() != 1232 {
+			t.Fatalf("got OPT %v, want UDP size 1232", gotOpt)
+		}
+
+		if req.IsEdns0() != nil {
+			t.Error("request message was modified")
+		}
+	})
+
+	t.Run("response too large", func(t *testing.T) {
+		client := doh.NewClient(doh.WithServers(serverURL), doh.WithMaxResponseSize(12))
+
+		_, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if !errors.Is(err, doh.ErrResponseTooLarge) {
+			t.Fatalf("got error %v, want %v", err, doh.ErrResponseTooLarge)
+		}
+	})
+}
+
+func TestClient_Lookup(t *testing.T) {
+	ctx := testContext(t)
+
+	client := doh.NewClient(doh.WithServers(testServerURL(t, testAnswerHandler)))
+
+	ips, err := client.LookupIP(ctx, "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(8, 8, 8, 8)) {
+		t.Errorf("got ips %v, want [8.8.8.8]", ips)
+	}
+
+	txts, err := client.LookupTXT(ctx, "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(txts) != 1 || txts[0] != "hello world" {
+		t.Errorf("got txts %q, want [\"hello world\"]", txts)
+	}
+
+	resp, err := client.SimpleQuery(ctx, &dj.Request{Name: "google.com", Type: "A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 || resp.Answer[0].Data != "8.8.8.8" {
+		t.Errorf("got answers %v, want [8.8.8.8]", resp.Answer)
+	}
+}
+
+func TestClient_SimpleQuery_Sections(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(req)
+		resp.SetEdns0(1232, false)
+
+		var records []string
+
+		switch req.Question[0].Name {
+		case "nope.example.com.":
+			resp.Rcode = dns.RcodeNameError
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeProhibited,
+				ExtraText: "blocked",
+			})
+			records = []string{"example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"}
+		case "sub.example.com.":
+			records = []string{"sub.example.com. 3600 IN NS ns.sub.example.com.", "ns.sub.example.com. 3600 IN A 192.0.2.53"}
+		}
+
+		for i, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+
+			if i == 0 {
+				resp.Ns = append(resp.Ns, rr)
+			} else {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+
+		return resp, nil
+	})
+
+	client := doh.NewClient(doh.WithServers(serverURL))
+
+	tests := []struct {
+		name           string
+		wantStatus     int
+		wantAuthority  []dj.Record
+		wantAdditional []dj.Record
+		wantComment    string
+	}{
+		{
+			name:       "nope.example.com",
+			wantStatus: dns.RcodeNameError,
+			wantAuthority: []dj.Record{
+				{Name: "example.com.", Type: int(dns.TypeSOA), TTL: 300, Data: "ns.example.com."},
+			},
+			wantComment: "EDE(18): Prohibited: blocked",
+		},
+		{
+			name: "sub.example.com",
+			wantAuthority: []dj.Record{
+				{Name: "sub.example.com.", Type: int(dns.TypeNS), TTL: 3600, Data: "ns.sub.example.com."},
+			},
+			wantAdditional: []dj.Record{
+				{Name: "ns.sub.example.com.", Type: int(dns.TypeA), TTL: 3600, Data: "192.0.2.53"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.SimpleQuery(ctx, &dj.Request{Name: test.name, Type: "A"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Status != test.wantStatus {
+				t.Errorf("got status %d, want %d", resp.Status, test.wantStatus)
+			}
+
+			if !reflect.DeepEqual(resp.Authority, test.wantAuthority) {
+				t.Errorf("got authority %+v, want %+v", resp.Authority, test.wantAuthority)
+			}
+
+			if !reflect.DeepEqual(resp.Additional, test.wantAdditional) {
+				t.Errorf("got additional %+v, want %+v", resp.Additional, test.wantAdditional)
+			}
+
+			if resp.Comment != test.wantComment {
+				t.Errorf("got comment %q, want %q", resp.Comment, test.wantComment)
+			}
+		})
+	}
+}
+
+func TestClient_Method(t *testing.T) {
+	ctx := testContext(t)
+
+	var gotMethod string
+
+	mux := doh.NewServerMux(testAnswerHandler)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL := server.URL + "/dns-query"
+
+	largeReq := new(dns.Msg).SetQuestion("google.com.", dns.TypeA)
+	largeReq.SetEdns0(4096, false)
+	largeReq.IsEdns0().Option = append(largeReq.IsEdns0().Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, doh.DefaultPostThreshold),
+	})
+
+	tests := []struct {
+		name   string
+		method doh.Method
+		req    *dns.Msg
+		want   string
+	}{
+		{
+			name:   "get",
+			method: doh.MethodGet,
+			req:    new(dns.Msg).SetQuestion("google.com.", dns.TypeA),
+			want:   http.MethodGet,
+		},
+		{
+			name:   "post",
+			method: doh.MethodPost,
+			req:    new(dns.Msg).SetQuestion("google.com.", dns.TypeA),
+			want:   http.MethodPost,
+		},
+		{
+			name:   "auto (small)",
+			method: doh.MethodAuto,
+			req:    new(dns.Msg).SetQuestion("google.com.", dns.TypeA),
+			want:   http.MethodGet,
+		},
+		{
+			name:   "auto (large)",
+			method: doh.MethodAuto,
+			req:    largeReq,
+			want:   http.MethodPost,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := doh.NewClient(doh.WithServers(serverURL), doh.WithMethod(test.method))
+
+			resp, err := client.Exchange(ctx, test.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if gotMethod != test.want {
+				t.Errorf("got method %s, want %s", gotMethod, test.want)
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(resp.Answer))
+			}
+		})
+	}
+}
+
+func TestClient_Padding(t *testing.T) {
+	ctx := testContext(t)
+
+	var gotQuery []byte
+
+	mux := doh.NewServerMux(testAnswerHandler)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name        string
+		opts        []doh.ClientOption
+		wantPadding bool
+	}{
+		{
+			name:        "default",
+			wantPadding: true,
+		},
+		{
+			name:        "with edns0",
+			opts:        []doh.ClientOption{doh.WithEDNS0(1232)},
+			wantPadding: true,
+		},
+		{
+			name:        "disabled",
+			opts:        []doh.ClientOption{doh.WithPadding(false)},
+			wantPadding: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := doh.NewClient(append([]doh.ClientOption{doh.WithServers(server.URL + "/dns-query")}, test.opts...)...)
+
+			for _, name := range []string{"a.example.", "a-much-longer-name.example."} {
+				req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+
+				if _, err := client.Exchange(ctx, req); err != nil {
+					t.Fatal(err)
+				}
+
+				if req.IsEdns0() != nil {
+					t.Error("request message was modified")
+				}
+
+				var query dns.Msg
+				if err := query.Unpack(gotQuery); err != nil {
+					t.Fatal(err)
+				}
+
+				if got := testHasPadding(&query); got != test.wantPadding {
+					t.Errorf("%s: got padding %v, want %v", name, got, test.wantPadding)
+				}
+
+				if test.wantPadding && len(gotQuery)%doh.QueryPaddingBlockSize != 0 {
+					t.Errorf("%s: got query length %d, want a multiple of %d", name, len(gotQuery), doh.QueryPaddingBlockSize)
+				}
+			}
+		})
+	}
+}
+
+// testHasPadding reports whether the message has an EDNS(0) padding option.
+func testHasPadding(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,211 @@
+package doh
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+)
+
+// WithDNSSEC sets the DNSSEC OK (DO) bit of queries, as defined in
+// [RFC 3225], which asks resolvers to include DNSSEC records, such as
+// RRSIGs, in responses. Queries without an OPT record get one, since the
+// DO bit is carried in it.
+//
+// Validating resolvers also report whether they validated the answer with
+// the Authenticated Data (AD) bit of responses, which is set in queries as
+// well, as described in [RFC 6840 section 5.7].
+//
+// [RFC 3225]: https://datatracker.ietf.org/doc/html/rfc3225
+// [RFC 6840 section 5.7]: https://datatracker.ietf.org/doc/html/rfc6840#section-5.7
+func WithDNSSEC() ClientOption {
+	return func(c *Client) {
+		c.dnssec = true
+	}
+}
+
+// WithCheckingDisabled sets the Checking Disabled (CD) bit of queries, as
+// defined in [RFC 4035 section 3.2.2], which asks validating resolvers to
+// return answers even if they fail DNSSEC validation, such as to inspect
+// the records of a misconfigured zone.
+//
+// [RFC 4035 section 3.2.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.2
+func WithCheckingDisabled() ClientOption {
+	return func(c *Client) {
+		c.checkingDisabled = true
+	}
+}
+
+// newDJRecord converts a DNS resource record into a dj (DNS JSON) record,
+// with the structured fields of DNSSEC records.
+func newDJRecord(rr dns.RR) dj.Record {
+	record := dj.Record{
+		Name: rr.Header().Name,
+		Type: int(rr.Header().Rrtype),
+		TTL:  int(rr.Header().Ttl),
+	}
+
+	// Extract main information from the record (IP address, etc.)
+	// and add it to the response.
+	switch rr := rr.(type) {
+	case *dns.A:
+		record.Data = rr.A.String()
+	case *dns.AAAA:
+		record.Data = rr.AAAA.String()
+	case *dns.CNAME:
+		record.Data = rr.Target
+	case *dns.MX:
+		record.Data = rr.Mx
+	case *dns.NS:
+		record.Data = rr.Ns
+	case *dns.PTR:
+		record.Data = rr.Ptr
+	case *dns.SOA:
+		record.Data = rr.Ns
+	case *dns.TXT:
+		record.Data = strings.Join(rr.Txt, " ")
+	case *dns.RRSIG:
+		record.Data = rdata(rr)
+		record.RRSIG = &dj.RRSIG{
+			TypeCovered: dns.TypeToString[rr.TypeCovered],
+			Algorithm:   int(rr.Algorithm),
+			Labels:      int(rr.Labels),
+			OriginalTTL: int(rr.OrigTtl),
+			Expiration:  signatureTime(rr.Expiration),
+			Inception:   signatureTime(rr.Inception),
+			KeyTag:      int(rr.KeyTag),
+			SignerName:  rr.SignerName,
+			Signature:   rr.Signature,
+		}
+	case *dns.DNSKEY:
+		record.Data = rdata(rr)
+		record.DNSKEY = &dj.DNSKEY{
+			Flags:     int(rr.Flags),
+			Protocol:  int(rr.Protocol),
+			Algorithm: int(rr.Algorithm),
+			PublicKey: rr.PublicKey,
+			KeyTag:    int(rr.KeyTag()),
+		}
+	case *dns.DS:
+		record.Data = rdata(rr)
+		record.DS = &dj.DS{
+			KeyTag:     int(rr.KeyTag),
+			Algorithm:  int(rr.Algorithm),
+			DigestType: int(rr.DigestType),
+			Digest:     strings.ToLower(rr.Digest),
+		}
+	case *dns.NSEC:
+		record.Data = rdata(rr)
+		record.NSEC = &dj.NSEC{
+			NextDomain: rr.NextDomain,
+			Types:      typeNames(rr.TypeBitMap),
+		}
+	case *dns.NSEC3:
+		salt := strings.ToLower(rr.Salt)
+		if salt == "" {
+			salt = "-"
+		}
+
+		record.Data = rdata(rr)
+		record.NSEC3 = &dj.NSEC3{
+			HashAlgorithm: int(rr.Hash),
+			Flags:         int(rr.Flags),
+			Iterations:    int(rr.Iterations),
+			Salt:          salt,
+			NextDomain:    rr.NextDomain,
+			Types:         typeNames(rr.TypeBitMap),
+		}
+	default:
+		record.Data = rr.String()
+	}
+
+	return record
+}
+
+// rdata returns the data of the resource record in presentation format,
+// without its header, as returned by DoH JSON API servers.
+func rdata(rr dns.RR) string {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// signatureTime returns the time of an RRSIG expiration or inception field,
+// using serial number arithmetic, as described in [RFC 4034 section 3.1.5].
+//
+// [RFC 4034 section 3.1.5]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.5
+func signatureTime(t uint32) time.Time {
+	// TimeToString resolves the 32-bit value to the closest time to now.
+	parsed, err := time.Parse("20060102150405", dns.TimeToString(t))
+	if err != nil {
+		return time.Unix(int64(t), 0).UTC()
+	}
+
+	return parsed
+}
+
+// typeNames returns the names of the record types in an NSEC or NSEC3 type
+// bit map.
+func typeNames(types []uint16) []string {
+	names := make([]string, 0, len(types))
+
+	for _, t := range types {
+		names = append(names, dns.Type(t).String())
+	}
+
+	return names
+}
+
+// nsecCovers returns whether the name is between the owner name and the next
+// domain name of the NSEC record in canonical order, proving that it doesn't
+// exist, as described in [RFC 4035 section 5.4].
+//
+// [RFC 4035 section 5.4]: https://datatracker.ietf.org/doc/html/rfc4035#section-5.4
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := dns.CanonicalName(nsec.Hdr.Name), dns.CanonicalName(nsec.NextDomain)
+
+	// Names below a delegation point are not in the zone of its NSEC record,
+	// as described in RFC 6840 section 4.1.
+	if dns.IsSubDomain(owner, name) && owner != name && hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA) {
+		return false
+	}
+
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+
+	// The last NSEC record of a zone wraps around to its apex.
+	return dns.IsSubDomain(next, name) && (canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0)
+}
+
+// canonicalCompare compares two domain names in the canonical order defined
+// in [RFC 4034 section 6.1], returning -1, 0, or 1.
+//
+// [RFC 4034 section 6.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-6.1
+func canonicalCompare(a, b string) int {
+	aLabels := dns.SplitDomainName(dns.CanonicalName(a))
+	bLabels := dns.SplitDomainName(dns.CanonicalName(b))
+
+	slices.Reverse(aLabels)
+	slices.Reverse(bLabels)
+
+	return slices.Compare(aLabels, bLabels)
+}
+
+// nextCloser returns the name one label longer than its closest encloser,
+// as defined in [RFC 5155 section 1.3].
+//
+// [RFC 5155 section 1.3]: https://datatracker.ietf.org/doc/html/rfc5155#section-1.3
+func nextCloser(name, encloser string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= dns.CountLabel(encloser) {
+		return name
+	}
+
+	return dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+}
+
+// hasType returns whether the NSEC or NSEC3 type bit map contains the type.
+func hasType(types []uint16, t uint16) bool {
+	return slices.Contains(types, t)
+}
@@ -0,0 +1,213 @@
+package doh_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestWithDNSSEC(t *testing.T) {
+	ctx := testContext(t)
+
+	var gotQuery *dns.Msg
+
+	serverURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		gotQuery = req
+		return testAnswerHandler(w, r, req)
+	})
+
+	tests := []struct {
+		name   string
+		opts   []doh.ClientOption
+		wantDO bool
+		wantAD bool
+		wantCD bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:   "dnssec",
+			opts:   []doh.ClientOption{doh.WithDNSSEC()},
+			wantDO: true,
+			wantAD: true,
+		},
+		{
+			name:   "checking disabled",
+			opts:   []doh.ClientOption{doh.WithCheckingDisabled()},
+			wantCD: true,
+		},
+		{
+			name:   "dnssec and checking disabled",
+			opts:   []doh.ClientOption{doh.WithDNSSEC(), doh.WithCheckingDisabled(), doh.WithPadding(false)},
+			wantDO: true,
+			wantAD: true,
+			wantCD: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := doh.NewClient(append([]doh.ClientOption{doh.WithServers(serverURL)}, test.opts...)...)
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+			if _, err := client.Exchange(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+
+			if req.IsEdns0() != nil || req.AuthenticatedData || req.CheckingDisabled {
+				t.Error("request message was modified")
+			}
+
+			gotDO := gotQuery.IsEdns0() != nil && gotQuery.IsEdns0().Do()
+
+			if gotDO != test.wantDO {
+				t.Errorf("got DO %v, want %v", gotDO, test.wantDO)
+			}
+
+			if gotQuery.AuthenticatedData != test.wantAD {
+				t.Errorf("got AD %v, want %v", gotQuery.AuthenticatedData, test.wantAD)
+			}
+
+			if gotQuery.CheckingDisabled != test.wantCD {
+				t.Errorf("got CD %v, want %v", gotQuery.CheckingDisabled, test.wantCD)
+			}
+		})
+	}
+}
+
+func TestClient_SimpleQuery_DNSSEC(t *testing.T) {
+	ctx := testContext(t)
+
+	records := map[uint16]string{
+		dns.TypeA:      "example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl",
+		dns.TypeDNSKEY: "example.com. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+		dns.TypeDS:     "example.com. 3600 IN DS 2371 13 2 C988EC423E3880EB8DD8A46FE06CA230EE23F35B578A2AA70DF52AC4A4A0A9A8",
+		dns.TypeNSEC:   "example.com. 3600 IN NSEC www.example.com. A NS SOA RRSIG NSEC DNSKEY",
+		dns.TypeNSEC3:  "2t7b4g4vsa5smi47k61mv5bv1a22bojr.example.com. 3600 IN NSEC3 1 1 0 AABB 2VPTU5TIMAMQTTGL4LUU9KG21E0AOR3S A RRSIG",
+	}
+
+	serverURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(req)
+		resp.AuthenticatedData = true
+
+		rr, err := dns.NewRR(records[req.Question[0].Qtype])
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Answer = append(resp.Answer, rr)
+
+		return resp, nil
+	})
+
+	client := doh.NewClient(doh.WithServers(serverURL), doh.WithDNSSEC())
+
+	tests := []struct {
+		qtype    string
+		wantData string
+		want     dj.Record
+	}{
+		{
+			qtype:    "A",
+			wantData: "A 13 2 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl",
+			want: dj.Record{
+				RRSIG: &dj.RRSIG{
+					TypeCovered: "A",
+					Algorithm:   13,
+					Labels:      2,
+					OriginalTTL: 300,
+					Expiration:  time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+					Inception:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+					KeyTag:      12345,
+					SignerName:  "example.com.",
+					Signature:   "c2lnbmF0dXJl",
+				},
+			},
+		},
+		{
+			qtype:    "DNSKEY",
+			wantData: "257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+			want: dj.Record{
+				DNSKEY: &dj.DNSKEY{
+					Flags:     257,
+					Protocol:  3,
+					Algorithm: 13,
+					PublicKey: "mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+					KeyTag:    2371,
+				},
+			},
+		},
+		{
+			qtype:    "DS",
+			wantData: "2371 13 2 C988EC423E3880EB8DD8A46FE06CA230EE23F35B578A2AA70DF52AC4A4A0A9A8",
+			want: dj.Record{
+				DS: &dj.DS{
+					KeyTag:     2371,
+					Algorithm:  13,
+					DigestType: 2,
+					Digest:     "c988ec423e3880eb8dd8a46fe06ca230ee23f35b578a2aa70df52ac4a4a0a9a8",
+				},
+			},
+		},
+		{
+			qtype:    "NSEC",
+			wantData: "www.example.com. A NS SOA RRSIG NSEC DNSKEY",
+			want: dj.Record{
+				NSEC: &dj.NSEC{
+					NextDomain: "www.example.com.",
+					Types:      []string{"A", "NS", "SOA", "RRSIG", "NSEC", "DNSKEY"},
+				},
+			},
+		},
+		{
+			qtype:    "NSEC3",
+			wantData: "1 1 0 AABB 2VPTU5TIMAMQTTGL4LUU9KG21E0AOR3S A RRSIG",
+			want: dj.Record{
+				NSEC3: &dj.NSEC3{
+					HashAlgorithm: 1,
+					Flags:         1,
+					Iterations:    0,
+					Salt:          "aabb",
+					NextDomain:    "2VPTU5TIMAMQTTGL4LUU9KG21E0AOR3S",
+					Types:         []string{"A", "RRSIG"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.qtype, func(t *testing.T) {
+			resp, err := client.SimpleQuery(ctx, &dj.Request{Name: "example.com", Type: test.qtype})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !resp.AD {
+				t.Error("got AD false, want true")
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(resp.Answer))
+			}
+
+			got := resp.Answer[0]
+
+			if got.Data != test.wantData {
+				t.Errorf("got data %q, want %q", got.Data, test.wantData)
+			}
+
+			got.Name, got.Type, got.TTL, got.Data = "", 0, 0, ""
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got record %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
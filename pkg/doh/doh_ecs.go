@@ -0,0 +1,283 @@
+package doh
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Default source prefix lengths that a [ClientSubnetHandler] truncates
+// client subnets to, as recommended by [RFC 7871 section 11.1].
+//
+// [RFC 7871 section 11.1]: https://datatracker.ietf.org/doc/html/rfc7871#section-11.1
+const (
+	DefaultClientSubnetIPv4PrefixLen = 24
+	DefaultClientSubnetIPv6PrefixLen = 56
+)
+
+// ClientSubnetMode determines how a [ClientSubnetHandler] treats the EDNS
+// Client Subnet (ECS) option of queries before forwarding them.
+type ClientSubnetMode int
+
+const (
+	// ClientSubnetStrip removes the ECS option from queries, so that
+	// upstreams never learn the subnet of the client.
+	ClientSubnetStrip ClientSubnetMode = iota
+
+	// ClientSubnetTruncate shortens the ECS option of queries to at most the
+	// configured prefix lengths, and leaves queries without one unchanged.
+	ClientSubnetTruncate
+
+	// ClientSubnetSynthesize adds an ECS option with the HTTP client's
+	// address, truncated to the configured prefix lengths, to queries
+	// without one, and truncates the ECS option of other queries.
+	ClientSubnetSynthesize
+)
+
+// String returns the name of the client subnet mode.
+func (m ClientSubnetMode) String() string {
+	switch m {
+	case ClientSubnetStrip:
+		return "strip"
+	case ClientSubnetTruncate:
+		return "truncate"
+	case ClientSubnetSynthesize:
+		return "synthesize"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseClientSubnetMode returns the client subnet mode with the given name,
+// as returned by [ClientSubnetMode.String].
+func ParseClientSubnetMode(name string) (ClientSubnetMode, bool) {
+	for _, mode := range []ClientSubnetMode{ClientSubnetStrip, ClientSubnetTruncate, ClientSubnetSynthesize} {
+		if strings.EqualFold(name, mode.String()) {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// ClientSubnetOptions configures a [ClientSubnetHandler].
+type ClientSubnetOptions struct {
+	// Mode determines how the ECS option of queries is treated. The default
+	// is ClientSubnetStrip.
+	Mode ClientSubnetMode
+
+	// IPv4PrefixLen is the longest IPv4 source prefix forwarded upstream.
+	// If zero, DefaultClientSubnetIPv4PrefixLen is used.
+	IPv4PrefixLen int
+
+	// IPv6PrefixLen is the longest IPv6 source prefix forwarded upstream.
+	// If zero, DefaultClientSubnetIPv6PrefixLen is used.
+	IPv6PrefixLen int
+}
+
+// truncate returns the prefix shortened to the configured prefix length of
+// its address family.
+func (opts ClientSubnetOptions) truncate(prefix netip.Prefix) netip.Prefix {
+	limit := opts.IPv4PrefixLen
+	if limit <= 0 {
+		limit = DefaultClientSubnetIPv4PrefixLen
+	}
+
+	if prefix.Addr().Is6() {
+		limit = opts.IPv6PrefixLen
+		if limit <= 0 {
+			limit = DefaultClientSubnetIPv6PrefixLen
+		}
+	}
+
+	prefix, _ = prefix.Addr().Prefix(min(prefix.Bits(), limit))
+
+	return prefix
+}
+
+// ClientSubnetHandler returns a handler that strips, truncates, or
+// synthesizes the [RFC 7871] EDNS Client Subnet (ECS) option of queries
+// before calling the next handler, depending on the configured mode.
+//
+// Responses carry the ECS option of the original query, with the scope
+// prefix length returned by the next handler, or no ECS option if the
+// original query had none, as described in [RFC 7871 section 7.2.1].
+//
+// [RFC 7871]: https://datatracker.ietf.org/doc/html/rfc7871
+// [RFC 7871 section 7.2.1]: https://datatracker.ietf.org/doc/html/rfc7871#section-7.2.1
+func ClientSubnetHandler(next Handler, opts ClientSubnetOptions) Handler {
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		original := clientSubnet(req)
+
+		fwd := req.Copy()
+
+		switch opts.Mode {
+		case ClientSubnetStrip:
+			removeClientSubnet(fwd)
+		case ClientSubnetTruncate, ClientSubnetSynthesize:
+			prefix, ok := clientSubnetPrefix(original)
+
+			if original == nil && opts.Mode == ClientSubnetSynthesize {
+				prefix, ok = remotePrefix(r)
+			}
+
+			if ok {
+				setClientSubnet(fwd, newClientSubnet(opts.truncate(prefix)), dns.DefaultMsgSize)
+			} else {
+				removeClientSubnet(fwd)
+			}
+		}
+
+		resp, err := next(w, r, fwd)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+
+		return clientSubnetResponse(resp, original), nil
+	}
+}
+
+// clientSubnetResponse returns a copy of the response carrying the given
+// ECS option of the original query, with the scope prefix length of the
+// response's own ECS option, if any.
+func clientSubnetResponse(resp *dns.Msg, original *dns.EDNS0_SUBNET) *dns.Msg {
+	subnet := clientSubnet(resp)
+
+	if original == nil {
+		if subnet == nil {
+			return resp
+		}
+
+		resp = resp.Copy()
+		removeClientSubnet(resp)
+
+		return resp
+	}
+
+	if subnet == nil {
+		return resp
+	}
+
+	echo := *original
+	echo.SourceScope = subnet.SourceScope
+
+	resp = resp.Copy()
+	setClientSubnet(resp, &echo, dns.DefaultMsgSize)
+
+	return resp
+}
+
+// remotePrefix returns the host prefix of the HTTP client's address.
+func remotePrefix(r *http.Request) (netip.Prefix, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	addr = addr.Unmap().WithZone("")
+
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// clientSubnet returns the ECS option of the DNS message, if any.
+func clientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// clientSubnetPrefix returns the source prefix of the ECS option.
+func clientSubnetPrefix(subnet *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	if subnet == nil {
+		return netip.Prefix{}, false
+	}
+
+	addr, ok := netip.AddrFromSlice(subnet.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	switch subnet.Family {
+	case 1:
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			return netip.Prefix{}, false
+		}
+	case 2:
+		if !addr.Is6() {
+			return netip.Prefix{}, false
+		}
+	default:
+		return netip.Prefix{}, false
+	}
+
+	prefix, err := addr.Prefix(int(subnet.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return prefix, true
+}
+
+// newClientSubnet returns an ECS option for the given source prefix, with
+// the address bits beyond the prefix length cleared.
+func newClientSubnet(prefix netip.Prefix) *dns.EDNS0_SUBNET {
+	prefix = prefix.Masked()
+
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       prefix.Addr().AsSlice(),
+	}
+
+	if prefix.Addr().Is6() {
+		subnet.Family = 2
+	}
+
+	return subnet
+}
+
+// setClientSubnet replaces the ECS option of the DNS message with the given
+// one. Messages without an OPT record get one advertising the given UDP
+// payload size.
+func setClientSubnet(msg *dns.Msg, subnet *dns.EDNS0_SUBNET, udpSize uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(udpSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	removeClientSubnet(msg)
+
+	opt.Option = append(opt.Option, subnet)
+}
+
+// removeClientSubnet removes the ECS option from the DNS message, if any.
+func removeClientSubnet(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+		return option.Option() == dns.EDNS0SUBNET
+	})
+}
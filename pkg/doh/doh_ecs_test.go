@@ -0,0 +1,230 @@
+package doh_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testSubnetHandler answers A queries like testAnswerHandler, echoing the
+// query's client subnet with a scope prefix length equal to its source
+// prefix length, as a resolver supporting ECS would.
+func testSubnetHandler(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := testAnswerHandler(w, r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if subnet := testClientSubnet(req); subnet != nil {
+		echo := *subnet
+		echo.SourceScope = subnet.SourceNetmask
+
+		resp.SetEdns0(1232, false)
+		resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+	}
+
+	return resp, nil
+}
+
+// testClientSubnet returns the client subnet option of the message, if any.
+func testClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// testSubnetString returns the client subnet option of the message as a
+// prefix, or an empty string if it has none.
+func testSubnetString(msg *dns.Msg) string {
+	subnet := testClientSubnet(msg)
+	if subnet == nil {
+		return ""
+	}
+
+	addr, _ := netip.AddrFromSlice(subnet.Address)
+
+	prefix, _ := addr.Unmap().Prefix(int(subnet.SourceNetmask))
+
+	return prefix.String()
+}
+
+func TestClientSubnetHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       doh.ClientSubnetMode
+		remoteAddr string
+		subnet     string
+		wantFwd    string
+		wantResp   string
+	}{
+		{
+			name:     "strip",
+			mode:     doh.ClientSubnetStrip,
+			subnet:   "203.0.113.7/32",
+			wantFwd:  "",
+			wantResp: "",
+		},
+		{
+			name:     "truncate ipv4",
+			mode:     doh.ClientSubnetTruncate,
+			subnet:   "203.0.113.7/32",
+			wantFwd:  "203.0.113.0/24",
+			wantResp: "203.0.113.7/32",
+		},
+		{
+			name:     "truncate ipv6",
+			mode:     doh.ClientSubnetTruncate,
+			subnet:   "2001:db8:1:2:3::1/128",
+			wantFwd:  "2001:db8:1::/56",
+			wantResp: "2001:db8:1:2:3::1/128",
+		},
+		{
+			name:     "truncate short prefix",
+			mode:     doh.ClientSubnetTruncate,
+			subnet:   "198.51.0.0/16",
+			wantFwd:  "198.51.0.0/16",
+			wantResp: "198.51.0.0/16",
+		},
+		{
+			name:     "truncate without subnet",
+			mode:     doh.ClientSubnetTruncate,
+			wantFwd:  "",
+			wantResp: "",
+		},
+		{
+			name:       "synthesize",
+			mode:       doh.ClientSubnetSynthesize,
+			remoteAddr: "192.0.2.55:41234",
+			wantFwd:    "192.0.2.0/24",
+			wantResp:   "",
+		},
+		{
+			name:       "synthesize ipv6",
+			mode:       doh.ClientSubnetSynthesize,
+			remoteAddr: "[2001:db8:aa:bb::1]:41234",
+			wantFwd:    "2001:db8:aa::/56",
+			wantResp:   "",
+		},
+		{
+			name:       "synthesize with subnet",
+			mode:       doh.ClientSubnetSynthesize,
+			remoteAddr: "192.0.2.55:41234",
+			subnet:     "203.0.113.7/32",
+			wantFwd:    "203.0.113.0/24",
+			wantResp:   "203.0.113.7/32",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fwd *dns.Msg
+
+			handler := doh.ClientSubnetHandler(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				fwd = req
+				return testSubnetHandler(w, r, req)
+			}, doh.ClientSubnetOptions{Mode: test.mode})
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+			if test.subnet != "" {
+				prefix := netip.MustParsePrefix(test.subnet)
+
+				family := uint16(1)
+				if prefix.Addr().Is6() {
+					family = 2
+				}
+
+				req.SetEdns0(1232, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        family,
+					SourceNetmask: uint8(prefix.Bits()),
+					Address:       net.IP(prefix.Addr().AsSlice()),
+				})
+			}
+
+			httpReq := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			if test.remoteAddr != "" {
+				httpReq.RemoteAddr = test.remoteAddr
+			}
+
+			resp, err := handler(httptest.NewRecorder(), httpReq, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := testSubnetString(fwd); got != test.wantFwd {
+				t.Errorf("got forwarded subnet %q, want %q", got, test.wantFwd)
+			}
+
+			if got := testSubnetString(resp); got != test.wantResp {
+				t.Errorf("got response subnet %q, want %q", got, test.wantResp)
+			}
+
+			if got := testSubnetString(req); got != test.subnet {
+				t.Errorf("got request subnet %q, want %q (request was modified)", got, test.subnet)
+			}
+
+			if subnet := testClientSubnet(resp); subnet != nil && subnet.SourceScope == 0 {
+				t.Error("got response subnet without scope")
+			}
+		})
+	}
+}
+
+func TestParseClientSubnetMode(t *testing.T) {
+	for _, mode := range []doh.ClientSubnetMode{doh.ClientSubnetStrip, doh.ClientSubnetTruncate, doh.ClientSubnetSynthesize} {
+		got, ok := doh.ParseClientSubnetMode(mode.String())
+		if !ok || got != mode {
+			t.Errorf("got mode %v, %v for %q, want %v", got, ok, mode.String(), mode)
+		}
+	}
+
+	if _, ok := doh.ParseClientSubnetMode("bogus"); ok {
+		t.Error("got mode for unknown name")
+	}
+}
+
+func TestWithClientSubnet(t *testing.T) {
+	ctx := testContext(t)
+
+	var gotSubnet string
+
+	serverURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		gotSubnet = testSubnetString(req)
+		return testSubnetHandler(w, r, req)
+	})
+
+	client := doh.NewClient(
+		doh.WithServers(serverURL),
+		doh.WithClientSubnet(netip.MustParsePrefix("203.0.113.0/24")),
+	)
+
+	resp, err := client.SimpleQuery(ctx, &dj.Request{Name: "example.com", Type: "A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotSubnet != "203.0.113.0/24" {
+		t.Errorf("got query subnet %q, want %q", gotSubnet, "203.0.113.0/24")
+	}
+
+	if resp.EDNSClientSubnet != "203.0.113.0/24" {
+		t.Errorf("got response subnet %q, want %q", resp.EDNSClientSubnet, "203.0.113.0/24")
+	}
+}
@@ -0,0 +1,186 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// newErrorResponse returns a response to the given DNS request with the
+// given response code. If the request supports EDNS(0), an [RFC 8914]
+// Extended DNS Error with the given info code and extra text is included.
+//
+// [RFC 8914]: https://datatracker.ietf.org/doc/html/rfc8914
+func newErrorResponse(req *dns.Msg, rcode int, infoCode uint16, extraText string) *dns.Msg {
+	resp := new(dns.Msg).SetRcode(req, rcode)
+	resp.RecursionAvailable = true
+
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		setExtendedError(resp, infoCode, extraText)
+	}
+
+	return resp
+}
+
+// setExtendedError adds an [RFC 8914] Extended DNS Error to the given
+// response, which must already have an OPT record.
+//
+// [RFC 8914]: https://datatracker.ietf.org/doc/html/rfc8914
+func setExtendedError(resp *dns.Msg, infoCode uint16, extraText string) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  infoCode,
+		ExtraText: extraText,
+	})
+}
+
+// extendedErrorComment returns the [RFC 8914] Extended DNS Errors of the
+// given response as a comment, such as "EDE(18): Prohibited", or an empty
+// string if it has none.
+//
+// [RFC 8914]: https://datatracker.ietf.org/doc/html/rfc8914
+func extendedErrorComment(resp *dns.Msg) string {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	var comments []string
+
+	for _, option := range opt.Option {
+		ede, ok := option.(*dns.EDNS0_EDE)
+		if !ok {
+			continue
+		}
+
+		comment := "EDE(" + strconv.Itoa(int(ede.InfoCode)) + ")"
+
+		if name, ok := dns.ExtendedErrorCodeToString[ede.InfoCode]; ok {
+			comment += ": " + name
+		}
+
+		if ede.ExtraText != "" {
+			comment += ": " + ede.ExtraText
+		}
+
+		comments = append(comments, comment)
+	}
+
+	return strings.Join(comments, "; ")
+}
+
+// Padding block sizes of the [RFC 8467] block-length padding policy, which
+// pads messages to a multiple of the block size to hide the length of the
+// names they contain.
+//
+// [RFC 8467]: https://datatracker.ietf.org/doc/html/rfc8467#section-4.1
+const (
+	// QueryPaddingBlockSize is the block size queries are padded to.
+	QueryPaddingBlockSize = 128
+
+	// ResponsePaddingBlockSize is the block size responses are padded to.
+	ResponsePaddingBlockSize = 468
+)
+
+// paddingOptionHeaderLen is the length of the option code and option length
+// fields of an EDNS(0) padding option.
+const paddingOptionHeaderLen = 4
+
+// hasPadding reports whether the DNS message has an [RFC 7830] EDNS(0)
+// padding option.
+//
+// [RFC 7830]: https://datatracker.ietf.org/doc/html/rfc7830
+func hasPadding(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+
+	return false
+}
+
+// padMsg adds an [RFC 7830] EDNS(0) padding option to the DNS message, so
+// that its packed length is a multiple of the given block size, replacing
+// any existing padding. Messages without an OPT record get one advertising
+// the given UDP payload size.
+//
+// [RFC 7830]: https://datatracker.ietf.org/doc/html/rfc7830
+func padMsg(msg *dns.Msg, blockSize int, udpSize uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(udpSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+		return option.Option() == dns.EDNS0PADDING
+	})
+
+	length := msg.Len() + paddingOptionHeaderLen
+
+	padding := (blockSize - length%blockSize) % blockSize
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
+
+// trimResponseEDNS returns the response without the EDNS(0) parts that the
+// query didn't ask for, such as those of an upstream's response to a query
+// forwarded with padding: its OPT record if the query had none, as required
+// by [RFC 6891 section 7], or its padding if the query wasn't padded, as
+// described in [RFC 8467 section 4.1]. The response is copied before it is
+// modified, since handlers may return messages that are shared.
+//
+// [RFC 6891 section 7]: https://datatracker.ietf.org/doc/html/rfc6891#section-7
+// [RFC 8467 section 4.1]: https://datatracker.ietf.org/doc/html/rfc8467#section-4.1
+func trimResponseEDNS(req, resp *dns.Msg) *dns.Msg {
+	switch {
+	case resp.IsEdns0() == nil:
+		return resp
+	case req.IsEdns0() == nil:
+		resp = resp.Copy()
+		resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	case hasPadding(resp) && !hasPadding(req):
+		resp = resp.Copy()
+
+		opt := resp.IsEdns0()
+		opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+			return option.Option() == dns.EDNS0PADDING
+		})
+	}
+
+	return resp
+}
+
+// extendedErrorCode returns the Extended DNS Error info code that best
+// describes the given handler error.
+func extendedErrorCode(err error) uint16 {
+	switch {
+	case errors.Is(err, ErrForwarderFailed):
+		return dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.Is(err, context.DeadlineExceeded):
+		return dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.Is(err, ErrFailedHTTPRequest), errors.Is(err, ErrFailedDNSExchange):
+		return dns.ExtendedErrorCodeNetworkError
+	case errors.Is(err, ErrFailedDNSResponseUnpack):
+		return dns.ExtendedErrorCodeInvalidData
+	default:
+		return dns.ExtendedErrorCodeOther
+	}
+}
@@ -0,0 +1,376 @@
+package doh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultBlockTTL is the default TTL, in seconds, of the records in
+// responses to blocked queries answered by a [FilterHandler].
+const DefaultBlockTTL = 300
+
+// BlockMode determines how a [FilterHandler] answers blocked queries.
+type BlockMode int
+
+const (
+	// BlockNXDomain answers blocked queries with NXDOMAIN, as if the name
+	// did not exist.
+	BlockNXDomain BlockMode = iota
+
+	// BlockNullIP answers blocked A and AAAA queries with the unspecified
+	// addresses 0.0.0.0 and ::, and other blocked queries with no data.
+	BlockNullIP
+
+	// BlockRefused answers blocked queries with REFUSED.
+	BlockRefused
+)
+
+// String returns the name of the block mode.
+func (m BlockMode) String() string {
+	switch m {
+	case BlockNXDomain:
+		return "nxdomain"
+	case BlockNullIP:
+		return "null"
+	case BlockRefused:
+		return "refused"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseBlockMode returns the block mode with the given name, as returned by
+// [BlockMode.String].
+func ParseBlockMode(name string) (BlockMode, bool) {
+	for _, mode := range []BlockMode{BlockNXDomain, BlockNullIP, BlockRefused} {
+		if strings.EqualFold(name, mode.String()) {
+			return mode, true
+		}
+	}
+	return 0, false
+}
+
+// hostsLocalNames are names commonly found in hosts files that refer to the
+// local machine, which are never blocked when loading hosts files.
+var hostsLocalNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// Filter is a set of blocked and allowed domains. Each domain also matches
+// all of its subdomains, and allowed domains take precedence over blocked
+// domains, so that false positives in a blocklist can be overridden.
+//
+// A Filter is safe for concurrent use, so lists can be reloaded while it
+// is in use.
+type Filter struct {
+	mu      sync.RWMutex
+	blocked map[string]struct{}
+	allowed map[string]struct{}
+}
+
+// NewFilter returns a new, empty filter.
+func NewFilter() *Filter {
+	return &Filter{
+		blocked: make(map[string]struct{}),
+		allowed: make(map[string]struct{}),
+	}
+}
+
+// Block adds the given domains, and their subdomains, to the blocklist.
+func (f *Filter) Block(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, name := range names {
+		f.blocked[dns.CanonicalName(name)] = struct{}{}
+	}
+}
+
+// Allow adds the given domains, and their subdomains, to the allowlist.
+func (f *Filter) Allow(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, name := range names {
+		f.allowed[dns.CanonicalName(name)] = struct{}{}
+	}
+}
+
+// Len returns the number of blocked domains.
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return len(f.blocked)
+}
+
+// LoadBlocklist adds the domains of the given list to the blocklist. The
+// list can use any mix of the following formats, one rule per line:
+//
+//   - hosts files, such as "0.0.0.0 ads.example.com"
+//   - plain domain lists, such as "ads.example.com"
+//   - adblock-style rules, such as "||ads.example.com^"
+//
+// Adblock-style exception rules, such as "@@||example.com^", are added to
+// the allowlist. Comments, blank lines, and unsupported rules, including
+// cosmetic rules such as "example.com##.banner", are ignored.
+func (f *Filter) LoadBlocklist(r io.Reader) error {
+	blocked, allowed, err := parseDomainList(r)
+	if err != nil {
+		return err
+	}
+
+	f.Block(blocked...)
+	f.Allow(allowed...)
+
+	return nil
+}
+
+// LoadAllowlist adds the domains of the given list, in any of the formats
+// supported by [Filter.LoadBlocklist], to the allowlist.
+func (f *Filter) LoadAllowlist(r io.Reader) error {
+	blocked, allowed, err := parseDomainList(r)
+	if err != nil {
+		return err
+	}
+
+	f.Allow(blocked...)
+	f.Allow(allowed...)
+
+	return nil
+}
+
+// Blocked reports whether the given name, or any of its parent domains, is
+// blocked, and not allowed.
+func (f *Filter) Blocked(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	name = dns.CanonicalName(name)
+
+	return matchSuffix(f.blocked, name) && !matchSuffix(f.allowed, name)
+}
+
+// matchSuffix reports whether the fully qualified name, or any of its parent
+// domains, is in the set, with one lookup per label.
+func matchSuffix(set map[string]struct{}, name string) bool {
+	if len(set) == 0 {
+		return false
+	}
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := set[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDomainList parses a blocklist in any of the formats supported by
+// Filter.LoadBlocklist, returning its blocked and allowed domains.
+func parseDomainList(r io.Reader) (blocked, allowed []string, err error) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '!' || line[0] == '[' || isCosmeticRule(line) {
+			continue
+		}
+
+		line = trimComment(line)
+
+		switch {
+		case strings.HasPrefix(line, "@@||"):
+			if name, ok := parseAdblockRule(line[4:]); ok {
+				allowed = append(allowed, name)
+			}
+		case strings.HasPrefix(line, "||"):
+			if name, ok := parseAdblockRule(line[2:]); ok {
+				blocked = append(blocked, name)
+			}
+		default:
+			fields := strings.Fields(line)
+
+			switch {
+			case len(fields) == 1:
+				if name, ok := parseDomain(fields[0]); ok {
+					blocked = append(blocked, name)
+				}
+			case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+				for _, field := range fields[1:] {
+					if name, ok := parseDomain(field); ok && !hostsLocalNames[name] {
+						blocked = append(blocked, name)
+					}
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("doh: failed to read domain list: %w", err)
+	}
+
+	return blocked, allowed, nil
+}
+
+// adblockCosmeticSeparators separate the domains of adblock-style cosmetic
+// rules, such as "example.com##.banner", from their element selectors.
+var adblockCosmeticSeparators = []string{"##", "#@#", "#?#", "#@?#", "#$#", "#@$#"}
+
+// isCosmeticRule reports whether the line is an adblock-style cosmetic rule,
+// which hides elements of pages instead of blocking domains.
+func isCosmeticRule(line string) bool {
+	for _, sep := range adblockCosmeticSeparators {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimComment removes the "#" comment at the start of the line, or following
+// whitespace, from the line.
+func trimComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// parseAdblockRule parses the domain of an adblock-style rule, following its
+// "||" prefix. Only rules matching whole domains are supported, such as
+// "example.com^", optionally with "$" options, which are ignored.
+func parseAdblockRule(rule string) (string, bool) {
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		rule = rule[:i]
+	}
+
+	name, ok := strings.CutSuffix(rule, "^")
+	if !ok {
+		name, ok = strings.CutSuffix(rule, "^|")
+	}
+	if !ok {
+		return "", false
+	}
+
+	return parseDomain(name)
+}
+
+// parseDomain returns the canonical form of the given domain name, if it is
+// a valid, non-root domain name.
+func parseDomain(s string) (string, bool) {
+	if strings.ContainsAny(s, "*/:") {
+		return "", false
+	}
+
+	if _, ok := dns.IsDomainName(s); !ok || s == "." {
+		return "", false
+	}
+
+	return dns.CanonicalName(s), true
+}
+
+// FilterOptions configures a [FilterHandler].
+type FilterOptions struct {
+	// Filter determines which queries are blocked.
+	Filter *Filter
+
+	// Mode determines how blocked queries are answered. By default, they
+	// are answered with NXDOMAIN.
+	Mode BlockMode
+
+	// TTL is the TTL, in seconds, of the records in responses to blocked
+	// queries, including the SOA record of negative responses, which
+	// determines how long they are cached. If zero, DefaultBlockTTL is used.
+	TTL uint32
+}
+
+// FilterHandler returns a DoH handler that answers queries for blocked
+// domains itself, according to the configured block mode, and passes all
+// other queries to the next handler. Responses to blocked queries include
+// an [RFC 8914] "Blocked" Extended DNS Error, if the query supports EDNS(0).
+//
+// [RFC 8914]: https://datatracker.ietf.org/doc/html/rfc8914
+func FilterHandler(next Handler, opts FilterOptions) Handler {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultBlockTTL
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		if opts.Filter == nil || len(req.Question) != 1 || !opts.Filter.Blocked(req.Question[0].Name) {
+			return next(w, r, req)
+		}
+
+		return blockedResponse(req, opts.Mode, opts.TTL), nil
+	}
+}
+
+// blockedResponse returns the response to a blocked query, according to the
+// given block mode.
+func blockedResponse(req *dns.Msg, mode BlockMode, ttl uint32) *dns.Msg {
+	switch mode {
+	case BlockRefused:
+		return newErrorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeBlocked, "")
+	case BlockNullIP:
+		resp := newErrorResponse(req, dns.RcodeSuccess, dns.ExtendedErrorCodeBlocked, "")
+
+		q := req.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+
+		switch q.Qtype {
+		case dns.TypeA:
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		default:
+			resp.Ns = []dns.RR{blockedSOA(q.Name, ttl)}
+		}
+
+		return resp
+	default:
+		resp := newErrorResponse(req, dns.RcodeNameError, dns.ExtendedErrorCodeBlocked, "")
+		resp.Ns = []dns.RR{blockedSOA(req.Question[0].Name, ttl)}
+
+		return resp
+	}
+}
+
+// blockedSOA returns the synthetic SOA record of negative responses to
+// blocked queries, whose TTL and minimum determine how long they may be
+// cached, as described in [RFC 2308 section 5].
+//
+// [RFC 2308 section 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func blockedSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "blocked.invalid.",
+		Mbox:    "hostmaster.blocked.invalid.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
@@ -0,0 +1,266 @@
+package doh_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestFilter(t *testing.T) {
+	list := `
+# hosts file
+0.0.0.0 0.0.0.0
+127.0.0.1 localhost
+0.0.0.0 hosts.example tracker.hosts.example # inline comment
+0.0.0.0 tab.hosts.example	# tab comment
+:: ipv6.example
+
+! adblock list
+[Adblock Plus 2.0]
+||adblock.example^
+||options.example^$third-party
+||path.example/ads
+@@||good.adblock.example^
+
+# plain list
+Plain.Example
+*.wildcard.example
+`
+
+	filter := doh.NewFilter()
+
+	if err := filter.LoadBlocklist(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filter.LoadAllowlist(strings.NewReader("allowed.plain.example\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "hosts.example.", want: true},
+		{name: "tracker.hosts.example.", want: true},
+		{name: "tab.hosts.example.", want: true},
+		{name: "ipv6.example.", want: true},
+		{name: "adblock.example.", want: true},
+		{name: "ads.adblock.example.", want: true},
+		{name: "options.example.", want: true},
+		{name: "plain.example.", want: true},
+		{name: "sub.PLAIN.example.", want: true},
+		{name: "good.adblock.example.", want: false},
+		{name: "sub.good.adblock.example.", want: false},
+		{name: "allowed.plain.example.", want: false},
+		{name: "path.example.", want: false},
+		{name: "wildcard.example.", want: false},
+		{name: "localhost.", want: false},
+		{name: "example.", want: false},
+		{name: "notplain.example.", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := filter.Blocked(test.name); got != test.want {
+				t.Errorf("got blocked %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilter_Adblock(t *testing.T) {
+	// An excerpt of an EasyList-style adblock list, mixing network rules
+	// with cosmetic rules that hide page elements and must be ignored.
+	list := `[Adblock Plus 2.0]
+! Version: 202410170000
+! Title: EasyList
+! Expires: 4 days (update frequency)
+! Homepage: https://easylist.to/
+||ads.example.net^
+||doubleclick.example^$third-party
+||tracker.example.org^$script,image
+@@||cdn.ads.example.net^$script
+example.com##.banner
+www.example.com###ad-container
+site.com#@#.ad
+news.example#?#div:-abp-has(> .sponsored)
+shop.example#$#abort-on-property-read adsbygoogle
+##.sponsored-link
+`
+
+	filter := doh.NewFilter()
+
+	if err := filter.LoadBlocklist(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ads.example.net.", want: true},
+		{name: "doubleclick.example.", want: true},
+		{name: "tracker.example.org.", want: true},
+		{name: "cdn.ads.example.net.", want: false},
+		{name: "example.com.", want: false},
+		{name: "www.example.com.", want: false},
+		{name: "site.com.", want: false},
+		{name: "news.example.", want: false},
+		{name: "shop.example.", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := filter.Blocked(test.name); got != test.want {
+				t.Errorf("got blocked %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseBlockMode(t *testing.T) {
+	for _, mode := range []doh.BlockMode{doh.BlockNXDomain, doh.BlockNullIP, doh.BlockRefused} {
+		got, ok := doh.ParseBlockMode(mode.String())
+		if !ok || got != mode {
+			t.Errorf("got %s, %v, want %s, true", got, ok, mode)
+		}
+	}
+
+	if _, ok := doh.ParseBlockMode("bogus"); ok {
+		t.Error("got valid block mode for unknown name")
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	filter := doh.NewFilter()
+	filter.Block("blocked.example")
+
+	tests := []struct {
+		name       string
+		mode       doh.BlockMode
+		qname      string
+		qtype      uint16
+		wantRcode  int
+		wantAnswer net.IP
+		wantEDE    bool
+		wantTTL    time.Duration
+	}{
+		{
+			name:      "not blocked",
+			qname:     "example.com.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "nxdomain",
+			mode:      doh.BlockNXDomain,
+			qname:     "ads.blocked.example.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+			wantEDE:   true,
+			wantTTL:   doh.DefaultBlockTTL * time.Second,
+		},
+		{
+			name:      "refused",
+			mode:      doh.BlockRefused,
+			qname:     "blocked.example.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeRefused,
+			wantEDE:   true,
+		},
+		{
+			name:       "null a",
+			mode:       doh.BlockNullIP,
+			qname:      "blocked.example.",
+			qtype:      dns.TypeA,
+			wantRcode:  dns.RcodeSuccess,
+			wantAnswer: net.IPv4zero,
+			wantEDE:    true,
+			wantTTL:    doh.DefaultBlockTTL * time.Second,
+		},
+		{
+			name:       "null aaaa",
+			mode:       doh.BlockNullIP,
+			qname:      "blocked.example.",
+			qtype:      dns.TypeAAAA,
+			wantRcode:  dns.RcodeSuccess,
+			wantAnswer: net.IPv6zero,
+			wantEDE:    true,
+		},
+		{
+			name:      "null txt",
+			mode:      doh.BlockNullIP,
+			qname:     "blocked.example.",
+			qtype:     dns.TypeTXT,
+			wantRcode: dns.RcodeSuccess,
+			wantEDE:   true,
+			wantTTL:   doh.DefaultBlockTTL * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := doh.FilterHandler(testAnswerHandler, doh.FilterOptions{
+				Filter: filter,
+				Mode:   test.mode,
+			})
+
+			req := new(dns.Msg).SetQuestion(test.qname, test.qtype)
+			req.SetEdns0(1232, false)
+
+			resp := testCacheHandlerCall(t, handler, req)
+			if resp.Rcode != test.wantRcode {
+				t.Fatalf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+
+			if test.wantAnswer != nil {
+				if len(resp.Answer) != 1 {
+					t.Fatalf("got %d answers, want 1", len(resp.Answer))
+				}
+
+				var ip net.IP
+				switch rr := resp.Answer[0].(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				}
+
+				if !ip.Equal(test.wantAnswer) {
+					t.Errorf("got answer %s, want %s", ip, test.wantAnswer)
+				}
+
+				if ttl := resp.Answer[0].Header().Ttl; ttl != doh.DefaultBlockTTL {
+					t.Errorf("got ttl %d, want %d", ttl, doh.DefaultBlockTTL)
+				}
+			}
+
+			var ede *dns.EDNS0_EDE
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, option := range opt.Option {
+					if e, ok := option.(*dns.EDNS0_EDE); ok {
+						ede = e
+					}
+				}
+			}
+
+			if got := ede != nil && ede.InfoCode == dns.ExtendedErrorCodeBlocked; got != test.wantEDE {
+				t.Errorf("got blocked extended error %v, want %v", got, test.wantEDE)
+			}
+
+			// Blocked responses are cacheable for the block TTL, including
+			// negative ones, through their SOA record.
+			if test.wantTTL != 0 {
+				ttl, ok := doh.ResponseTTL(resp)
+				if !ok || ttl != test.wantTTL {
+					t.Errorf("got response ttl %v, %v, want %v", ttl, ok, test.wantTTL)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package doh
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive failed
+	// attempts after which a [Proxy] upstream is considered unhealthy.
+	DefaultFailureThreshold = 5
+
+	// DefaultCooldown is the default duration an unhealthy [Proxy] upstream
+	// is skipped before it is probed again.
+	DefaultCooldown = 30 * time.Second
+
+	// ewmaWeight is the weight of the latest sample in an upstream's latency
+	// moving average.
+	ewmaWeight = 0.3
+
+	// errorRateWeight is the weight of the latest attempt in an upstream's
+	// error rate moving average.
+	errorRateWeight = 0.1
+
+	// errorRateMinAttempts is the minimum number of attempts before an
+	// upstream's error rate is used to consider it unhealthy.
+	errorRateMinAttempts = 10
+
+	// failureLatency is the minimum latency recorded for a failed attempt
+	// when no attempt timeout is configured.
+	failureLatency = time.Second
+)
+
+// CircuitState is the health state of a [Proxy] upstream, following the
+// circuit breaker pattern.
+type CircuitState int
+
+const (
+	// CircuitClosed means the upstream is healthy, and is used normally.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means the upstream is unhealthy, and is skipped until
+	// its cooldown has passed.
+	CircuitOpen
+
+	// CircuitHalfOpen means the upstream's cooldown has passed, and a probe
+	// query is allowed to check whether it has recovered.
+	CircuitHalfOpen
+)
+
+// String returns the name of the circuit state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements the [encoding.TextMarshaler] interface.
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UpstreamStatus is a snapshot of the health of a [Proxy] upstream, which
+// can be used for metrics or status endpoints.
+type UpstreamStatus struct {
+	URL                 string        `json:"url"`
+	State               CircuitState  `json:"state"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	ErrorRate           float64       `json:"error_rate"`
+	Latency             time.Duration `json:"latency"`
+	Successes           uint64        `json:"successes"`
+	Failures            uint64        `json:"failures"`
+	LastError           string        `json:"last_error,omitempty"`
+	RetryAt             time.Time     `json:"retry_at,omitzero"`
+}
+
+// upstreamHealth is the health state of a proxyUpstream, guarded by the
+// upstream's mutex.
+type upstreamHealth struct {
+	state               CircuitState
+	consecutiveFailures int
+	errorRate           float64
+	latency             time.Duration
+	successes           uint64
+	failures            uint64
+	lastError           error
+	retryAt             time.Time
+}
+
+// allow reports whether the upstream may be tried at the given time, which
+// is when its circuit is closed, or its cooldown has passed. It doesn't
+// change the upstream's state, see [proxyUpstream.claim].
+func (u *proxyUpstream) allow(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.health.state == CircuitClosed || !now.Before(u.health.retryAt)
+}
+
+// claim reports whether an attempt may be sent to the upstream at the given
+// time, and is called right before sending it. Once an open circuit's
+// cooldown has passed, a single probe is allowed per cooldown period until
+// the upstream recovers, which is claimed by the first attempt, so that
+// upstreams that are never tried don't use up their probe.
+func (u *proxyUpstream) claim(opts *ProxyOptions, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h := &u.health
+
+	if h.state == CircuitClosed {
+		return true
+	}
+
+	if now.Before(h.retryAt) {
+		return false
+	}
+
+	h.state = CircuitHalfOpen
+	h.retryAt = now.Add(cooldown(opts.Cooldown))
+
+	return true
+}
+
+// cooldown returns the given cooldown, or DefaultCooldown if unset.
+func cooldown(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return DefaultCooldown
+}
+
+// record records the outcome of an attempt against the upstream, updating
+// its latency and health. Canceled attempts are not recorded.
+func (u *proxyUpstream) record(opts *ProxyOptions, now time.Time, latency time.Duration, err error, canceled bool) {
+	if canceled {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h := &u.health
+
+	if h.successes+h.failures == 0 {
+		h.latency = latency
+	} else {
+		h.latency = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(h.latency))
+	}
+
+	if err == nil {
+		h.successes++
+		h.consecutiveFailures = 0
+		h.errorRate = (1 - errorRateWeight) * h.errorRate
+		h.state = CircuitClosed
+		h.retryAt = time.Time{}
+		return
+	}
+
+	h.failures++
+	h.consecutiveFailures++
+	h.errorRate = errorRateWeight + (1-errorRateWeight)*h.errorRate
+	h.lastError = err
+
+	if h.state == CircuitHalfOpen || u.unhealthy(opts) {
+		h.state = CircuitOpen
+		h.retryAt = now.Add(cooldown(opts.Cooldown))
+	}
+}
+
+// unhealthy reports whether the upstream's failures exceed the configured
+// thresholds. The upstream's mutex must be held.
+func (u *proxyUpstream) unhealthy(opts *ProxyOptions) bool {
+	h := &u.health
+
+	threshold := opts.FailureThreshold
+	if threshold == 0 {
+		threshold = DefaultFailureThreshold
+	}
+
+	if threshold > 0 && h.consecutiveFailures >= threshold {
+		return true
+	}
+
+	attempts := h.successes + h.failures
+
+	return opts.ErrorRateThreshold > 0 && attempts >= errorRateMinAttempts && h.errorRate >= opts.ErrorRateThreshold
+}
+
+// averageLatency returns the upstream's moving average latency, which is
+// zero until the first attempt.
+func (u *proxyUpstream) averageLatency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.health.latency
+}
+
+// status returns a snapshot of the upstream's health.
+func (u *proxyUpstream) status() UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h := &u.health
+
+	status := UpstreamStatus{
+		URL:                 u.url,
+		State:               h.state,
+		ConsecutiveFailures: h.consecutiveFailures,
+		ErrorRate:           h.errorRate,
+		Latency:             h.latency,
+		Successes:           h.successes,
+		Failures:            h.failures,
+		RetryAt:             h.retryAt,
+	}
+
+	if h.lastError != nil {
+		status.LastError = h.lastError.Error()
+	}
+
+	return status
+}
+
+// Status returns a snapshot of the health of each of the proxy's upstreams,
+// in the configured order.
+func (p *Proxy) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.upstreams))
+
+	for _, upstream := range p.upstreams {
+		statuses = append(statuses, upstream.status())
+	}
+
+	return statuses
+}
+
+// StatusHandler returns an HTTP handler that responds with the proxy's
+// upstream health as JSON, which can be used as a status endpoint.
+func (p *Proxy) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		json.NewEncoder(w).Encode(p.Status())
+	})
+}
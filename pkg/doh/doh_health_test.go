@@ -0,0 +1,192 @@
+package doh_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestProxy_Health(t *testing.T) {
+	ctx := testContext(t)
+
+	query := func(t *testing.T, proxy *doh.Proxy) {
+		t.Helper()
+
+		_, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("unhealthy upstream skipped", func(t *testing.T) {
+		failing := newTestUpstream(t, 0, true)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			FailureThreshold: 2,
+			Cooldown:         time.Hour,
+		}, failing.url, good.url)
+
+		for range 5 {
+			query(t, proxy)
+		}
+
+		if got := failing.queries.Load(); got != 2 {
+			t.Errorf("got %d queries for failing upstream, want 2", got)
+		}
+
+		status := proxy.Status()
+
+		if status[0].State != doh.CircuitOpen {
+			t.Errorf("got state %s for failing upstream, want %s", status[0].State, doh.CircuitOpen)
+		}
+
+		if status[0].LastError == "" {
+			t.Error("got no last error for failing upstream")
+		}
+
+		if status[1].State != doh.CircuitClosed || status[1].Successes != 5 {
+			t.Errorf("got state %s with %d successes for good upstream, want %s with 5", status[1].State, status[1].Successes, doh.CircuitClosed)
+		}
+	})
+
+	t.Run("error rate", func(t *testing.T) {
+		flaky := newTestUpstream(t, 0, false)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			FailureThreshold:   -1,
+			ErrorRateThreshold: 0.3,
+			Cooldown:           time.Hour,
+		}, flaky.url, good.url)
+
+		// Alternate failures and successes, so there are never many
+		// consecutive failures, but the error rate climbs.
+		for i := range 20 {
+			flaky.fail.Store(i%2 == 0)
+			query(t, proxy)
+		}
+
+		if state := proxy.Status()[0].State; state != doh.CircuitOpen {
+			t.Errorf("got state %s for flaky upstream, want %s", state, doh.CircuitOpen)
+		}
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		recovering := newTestUpstream(t, 0, true)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			FailureThreshold: 1,
+			Cooldown:         50 * time.Millisecond,
+		}, recovering.url, good.url)
+
+		query(t, proxy)
+
+		if state := proxy.Status()[0].State; state != doh.CircuitOpen {
+			t.Fatalf("got state %s, want %s", state, doh.CircuitOpen)
+		}
+
+		recovering.fail.Store(false)
+
+		time.Sleep(100 * time.Millisecond)
+
+		query(t, proxy)
+
+		if state := proxy.Status()[0].State; state != doh.CircuitClosed {
+			t.Fatalf("got state %s, want %s", state, doh.CircuitClosed)
+		}
+
+		if got := recovering.queries.Load(); got != 2 {
+			t.Errorf("got %d queries for recovering upstream, want 2", got)
+		}
+	})
+
+	t.Run("recovery behind healthy upstream", func(t *testing.T) {
+		first := newTestUpstream(t, 0, true)
+		recovering := newTestUpstream(t, 0, true)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			FailureThreshold: 1,
+			Cooldown:         50 * time.Millisecond,
+		}, first.url, recovering.url)
+
+		if _, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA)); err == nil {
+			t.Fatal("got no error")
+		}
+
+		first.fail.Store(false)
+		recovering.fail.Store(false)
+
+		time.Sleep(100 * time.Millisecond)
+
+		// Queries answered by the first upstream don't use up the probe of
+		// the recovering upstream, which is never tried.
+		for range 3 {
+			query(t, proxy)
+		}
+
+		if state := proxy.Status()[1].State; state != doh.CircuitOpen {
+			t.Errorf("got state %s for untried upstream, want %s", state, doh.CircuitOpen)
+		}
+
+		// So it is probed as soon as the first upstream fails.
+		first.fail.Store(true)
+		query(t, proxy)
+
+		if state := proxy.Status()[1].State; state != doh.CircuitClosed {
+			t.Errorf("got state %s for recovering upstream, want %s", state, doh.CircuitClosed)
+		}
+	})
+
+	t.Run("all unhealthy", func(t *testing.T) {
+		recovering := newTestUpstream(t, 0, true)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			FailureThreshold: 1,
+			Cooldown:         time.Hour,
+		}, recovering.url)
+
+		_, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err == nil {
+			t.Fatal("got no error")
+		}
+
+		recovering.fail.Store(false)
+
+		query(t, proxy)
+	})
+}
+
+func TestProxy_StatusHandler(t *testing.T) {
+	good := newTestUpstream(t, 0, false)
+
+	proxy := doh.NewProxy(doh.ProxyOptions{}, good.url)
+
+	_, err := proxy.Exchange(testContext(t), new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+
+	proxy.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	var statuses []map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(statuses))
+	}
+
+	if statuses[0]["url"] != good.url || statuses[0]["state"] != "closed" {
+		t.Errorf("got status %v, want closed %s", statuses[0], good.url)
+	}
+}
@@ -0,0 +1,394 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// defaultAltSvcMaxAge is how long an Alt-Svc alternative is used when
+	// the header has no "ma" parameter, as defined in RFC 7838 section 3.1.
+	defaultAltSvcMaxAge = 24 * time.Hour
+
+	// http3BrokenDuration is how long HTTP/3 is not tried again for a server
+	// after it failed, before falling back to HTTP/1.1 or HTTP/2.
+	http3BrokenDuration = 5 * time.Minute
+)
+
+// HTTP3Transport is an [http.RoundTripper] sending DoH requests over HTTP/3
+// to servers that advertise support for it with an [RFC 7838] Alt-Svc
+// header, and over HTTP/1.1 or HTTP/2 to all other servers, or when HTTP/3
+// fails, such as when UDP is blocked.
+//
+// The first request to a server always uses the fallback transport, since
+// HTTP/3 support is only discovered from its response, unless AssumeHTTP3
+// is set. Because each DNS query is sent on its own QUIC stream, a lost
+// packet only delays its own query, and resumed connections can send GET
+// queries in 0-RTT.
+//
+// [RFC 7838]: https://datatracker.ietf.org/doc/html/rfc7838
+type HTTP3Transport struct {
+	// Fallback is used for servers that don't support HTTP/3, and when
+	// HTTP/3 fails. If nil, a pooled cleanhttp transport is used.
+	Fallback http.RoundTripper
+
+	// TLSClientConfig is used for HTTP/3 connections. If nil, the TLS
+	// configuration of the fallback transport is used, if it is an
+	// [http.Transport], otherwise the default configuration.
+	TLSClientConfig *tls.Config
+
+	// AssumeHTTP3 tries HTTP/3 on the same port first for servers that
+	// haven't advertised it, which is useful for short-lived clients that
+	// wouldn't make a second request.
+	AssumeHTTP3 bool
+
+	once sync.Once
+	h3   *http3.Transport
+
+	mu     sync.Mutex
+	altSvc map[string]*altService
+}
+
+// altService is the HTTP/3 alternative service of an origin server.
+type altService struct {
+	// authority is the host and port of the alternative service.
+	authority string
+
+	// expires is when the alternative service must no longer be used.
+	expires time.Time
+
+	// brokenUntil is when HTTP/3 can be tried again after it failed.
+	brokenUntil time.Time
+}
+
+// WithHTTP3 enables HTTP/3 for servers that advertise it, by wrapping the
+// transport of the client's HTTP client in an [HTTP3Transport], falling
+// back to it for all other servers.
+func WithHTTP3() ClientOption {
+	return func(c *Client) {
+		c.http3 = true
+	}
+}
+
+// RoundTrip implements the [http.RoundTripper] interface, sending the
+// request over HTTP/3 if the server supports it.
+func (t *HTTP3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(t.init)
+
+	if req.URL.Scheme != "https" {
+		return t.Fallback.RoundTrip(req)
+	}
+
+	origin := originAuthority(req)
+
+	if alt, ok := t.alternative(origin); ok {
+		resp, err := t.roundTripHTTP3(req, alt)
+		if err == nil {
+			return resp, nil
+		}
+
+		// Canceled requests, such as those losing a race, or timing out,
+		// say nothing about the server's HTTP/3 support.
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+
+		t.markBroken(origin)
+
+		// The request can only be retried if its body can be read again.
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+
+	resp, err := t.Fallback.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.discover(origin, resp.Header.Values("Alt-Svc"))
+
+	return resp, nil
+}
+
+// Close closes the transport's HTTP/3 connections, and the idle connections
+// of the fallback transport.
+func (t *HTTP3Transport) Close() error {
+	t.once.Do(t.init)
+
+	if closer, ok := t.Fallback.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+
+	return t.h3.Close()
+}
+
+// init sets up the fallback and HTTP/3 transports.
+func (t *HTTP3Transport) init() {
+	if t.Fallback == nil {
+		t.Fallback = cleanhttp.DefaultPooledTransport()
+	}
+
+	tlsConfig := t.TLSClientConfig
+	if tlsConfig == nil {
+		if fallback, ok := t.Fallback.(*http.Transport); ok && fallback.TLSClientConfig != nil {
+			tlsConfig = fallback.TLSClientConfig.Clone()
+		}
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	// Keep session tickets, so that resumed connections can use 0-RTT.
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	t.h3 = &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout: quicIdleTimeout,
+		},
+		Dial: t.dial,
+	}
+}
+
+// roundTripHTTP3 sends the request over HTTP/3 to the given alternative
+// service of its origin server.
+func (t *HTTP3Transport) roundTripHTTP3(req *http.Request, alt string) (*http.Response, error) {
+	// The HTTP/3 transport dials the origin of the request URL, which is
+	// redirected to the alternative service by t.dial.
+	ctx := context.WithValue(req.Context(), altAuthorityKey{}, alt)
+
+	h3Req := req.Clone(ctx)
+
+	// GET requests are safe to replay, so they can be sent in 0-RTT.
+	if h3Req.Method == http.MethodGet {
+		h3Req.Method = http3.MethodGet0RTT
+	}
+
+	return t.h3.RoundTripOpt(h3Req, http3.RoundTripOpt{})
+}
+
+// altAuthorityKey is the context key of the alternative service authority
+// that HTTP/3 connections are dialed to.
+type altAuthorityKey struct{}
+
+// dial dials a QUIC connection to the alternative service of the request,
+// verifying the TLS certificate of the origin server.
+func (t *HTTP3Transport) dial(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	if alt, ok := ctx.Value(altAuthorityKey{}).(string); ok {
+		addr = alt
+	}
+
+	// The connection is shared by all requests to the origin, so its dial
+	// isn't canceled with the request that started it, which would fail the
+	// requests waiting for it too. It is still limited by the handshake
+	// timeout.
+	return quic.DialAddrEarly(context.WithoutCancel(ctx), addr, tlsConfig, config)
+}
+
+// alternative returns the authority of the HTTP/3 alternative service of
+// the given origin, if it has one that is usable.
+func (t *HTTP3Transport) alternative(origin string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	alt, ok := t.altSvc[origin]
+	if ok && now.After(alt.expires) && now.After(alt.brokenUntil) {
+		delete(t.altSvc, origin)
+		ok = false
+	}
+
+	switch {
+	case ok && now.Before(alt.brokenUntil):
+		return "", false
+	case ok && now.Before(alt.expires):
+		return alt.authority, true
+	case t.AssumeHTTP3:
+		return origin, true
+	default:
+		return "", false
+	}
+}
+
+// markBroken stops HTTP/3 from being used for the given origin for a while,
+// after it failed.
+func (t *HTTP3Transport) markBroken(origin string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	alt, ok := t.altSvc[origin]
+	if !ok {
+		alt = &altService{authority: origin}
+		t.setAltSvc(origin, alt)
+	}
+
+	alt.brokenUntil = time.Now().Add(http3BrokenDuration)
+}
+
+// discover records the HTTP/3 alternative service advertised in the given
+// Alt-Svc header values of a response from the origin.
+func (t *HTTP3Transport) discover(origin string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+
+	authority, maxAge, ok := parseAltSvc(values)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	alt, known := t.altSvc[origin]
+
+	if !ok {
+		// "clear" invalidates all alternatives of the origin, as described
+		// in RFC 7838 section 3.
+		if authority == "clear" {
+			delete(t.altSvc, origin)
+		}
+		return
+	}
+
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return
+	}
+
+	// An empty host means the alternative is on the same host.
+	if host == "" {
+		host, _, _ = net.SplitHostPort(origin)
+	}
+
+	authority = net.JoinHostPort(host, port)
+
+	if !known {
+		alt = &altService{}
+		t.setAltSvc(origin, alt)
+	}
+
+	if alt.authority != authority {
+		alt.brokenUntil = time.Time{}
+	}
+
+	alt.authority = authority
+	alt.expires = time.Now().Add(maxAge)
+}
+
+// setAltSvc stores the alternative service of the origin, which must be
+// called with the mutex held.
+func (t *HTTP3Transport) setAltSvc(origin string, alt *altService) {
+	if t.altSvc == nil {
+		t.altSvc = make(map[string]*altService)
+	}
+
+	t.altSvc[origin] = alt
+}
+
+// originAuthority returns the host and port of the request's origin server.
+func originAuthority(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// parseAltSvc returns the authority and max age of the first HTTP/3
+// alternative in the given Alt-Svc header values, as defined in [RFC 7838
+// section 3], or "clear" and false if all alternatives are cleared.
+//
+// [RFC 7838 section 3]: https://datatracker.ietf.org/doc/html/rfc7838#section-3
+func parseAltSvc(values []string) (authority string, maxAge time.Duration, ok bool) {
+	for _, value := range values {
+		for alternative := range strings.SplitSeq(value, ",") {
+			alternative = strings.TrimSpace(alternative)
+
+			if alternative == "clear" {
+				return "clear", 0, false
+			}
+
+			params := strings.Split(alternative, ";")
+
+			protocol, rawAuthority, found := strings.Cut(params[0], "=")
+			if !found || strings.TrimSpace(protocol) != http3.NextProtoH3 {
+				continue
+			}
+
+			authority, err := strconv.Unquote(strings.TrimSpace(rawAuthority))
+			if err != nil {
+				continue
+			}
+
+			maxAge := defaultAltSvcMaxAge
+
+			for _, param := range params[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if key != "ma" {
+					continue
+				}
+
+				seconds, err := strconv.ParseUint(strings.Trim(value, `"`), 10, 32)
+				if err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+
+			return authority, maxAge, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// NewHTTP3Server returns an HTTP/3 server for the given handler, such as
+// one returned by [NewServerMux], accepting 0-RTT requests from resumed
+// connections. The server is started with its Serve method, using a UDP
+// connection, usually on the same port as the HTTPS server.
+func NewHTTP3Server(handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		QUICConfig: &quic.Config{
+			Allow0RTT:      true,
+			MaxIdleTimeout: quicIdleTimeout,
+		},
+	}
+}
+
+// AltSvcHandler returns an HTTP handler that advertises the given HTTP/3
+// server with an Alt-Svc header on each response, so that clients such as
+// an [HTTP3Transport] can discover it, before calling the next handler.
+func AltSvcHandler(next http.Handler, server *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No header is set until the server is listening.
+		server.SetQUICHeaders(w.Header())
+
+		next.ServeHTTP(w, r)
+	})
+}
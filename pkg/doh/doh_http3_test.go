@@ -0,0 +1,233 @@
+package doh_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testHTTP3Server starts a DoH server over HTTPS, advertising an HTTP/3
+// server on another port if h3 is true, returning its URL, a pool trusting
+// its certificate, and the HTTP major version of the last request.
+func testHTTP3Server(t *testing.T, h3 bool) (string, *x509.CertPool, *atomic.Int64) {
+	t.Helper()
+
+	cert, pool := testCertificate(t)
+
+	var proto atomic.Int64
+
+	mux := doh.NewServerMux(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		proto.Store(int64(r.ProtoMajor))
+		return testAnswerHandler(w, r, req)
+	})
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	var handler http.Handler = mux
+
+	if h3 {
+		h3Server := doh.NewHTTP3Server(mux, tlsConfig)
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go h3Server.Serve(pc)
+
+		t.Cleanup(func() {
+			h3Server.Close()
+			pc.Close()
+		})
+
+		// Wait for the server to listen, so that it is advertised.
+		for h3Server.SetQUICHeaders(http.Header{}) != nil {
+			time.Sleep(time.Millisecond)
+		}
+
+		handler = doh.AltSvcHandler(mux, h3Server)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = tlsConfig
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server.URL + "/dns-query", pool, &proto
+}
+
+func TestHTTP3Transport_AltSvc(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL, pool, proto := testHTTP3Server(t, true)
+
+	transport := &doh.HTTP3Transport{
+		Fallback: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	t.Cleanup(func() { transport.Close() })
+
+	client := doh.NewClient(
+		doh.WithHTTPClient(&http.Client{Transport: transport}),
+		doh.WithServers(serverURL),
+	)
+
+	// The first query discovers HTTP/3 support from the Alt-Svc header,
+	// which is used for the following queries.
+	for i, want := range []int64{2, 3, 3} {
+		resp, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Errorf("query %d: got %d answers, want 1", i, len(resp.Answer))
+		}
+
+		if got := proto.Load(); got != want {
+			t.Errorf("query %d: got HTTP/%d, want HTTP/%d", i, got, want)
+		}
+	}
+}
+
+func TestHTTP3Transport_Canceled(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL, pool, proto := testHTTP3Server(t, true)
+
+	transport := &doh.HTTP3Transport{
+		Fallback: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	t.Cleanup(func() { transport.Close() })
+
+	client := doh.NewClient(
+		doh.WithHTTPClient(&http.Client{Transport: transport}),
+		doh.WithServers(serverURL),
+	)
+
+	query := func(want int64) {
+		t.Helper()
+
+		if _, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := proto.Load(); got != want {
+			t.Errorf("got HTTP/%d, want HTTP/%d", got, want)
+		}
+	}
+
+	// Discover HTTP/3 support from the Alt-Svc header.
+	query(2)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	req, err := http.NewRequestWithContext(canceledCtx, http.MethodGet, serverURL+"?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("got no error for canceled request")
+	}
+
+	// The canceled request doesn't stop HTTP/3 from being used.
+	query(3)
+}
+
+func TestHTTP3Transport_Fallback(t *testing.T) {
+	for _, method := range []doh.Method{doh.MethodGet, doh.MethodPost} {
+		t.Run(string(method), func(t *testing.T) {
+			ctx := testContext(t)
+
+			serverURL, pool, proto := testHTTP3Server(t, false)
+
+			// Listen on the server's port over QUIC without HTTP/3, so that
+			// the HTTP/3 handshake fails right away.
+			u, err := url.Parse(serverURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, _ := testCertificate(t)
+
+			ln, err := doh.ListenQUIC(u.Host, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if err != nil {
+				t.Skipf("can't listen on the server's port over udp: %v", err)
+			}
+			t.Cleanup(func() { ln.Close() })
+
+			transport := &doh.HTTP3Transport{
+				Fallback: &http.Transport{
+					TLSClientConfig:   &tls.Config{RootCAs: pool},
+					ForceAttemptHTTP2: true,
+				},
+				AssumeHTTP3: true,
+			}
+			t.Cleanup(func() { transport.Close() })
+
+			client := doh.NewClient(
+				doh.WithHTTPClient(&http.Client{Transport: transport}),
+				doh.WithServers(serverURL),
+				doh.WithMethod(method),
+			)
+
+			for i := range 2 {
+				resp, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+				if err != nil {
+					t.Fatalf("query %d: %v", i, err)
+				}
+
+				if len(resp.Answer) != 1 {
+					t.Errorf("query %d: got %d answers, want 1", i, len(resp.Answer))
+				}
+
+				if got := proto.Load(); got != 2 {
+					t.Errorf("query %d: got HTTP/%d, want HTTP/2", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithHTTP3(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL, pool, proto := testHTTP3Server(t, true)
+
+	client := doh.NewClient(
+		doh.WithHTTPClient(&http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}}),
+		doh.WithServers(serverURL),
+		doh.WithHTTP3(),
+	)
+
+	for range 2 {
+		if _, err := client.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := proto.Load(); got != 3 {
+		t.Errorf("got HTTP/%d, want HTTP/3", got)
+	}
+}
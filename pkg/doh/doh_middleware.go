@@ -0,0 +1,218 @@
+package doh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrHandlerPanic is returned by a handler wrapped with [Recover] when
+	// it panics.
+	ErrHandlerPanic = errors.New("doh: handler panicked")
+)
+
+// RequestIDHeader is the HTTP header used by [RequestID] to read and
+// return request IDs.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the maximum length of a request ID taken from the
+// RequestIDHeader of an HTTP request.
+const maxRequestIDLength = 64
+
+// Middleware wraps a DoH handler with additional behavior, such as logging
+// or filtering, returning a new handler.
+type Middleware func(Handler) Handler
+
+// Chain returns the handler wrapped with the given middlewares, where the
+// first middleware is the outermost, so it is the first to see requests and
+// the last to see responses.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for _, middleware := range slices.Backward(middlewares) {
+		handler = middleware(handler)
+	}
+
+	return handler
+}
+
+// Recover returns a middleware that recovers from panics in the next
+// handler, returning an error wrapping ErrHandlerPanic instead, so that the
+// client receives a DNS server failure rather than a dropped connection.
+// The panic's stack trace is logged at the error level, rather than added
+// to the error. If logger is nil, slog.Default is used.
+func Recover(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (resp *dns.Msg, err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					resp, err = nil, fmt.Errorf("%w: %v", ErrHandlerPanic, v)
+
+					logger.ErrorContext(r.Context(), "recovered handler panic", "error", err, "stack", string(debug.Stack()))
+				}
+			}()
+
+			return next(w, r, req)
+		}
+	}
+}
+
+// Logging returns a middleware that logs each DNS query handled by the next
+// handler, along with its response code and duration. Failed queries are
+// logged at the error level. If logger is nil, slog.Default is used.
+func Logging(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			start := time.Now()
+
+			resp, err := next(w, r, req)
+
+			attrs := []slog.Attr{
+				slog.String("remote_addr", r.RemoteAddr),
+			}
+
+			if len(req.Question) > 0 {
+				q := req.Question[0]
+				attrs = append(attrs,
+					slog.String("name", q.Name),
+					slog.String("type", dns.TypeToString[q.Qtype]),
+				)
+			}
+
+			if id, ok := RequestIDFromContext(r.Context()); ok {
+				attrs = append(attrs, slog.String("request_id", id))
+			}
+
+			attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+
+			level := slog.LevelInfo
+
+			switch {
+			case err != nil:
+				level = slog.LevelError
+				attrs = append(attrs, slog.String("error", err.Error()))
+			case resp != nil:
+				attrs = append(attrs, slog.String("rcode", dns.RcodeToString[resp.Rcode]))
+			}
+
+			logger.LogAttrs(r.Context(), level, "dns query", attrs...)
+
+			return resp, err
+		}
+	}
+}
+
+// Timing returns a middleware that reports how long the next handler took
+// to the client, using the HTTP Server-Timing header as a "dns" metric with
+// the duration in milliseconds.
+func Timing() Middleware {
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			start := time.Now()
+
+			resp, err := next(w, r, req)
+
+			ms := float64(time.Since(start)) / float64(time.Millisecond)
+			w.Header().Add("Server-Timing", "dns;dur="+strconv.FormatFloat(ms, 'f', 3, 64))
+
+			return resp, err
+		}
+	}
+}
+
+// requestIDKey is the context key of the request ID set by RequestID.
+type requestIDKey struct{}
+
+// RequestID returns a middleware that assigns an ID to each request, taken
+// from the RequestIDHeader of the HTTP request or randomly generated. The ID
+// is set on the same header of the HTTP response, and is available to the
+// next handlers with [RequestIDFromContext].
+//
+// IDs from the request are only used if they're at most 64 letters, digits,
+// dots, underscores or hyphens, since they end up in response headers and
+// logs; other IDs are replaced with a generated one.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+
+			w.Header().Set(RequestIDHeader, id)
+
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+			return next(w, r, req)
+		}
+	}
+}
+
+// RequestIDFromContext returns the request ID assigned by [RequestID], if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// validRequestID reports whether the request ID is a non-empty token of at
+// most maxRequestIDLength letters, digits, dots, underscores or hyphens.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// QueryTypeFilter returns a middleware that refuses queries for any of the
+// given types, such as ANY, without calling the next handler. Refused
+// queries are answered with REFUSED and, if the query supports EDNS(0), an
+// [RFC 8914] "Prohibited" Extended DNS Error.
+//
+// [RFC 8914]: https://datatracker.ietf.org/doc/html/rfc8914
+func QueryTypeFilter(qtypes ...uint16) Middleware {
+	return func(next Handler) Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			for _, q := range req.Question {
+				if slices.Contains(qtypes, q.Qtype) {
+					return newErrorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "query type "+dns.TypeToString[q.Qtype]+" is not allowed"), nil
+				}
+			}
+
+			return next(w, r, req)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package doh_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+
+	middleware := func(name string) doh.Middleware {
+		return func(next doh.Handler) doh.Handler {
+			return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				order = append(order, name+" before")
+				resp, err := next(w, r, req)
+				order = append(order, name+" after")
+				return resp, err
+			}
+		}
+	}
+
+	handler := doh.Chain(testAnswerHandler, middleware("a"), middleware("b"))
+
+	testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+	want := []string{"a before", "b before", "b after", "a after"}
+
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	panicking := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		panic("boom")
+	}
+
+	var buf bytes.Buffer
+
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	handler := doh.Chain(panicking, doh.Recover(logger))
+
+	_, err := handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dns-query", nil), new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if !errors.Is(err, doh.ErrHandlerPanic) {
+		t.Fatalf("got error %v, want %v", err, doh.ErrHandlerPanic)
+	}
+
+	if !strings.Contains(err.Error(), "boom") {
+		t.Errorf("got error %q, want panic value", err)
+	}
+
+	if strings.Contains(err.Error(), "\n") {
+		t.Errorf("got multi-line error %q, want stack trace logged separately", err)
+	}
+
+	if !strings.Contains(buf.String(), "stack=") || !strings.Contains(buf.String(), "TestRecover") {
+		t.Errorf("got log %q, want stack trace", buf.String())
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	handler := doh.Chain(testAnswerHandler, doh.RequestID(), doh.Logging(logger))
+
+	r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+	r.Header.Set(doh.RequestIDHeader, "abc123")
+
+	_, err := handler(httptest.NewRecorder(), r, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"name=example.com.", "type=A", "rcode=NOERROR", "request_id=abc123", "level=INFO"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got log %q, want %q", buf.String(), want)
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	handler := doh.Chain(testAnswerHandler, doh.Timing())
+
+	w := httptest.NewRecorder()
+
+	_, err := handler(w, httptest.NewRequest(http.MethodGet, "/dns-query", nil), new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := w.Header().Get("Server-Timing"); !strings.HasPrefix(got, "dns;dur=") {
+		t.Errorf("got Server-Timing %q, want dns metric", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+
+	handler := doh.Chain(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		got, _ = doh.RequestIDFromContext(r.Context())
+		return testAnswerHandler(w, r, req)
+	}, doh.RequestID())
+
+	t.Run("generated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+
+		testCacheHandlerCall(t, func(_ http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			return handler(w, r, req)
+		}, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+		if got == "" {
+			t.Fatal("got empty request id")
+		}
+
+		if header := w.Header().Get(doh.RequestIDHeader); header != got {
+			t.Errorf("got header %q, want %q", header, got)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "from header", header: "abc123", want: true},
+		{name: "token characters", header: "req-1.2_3", want: true},
+		{name: "max length", header: strings.Repeat("a", 64), want: true},
+		{name: "too long", header: strings.Repeat("a", 65)},
+		{name: "log injection", header: "abc\nlevel=ERROR msg=forged"},
+		{name: "spaces", header: "abc 123"},
+		{name: "non-ascii", header: "abc\u00e9"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			r.Header[doh.RequestIDHeader] = []string{test.header}
+
+			_, err := handler(w, r, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == test.header) != test.want {
+				t.Errorf("got request id %q for header %q, want it used %v", got, test.header, test.want)
+			}
+
+			if got == "" {
+				t.Error("got empty request id")
+			}
+
+			if header := w.Header().Get(doh.RequestIDHeader); header != got {
+				t.Errorf("got header %q, want %q", header, got)
+			}
+		})
+	}
+}
+
+func TestQueryTypeFilter(t *testing.T) {
+	handler := doh.Chain(testAnswerHandler, doh.QueryTypeFilter(dns.TypeANY))
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+	}{
+		{
+			name:      "allowed",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "refused",
+			qtype:     dns.TypeANY,
+			wantRcode: dns.RcodeRefused,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion("example.com.", test.qtype)
+			req.SetEdns0(1232, false)
+
+			resp := testCacheHandlerCall(t, handler, req)
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+
+			if test.wantRcode != dns.RcodeRefused {
+				return
+			}
+
+			ede, ok := resp.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+			if !ok || ede.InfoCode != dns.ExtendedErrorCodeProhibited {
+				t.Errorf("got option %v, want prohibited extended error", resp.IsEdns0().Option)
+			}
+		})
+	}
+}
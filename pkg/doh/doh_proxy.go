@@ -0,0 +1,556 @@
+package doh
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrServerFailure is the error of a [Proxy] upstream attempt answered with
+// a SERVFAIL response, such as by a chained DoH server whose own upstreams
+// failed, which is treated as a failure of the upstream.
+var ErrServerFailure = errors.New("doh: upstream server failure")
+
+// UpstreamError is an error from a single upstream of a [Proxy].
+type UpstreamError struct {
+	URL string
+	Err error
+}
+
+// Error implements the error interface.
+func (e *UpstreamError) Error() string {
+	return e.URL + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// ForwarderError is returned when a [Proxy] fails to get a response from
+// all of its upstreams, listing the error from each upstream tried.
+//
+// It matches [ErrForwarderFailed] with [errors.Is], and each upstream's
+// error can be found with [errors.Is] or [errors.As].
+type ForwarderError struct {
+	Errors []*UpstreamError
+}
+
+// Error implements the error interface.
+func (e *ForwarderError) Error() string {
+	if len(e.Errors) == 0 {
+		return ErrForwarderFailed.Error()
+	}
+
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+
+	return ErrForwarderFailed.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether the target is [ErrForwarderFailed].
+func (e *ForwarderError) Is(target error) bool {
+	return target == ErrForwarderFailed
+}
+
+// Unwrap returns the error from each upstream.
+func (e *ForwarderError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Strategy determines the order in which a [Proxy] tries its upstreams.
+type Strategy int
+
+const (
+	// StrategySequential tries each upstream in the configured order,
+	// failing over to the next one on error.
+	StrategySequential Strategy = iota
+
+	// StrategyRace sends each query to all upstreams at once, using the
+	// first successful response and canceling the rest.
+	StrategyRace
+
+	// StrategyRoundRobin starts each query at the next upstream in turn,
+	// failing over to the following ones on error.
+	StrategyRoundRobin
+
+	// StrategyRandom starts each query at a random upstream, chosen by the
+	// configured weights, failing over to the remaining ones on error.
+	StrategyRandom
+
+	// StrategyFastest tries upstreams in order of their exponentially
+	// weighted moving average (EWMA) latency, lowest first.
+	StrategyFastest
+)
+
+// String returns the name of the strategy.
+func (s Strategy) String() string {
+	switch s {
+	case StrategySequential:
+		return "sequential"
+	case StrategyRace:
+		return "race"
+	case StrategyRoundRobin:
+		return "round-robin"
+	case StrategyRandom:
+		return "random"
+	case StrategyFastest:
+		return "fastest"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseStrategy returns the strategy with the given name, as returned by
+// [Strategy.String].
+func ParseStrategy(name string) (Strategy, bool) {
+	for s := StrategySequential; s <= StrategyFastest; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// ProxyOptions configures a [Proxy].
+type ProxyOptions struct {
+	// HTTPClient is used to send DoH requests to upstreams given by URL. If
+	// nil, a [cleanhttp.DefaultPooledClient] is used.
+	HTTPClient *http.Client
+
+	// Strategy determines the order in which upstreams are tried. The
+	// default is StrategySequential.
+	Strategy Strategy
+
+	// AttemptTimeout limits the duration of each attempt against a single
+	// upstream, so that a slow upstream can't use up the time available to
+	// the others. If zero, attempts are only limited by the query context.
+	AttemptTimeout time.Duration
+
+	// Weights are the relative weights of each upstream for StrategyRandom,
+	// in the same order as the upstream URLs. Missing or non-positive
+	// weights count as 1.
+	Weights []int
+
+	// FailureThreshold is the number of consecutive failed attempts after
+	// which an upstream is considered unhealthy, and skipped until its
+	// cooldown has passed. If zero, DefaultFailureThreshold is used, and
+	// if negative, upstreams are never skipped due to consecutive failures.
+	FailureThreshold int
+
+	// ErrorRateThreshold is the moving average error rate, between 0 and 1,
+	// above which an upstream is considered unhealthy. If zero, upstreams
+	// are never skipped due to their error rate.
+	ErrorRateThreshold float64
+
+	// Cooldown is how long an unhealthy upstream is skipped before a single
+	// probe query is sent to check whether it has recovered. If zero,
+	// DefaultCooldown is used.
+	Cooldown time.Duration
+
+	// Coalesce enables merging concurrent identical queries (by name, type,
+	// class, and DO and CD bits) into a single upstream exchange, sharing
+	// the response between all of the callers, which avoids a burst of
+	// upstream queries when a popular name expires from caches.
+	Coalesce bool
+}
+
+// ProxyStats are counters of the queries handled by a [Proxy].
+type ProxyStats struct {
+	// Queries is the number of queries received by the proxy.
+	Queries uint64 `json:"queries"`
+
+	// Coalesced is the number of queries answered by sharing another
+	// identical in-flight query's upstream exchange.
+	Coalesced uint64 `json:"coalesced"`
+}
+
+// Proxy forwards DNS queries to a group of upstream servers, effectively
+// acting as a DNS-over-HTTPS (DoH) proxy with failover, using the configured
+// [Strategy] to choose between them. Upstreams can be DoH servers, or any
+// other [Upstream], such as plain DNS or DNS over TLS servers.
+//
+// The proxy tracks the health of each upstream, skipping unhealthy upstreams
+// until they recover, like a circuit breaker. If all upstreams are unhealthy,
+// they are all tried anyway.
+type Proxy struct {
+	opts      ProxyOptions
+	upstreams []*proxyUpstream
+	next      atomic.Uint64
+	flights   singleflight.Group
+	queries   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+// proxyUpstream is a single upstream of a Proxy.
+type proxyUpstream struct {
+	url      string
+	upstream Upstream
+	weight   int
+
+	mu     sync.Mutex
+	health upstreamHealth
+}
+
+// NewProxy returns a new proxy forwarding queries to the given upstream
+// URLs, which can be any mix of DoH server URLs, and plain DNS or DNS over
+// TLS URLs, as accepted by [ParseUpstream]. Queries to upstreams with invalid
+// URLs fail with ErrUnsupportedUpstream.
+func NewProxy(opts ProxyOptions, upstreamURLs ...string) *Proxy {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = cleanhttp.DefaultPooledClient()
+	}
+
+	upstreams := make([]Upstream, 0, len(upstreamURLs))
+
+	for _, upstreamURL := range upstreamURLs {
+		upstream, err := ParseUpstream(upstreamURL, opts.HTTPClient)
+		if err != nil {
+			upstream = &errorUpstream{url: upstreamURL, err: err}
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	return NewUpstreamProxy(opts, upstreams...)
+}
+
+// NewUpstreamProxy returns a new proxy forwarding queries to the given
+// upstreams.
+func NewUpstreamProxy(opts ProxyOptions, upstreams ...Upstream) *Proxy {
+	p := &Proxy{
+		opts: opts,
+	}
+
+	for i, upstream := range upstreams {
+		weight := 1
+		if i < len(opts.Weights) && opts.Weights[i] > 0 {
+			weight = opts.Weights[i]
+		}
+
+		p.upstreams = append(p.upstreams, &proxyUpstream{
+			url:      upstream.String(),
+			upstream: upstream,
+			weight:   weight,
+		})
+	}
+
+	return p
+}
+
+// Handler returns a DoH handler that forwards DNS queries using the proxy.
+func (p *Proxy) Handler() Handler {
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return p.Exchange(r.Context(), req)
+	}
+}
+
+// Stats returns the proxy's query counters.
+func (p *Proxy) Stats() ProxyStats {
+	return ProxyStats{
+		Queries:   p.queries.Load(),
+		Coalesced: p.coalesced.Load(),
+	}
+}
+
+// Exchange forwards the DNS query to the proxy's upstreams, returning the
+// first successful response, or a [*ForwarderError] listing each upstream's
+// error if all upstreams fail.
+//
+// SERVFAIL responses count as failures, so that the next upstream is tried,
+// but if all upstreams fail and one of them answered with SERVFAIL, that
+// response is returned, keeping any Extended DNS Error it carries.
+func (p *Proxy) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	p.queries.Add(1)
+
+	if p.opts.Coalesce {
+		if key, ok := CacheKey(req); ok {
+			return p.coalesce(ctx, key, req)
+		}
+	}
+
+	return p.exchange(ctx, req)
+}
+
+// coalesce forwards the DNS query, sharing a single upstream exchange with
+// any concurrent queries with the same key. The shared exchange isn't
+// canceled when the caller that started it goes away, so that it can still
+// answer the others.
+func (p *Proxy) coalesce(ctx context.Context, key string, req *dns.Msg) (*dns.Msg, error) {
+	// leader is only set by the caller whose function is executed, and read
+	// after receiving the result, which happens after the function returns.
+	var leader bool
+
+	ch := p.flights.DoChan(key, func() (any, error) {
+		leader = true
+
+		flightCtx := context.WithoutCancel(ctx)
+
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			flightCtx, cancel = context.WithDeadline(flightCtx, deadline)
+			defer cancel()
+		}
+
+		return p.exchange(flightCtx, req)
+	})
+
+	select {
+	case result := <-ch:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		resp := result.Val.(*dns.Msg)
+
+		if !result.Shared {
+			return resp, nil
+		}
+
+		if !leader {
+			p.coalesced.Add(1)
+		}
+
+		// Each caller gets its own copy of the shared response, with its own
+		// message ID and question, which may differ in case from the shared one.
+		resp = resp.Copy()
+		resp.Id = req.Id
+		resp.Question = slices.Clone(req.Question)
+
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exchange forwards the DNS query to the proxy's upstreams, according to
+// the proxy's strategy.
+func (p *Proxy) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if p.opts.Strategy == StrategyRace {
+		return p.race(ctx, req)
+	}
+
+	var (
+		forwarderErr = &ForwarderError{}
+		servfail     *dns.Msg
+	)
+
+	upstreams, fallback := p.available()
+
+	for _, upstream := range p.order(upstreams) {
+		// Another query may have claimed the probe of a recovering upstream
+		// since it was found available.
+		if !upstream.claim(&p.opts, time.Now()) && !fallback {
+			continue
+		}
+
+		resp, err := p.attempt(ctx, upstream, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		if errors.Is(err, ErrServerFailure) {
+			servfail = resp
+		}
+
+		forwarderErr.Errors = append(forwarderErr.Errors, &UpstreamError{URL: upstream.url, Err: err})
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if servfail != nil {
+		return servfail, nil
+	}
+
+	return nil, forwarderErr
+}
+
+// available returns the upstreams that may be tried for a single query,
+// skipping unhealthy ones, or all upstreams if none are healthy, in which
+// case fallback is true, and they are tried regardless of their health.
+func (p *Proxy) available() (upstreams []*proxyUpstream, fallback bool) {
+	now := time.Now()
+
+	for _, upstream := range p.upstreams {
+		if upstream.allow(now) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	if len(upstreams) == 0 {
+		return p.upstreams, true
+	}
+
+	return upstreams, false
+}
+
+// order returns the given upstreams in the order they should be tried for
+// a single query, according to the proxy's strategy.
+func (p *Proxy) order(upstreams []*proxyUpstream) []*proxyUpstream {
+	switch p.opts.Strategy {
+	case StrategyRoundRobin:
+		if len(upstreams) == 0 {
+			return nil
+		}
+
+		start := int(p.next.Add(1)-1) % len(upstreams)
+
+		return append(slices.Clone(upstreams[start:]), upstreams[:start]...)
+	case StrategyRandom:
+		return weightedShuffle(upstreams)
+	case StrategyFastest:
+		ordered := slices.Clone(upstreams)
+
+		slices.SortStableFunc(ordered, func(a, b *proxyUpstream) int {
+			return cmp.Compare(a.averageLatency(), b.averageLatency())
+		})
+
+		return ordered
+	default:
+		return upstreams
+	}
+}
+
+// weightedShuffle returns the upstreams in a random order, where upstreams
+// with larger weights are more likely to come first.
+func weightedShuffle(upstreams []*proxyUpstream) []*proxyUpstream {
+	remaining := slices.Clone(upstreams)
+	ordered := make([]*proxyUpstream, 0, len(upstreams))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, upstream := range remaining {
+			total += upstream.weight
+		}
+
+		n := rand.IntN(total)
+
+		for i, upstream := range remaining {
+			n -= upstream.weight
+			if n < 0 {
+				ordered = append(ordered, upstream)
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+// attempt sends the DNS query to a single upstream, limited by the
+// proxy's attempt timeout, and records the attempt's outcome in the
+// upstream's health.
+func (p *Proxy) attempt(ctx context.Context, upstream *proxyUpstream, req *dns.Msg) (*dns.Msg, error) {
+	if p.opts.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.AttemptTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+
+	resp, err := upstream.upstream.Exchange(ctx, req)
+
+	latency := time.Since(start)
+
+	// The response is still returned along with the error, to be used if
+	// all upstreams fail.
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = ErrServerFailure
+	}
+
+	// Failed attempts count as taking at least the attempt timeout, so that
+	// failing upstreams don't look fast.
+	if err != nil {
+		penalty := p.opts.AttemptTimeout
+		if penalty == 0 {
+			penalty = failureLatency
+		}
+
+		latency = max(latency, penalty)
+	}
+
+	// Attempts canceled by the caller, such as race losers, say nothing
+	// about the upstream's latency or health.
+	canceled := err != nil && errors.Is(ctx.Err(), context.Canceled)
+
+	upstream.record(&p.opts, time.Now(), latency, err, canceled)
+
+	return resp, err
+}
+
+// race sends the DNS query to all upstreams at once, returning the first
+// successful response and canceling the remaining attempts.
+func (p *Proxy) race(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		upstream *proxyUpstream
+		resp     *dns.Msg
+		err      error
+	}
+
+	upstreams, fallback := p.available()
+
+	results := make(chan result, len(upstreams))
+
+	attempts := 0
+
+	for _, upstream := range upstreams {
+		if !upstream.claim(&p.opts, time.Now()) && !fallback {
+			continue
+		}
+
+		attempts++
+
+		go func() {
+			resp, err := p.attempt(ctx, upstream, req)
+			results <- result{upstream: upstream, resp: resp, err: err}
+		}()
+	}
+
+	var (
+		forwarderErr = &ForwarderError{}
+		servfail     *dns.Msg
+	)
+
+	for range attempts {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+
+		if errors.Is(r.err, ErrServerFailure) {
+			servfail = r.resp
+		}
+
+		forwarderErr.Errors = append(forwarderErr.Errors, &UpstreamError{URL: r.upstream.url, Err: r.err})
+	}
+
+	if servfail != nil {
+		return servfail, nil
+	}
+
+	return nil, forwarderErr
+}
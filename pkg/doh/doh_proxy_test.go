@@ -0,0 +1,367 @@
+package doh_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testUpstream is a local DoH server used as a proxy upstream in tests,
+// counting the queries it receives.
+type testUpstream struct {
+	url     string
+	queries atomic.Int64
+	fail    atomic.Bool
+}
+
+// newTestUpstream starts a DoH test server answering every query after the
+// given delay, or failing every query if fail is true.
+func newTestUpstream(t *testing.T, delay time.Duration, fail bool) *testUpstream {
+	t.Helper()
+
+	upstream := &testUpstream{}
+	upstream.fail.Store(fail)
+
+	mux := doh.NewServerMux(testAnswerHandler)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.queries.Add(1)
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		if upstream.fail.Load() {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	upstream.url = server.URL + "/dns-query"
+
+	return upstream
+}
+
+func TestProxy(t *testing.T) {
+	ctx := testContext(t)
+
+	query := func(t *testing.T, proxy *doh.Proxy) {
+		t.Helper()
+
+		resp, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Fatalf("got %d answers, want 1", len(resp.Answer))
+		}
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		failing := newTestUpstream(t, 0, true)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{}, failing.url, good.url)
+
+		query(t, proxy)
+
+		if failing.queries.Load() != 1 || good.queries.Load() != 1 {
+			t.Errorf("got %d and %d queries, want 1 and 1", failing.queries.Load(), good.queries.Load())
+		}
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		failing := newTestUpstream(t, 0, true)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{}, failing.url, failing.url)
+
+		_, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+		if !errors.Is(err, doh.ErrForwarderFailed) {
+			t.Fatalf("got error %v, want %v", err, doh.ErrForwarderFailed)
+		}
+
+		if !errors.Is(err, doh.ErrFailedHTTPRequest) {
+			t.Errorf("got error %v, want upstream error %v", err, doh.ErrFailedHTTPRequest)
+		}
+
+		var forwarderErr *doh.ForwarderError
+		if !errors.As(err, &forwarderErr) {
+			t.Fatalf("got error %T, want %T", err, forwarderErr)
+		}
+
+		if len(forwarderErr.Errors) != 2 {
+			t.Fatalf("got %d upstream errors, want 2", len(forwarderErr.Errors))
+		}
+
+		for _, upstreamErr := range forwarderErr.Errors {
+			if upstreamErr.URL != failing.url {
+				t.Errorf("got upstream error for %s, want %s", upstreamErr.URL, failing.url)
+			}
+		}
+	})
+
+	t.Run("server failure", func(t *testing.T) {
+		// A chained DoH server whose handler fails answers with SERVFAIL.
+		chained := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			return nil, doh.ErrForwarderFailed
+		})
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{FailureThreshold: 1, Cooldown: time.Hour}, chained, good.url)
+
+		query(t, proxy)
+
+		if good.queries.Load() != 1 {
+			t.Errorf("got %d queries for good upstream, want 1", good.queries.Load())
+		}
+
+		status := proxy.Status()[0]
+
+		if status.Failures != 1 || status.State != doh.CircuitOpen {
+			t.Errorf("got %d failures with state %s for failing upstream, want 1 with %s", status.Failures, status.State, doh.CircuitOpen)
+		}
+
+		if !strings.Contains(status.LastError, doh.ErrServerFailure.Error()) {
+			t.Errorf("got last error %q, want %q", status.LastError, doh.ErrServerFailure)
+		}
+	})
+
+	t.Run("all server failure", func(t *testing.T) {
+		chained := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			return nil, doh.ErrForwarderFailed
+		})
+
+		for _, strategy := range []doh.Strategy{doh.StrategySequential, doh.StrategyRace} {
+			proxy := doh.NewProxy(doh.ProxyOptions{Strategy: strategy}, chained, chained)
+
+			resp, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("google.com.", dns.TypeA))
+			if err != nil {
+				t.Fatalf("%s: %v", strategy, err)
+			}
+
+			if resp.Rcode != dns.RcodeServerFailure {
+				t.Errorf("%s: got rcode %s, want %s", strategy, dns.RcodeToString[resp.Rcode], dns.RcodeToString[dns.RcodeServerFailure])
+			}
+		}
+	})
+
+	t.Run("attempt timeout", func(t *testing.T) {
+		slow := newTestUpstream(t, 5*time.Second, false)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{AttemptTimeout: 50 * time.Millisecond}, slow.url, good.url)
+
+		start := time.Now()
+
+		query(t, proxy)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("took %s, want less than 1s", elapsed)
+		}
+	})
+
+	t.Run("race", func(t *testing.T) {
+		slow := newTestUpstream(t, 5*time.Second, false)
+		good := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{Strategy: doh.StrategyRace}, slow.url, good.url)
+
+		start := time.Now()
+
+		query(t, proxy)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("took %s, want less than 1s", elapsed)
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		upstreams := []*testUpstream{
+			newTestUpstream(t, 0, false),
+			newTestUpstream(t, 0, false),
+			newTestUpstream(t, 0, false),
+		}
+
+		proxy := doh.NewProxy(doh.ProxyOptions{Strategy: doh.StrategyRoundRobin}, upstreams[0].url, upstreams[1].url, upstreams[2].url)
+
+		for range 6 {
+			query(t, proxy)
+		}
+
+		for i, upstream := range upstreams {
+			if got := upstream.queries.Load(); got != 2 {
+				t.Errorf("upstream %d got %d queries, want 2", i, got)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		heavy := newTestUpstream(t, 0, false)
+		light := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{
+			Strategy: doh.StrategyRandom,
+			Weights:  []int{1_000_000_000, 1},
+		}, heavy.url, light.url)
+
+		for range 10 {
+			query(t, proxy)
+		}
+
+		if heavy.queries.Load() != 10 {
+			t.Errorf("got %d queries for heavy upstream, want 10", heavy.queries.Load())
+		}
+	})
+
+	t.Run("fastest", func(t *testing.T) {
+		slow := newTestUpstream(t, 100*time.Millisecond, false)
+		fast := newTestUpstream(t, 0, false)
+
+		proxy := doh.NewProxy(doh.ProxyOptions{Strategy: doh.StrategyFastest}, slow.url, fast.url)
+
+		for range 5 {
+			query(t, proxy)
+		}
+
+		if slow.queries.Load() != 1 {
+			t.Errorf("got %d queries for slow upstream, want 1", slow.queries.Load())
+		}
+	})
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, strategy := range []doh.Strategy{
+		doh.StrategySequential,
+		doh.StrategyRace,
+		doh.StrategyRoundRobin,
+		doh.StrategyRandom,
+		doh.StrategyFastest,
+	} {
+		got, ok := doh.ParseStrategy(strategy.String())
+		if !ok || got != strategy {
+			t.Errorf("got strategy %v (%v), want %v", got, ok, strategy)
+		}
+	}
+
+	if _, ok := doh.ParseStrategy("bogus"); ok {
+		t.Error("parsed unknown strategy")
+	}
+}
+
+func TestProxy_Coalesce(t *testing.T) {
+	ctx := testContext(t)
+
+	var (
+		upstreamQueries atomic.Int64
+		started         = make(chan struct{})
+		release         = make(chan struct{})
+	)
+
+	mux := doh.NewServerMux(testAnswerHandler)
+
+	// The upstream blocks until all callers have entered the proxy, so that
+	// they all share its single exchange.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreamQueries.Add(1) == 1 {
+			close(started)
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	proxy := doh.NewProxy(doh.ProxyOptions{Coalesce: true}, server.URL+"/dns-query")
+
+	const n = 10
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, n)
+	)
+
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Vary the case of the name, which is still the same question.
+			name := "google.com."
+			if i%2 == 0 {
+				name = "GOOGLE.com."
+			}
+
+			req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+
+			resp, err := proxy.Exchange(ctx, req)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if resp.Id != req.Id {
+				errs <- fmt.Errorf("got id %d, want %d", resp.Id, req.Id)
+				return
+			}
+
+			if resp.Question[0].Name != name {
+				errs <- fmt.Errorf("got question name %s, want %s", resp.Question[0].Name, name)
+			}
+		}()
+	}
+
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	for proxy.Stats().Queries < n {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+
+	close(release)
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("got %d upstream queries, want 1", got)
+	}
+
+	stats := proxy.Stats()
+
+	// Callers are counted before joining the shared exchange, so one could
+	// still be about to join it when the upstream is released.
+	if stats.Queries != n || stats.Coalesced < 1 {
+		t.Errorf("got stats %+v, want %d queries with at least 1 coalesced", stats, n)
+	}
+}
@@ -0,0 +1,409 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the TLS application-layer protocol negotiation (ALPN) token
+// of DNS over QUIC (DoQ), as defined in [RFC 9250 section 4.1.1].
+//
+// [RFC 9250 section 4.1.1]: https://datatracker.ietf.org/doc/html/rfc9250#section-4.1.1
+const QUICALPN = "doq"
+
+// DoQ error codes, as defined in RFC 9250 section 4.3, used to close QUIC
+// connections and streams.
+const (
+	quicNoError          = 0x0
+	quicInternalError    = 0x1
+	quicProtocolError    = 0x2
+	quicRequestCancelled = 0x3
+)
+
+// quicIdleTimeout is how long a DoQ connection can be idle before it is
+// closed, by either the client or the server.
+const quicIdleTimeout = 30 * time.Second
+
+// QUICUpstream is an [Upstream] speaking DNS over QUIC (DoQ) as defined in
+// [RFC 9250], sending each query on its own stream of a shared connection,
+// which is reestablished when it is closed.
+//
+// [RFC 9250]: https://datatracker.ietf.org/doc/html/rfc9250
+type QUICUpstream struct {
+	// Addr is the host and port of the DoQ server.
+	Addr string
+
+	// TLSConfig is used to connect to the server. If nil, the default
+	// configuration is used, verifying the server's certificate for the host
+	// of Addr. The "doq" protocol is always negotiated.
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+// Exchange sends the DNS request to the upstream, returning its response.
+func (u *QUICUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := u.exchange(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailedDNSExchange, err)
+	}
+
+	return resp, nil
+}
+
+// exchange sends the DNS request on a new stream, retrying once with a new
+// connection if the shared connection was closed.
+func (u *QUICUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.connection(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil && ctx.Err() == nil {
+		conn, err = u.connection(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err = conn.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Cancel the stream if the context is done before the response arrives.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(quicRequestCancelled)
+		stream.CancelWrite(quicRequestCancelled)
+	})
+	defer stop()
+
+	// The message ID must be 0 on DoQ streams, as described in RFC 9250
+	// section 4.2.1, so the request is sent with its ID cleared.
+	msg := req.Copy()
+	msg.Id = 0
+
+	if err := writeQUICMsg(stream, msg); err != nil {
+		return nil, err
+	}
+
+	resp, err := readQUICMsg(stream)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	resp.Id = req.Id
+
+	return resp, nil
+}
+
+// connection returns the shared connection, dialing a new one if there is
+// none, or if it is the given stale connection.
+func (u *QUICUpstream) connection(ctx context.Context, stale *quic.Conn) (*quic.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && u.conn != stale && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+
+	if u.conn != nil {
+		u.conn.CloseWithError(quicNoError, "")
+		u.conn = nil
+	}
+
+	var tlsConfig *tls.Config
+	if u.TLSConfig != nil {
+		tlsConfig = u.TLSConfig.Clone()
+	} else {
+		host, _, err := net.SplitHostPort(u.Addr)
+		if err != nil {
+			host = u.Addr
+		}
+
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	tlsConfig.NextProtos = []string{QUICALPN}
+
+	conn, err := quic.DialAddr(ctx, u.Addr, tlsConfig, &quic.Config{
+		MaxIdleTimeout: quicIdleTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u.conn = conn
+
+	return conn, nil
+}
+
+// Close closes the upstream's shared connection, if any.
+func (u *QUICUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+
+	err := u.conn.CloseWithError(quicNoError, "")
+	u.conn = nil
+
+	return err
+}
+
+// String returns the URL of the upstream, as accepted by [ParseUpstream].
+func (u *QUICUpstream) String() string {
+	return "quic://" + u.Addr
+}
+
+// writeQUICMsg writes the DNS message to the stream, prefixed with its
+// length, and closes the sending side of the stream, as described in RFC
+// 9250 section 4.2.
+func writeQUICMsg(stream *quic.Stream, msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFailedDNSRequestPack, err)
+	}
+
+	b := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(b, uint16(len(packed)))
+	copy(b[2:], packed)
+
+	if _, err := stream.Write(b); err != nil {
+		return err
+	}
+
+	return stream.Close()
+}
+
+// readQUICMsg reads a length prefixed DNS message from the stream.
+func readQUICMsg(stream *quic.Stream) (*dns.Msg, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailedDNSResponseUnpack, err)
+	}
+
+	return msg, nil
+}
+
+// QUICServerOptions configures a [QUICServer].
+type QUICServerOptions struct {
+	// Timeout is the maximum time to wait for the handler to answer each
+	// query. If zero, DefaultStubTimeout is used.
+	Timeout time.Duration
+
+	// Logger is used to log failed queries. If nil, nothing is logged.
+	Logger *slog.Logger
+}
+
+// QUICServer is a DNS over QUIC (DoQ) server as defined in [RFC 9250],
+// which answers queries with a DoH [Handler], so that the same handler can
+// serve both DoH and DoQ clients.
+//
+// Handlers are called with a synthesized POST request for [DefaultPath],
+// whose RemoteAddr is the address of the DoQ client, and a response writer
+// that discards anything written to it.
+//
+// [RFC 9250]: https://datatracker.ietf.org/doc/html/rfc9250
+type QUICServer struct {
+	// Handler handles the DNS requests received by the server.
+	Handler Handler
+
+	QUICServerOptions
+}
+
+// NewQUICServer returns a DoQ server that answers queries with the given
+// handler, configured with the given options.
+func NewQUICServer(handler Handler, opts QUICServerOptions) *QUICServer {
+	return &QUICServer{
+		Handler:           handler,
+		QUICServerOptions: opts,
+	}
+}
+
+// ListenAndServe listens on the given UDP address, and serves DoQ queries
+// until the context is canceled. The "doq" protocol is added to the given
+// TLS configuration.
+func (s *QUICServer) ListenAndServe(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	ln, err := ListenQUIC(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// ListenQUIC returns a QUIC listener on the given UDP address for a
+// [QUICServer], adding the "doq" protocol to the given TLS configuration.
+func ListenQUIC(addr string, tlsConfig *tls.Config) (*quic.Listener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{QUICALPN}
+
+	return quic.ListenAddr(addr, tlsConfig, &quic.Config{
+		MaxIdleTimeout: quicIdleTimeout,
+	})
+}
+
+// Serve serves DoQ queries received on the given listener until the
+// context is canceled, closing the listener and all of its connections
+// when it returns.
+func (s *QUICServer) Serve(ctx context.Context, ln *quic.Listener) error {
+	defer ln.Close()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = make(map[*quic.Conn]struct{})
+	)
+
+	defer func() {
+		mu.Lock()
+		for conn := range conns {
+			conn.CloseWithError(quicNoError, "")
+		}
+		mu.Unlock()
+
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveConn(conn)
+
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// serveConn serves the queries received on each stream of the connection,
+// until the connection is closed.
+func (s *QUICServer) serveConn(conn *quic.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s.serveStream(conn, stream)
+		}()
+	}
+}
+
+// serveStream answers the single query received on the stream.
+func (s *QUICServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStubTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(conn.Context(), timeout)
+	defer cancel()
+
+	stream.SetDeadline(time.Now().Add(timeout))
+
+	req, err := readQUICMsg(stream)
+	if err != nil {
+		stream.CancelRead(quicProtocolError)
+		stream.CancelWrite(quicProtocolError)
+		return
+	}
+
+	// A non-zero message ID is a protocol error, as described in RFC 9250
+	// section 4.2.1.
+	if req.Id != 0 {
+		conn.CloseWithError(quicProtocolError, "non-zero message id")
+		return
+	}
+
+	var resp *dns.Msg
+
+	if req.Response || len(req.Question) == 0 {
+		resp = newErrorResponse(req, dns.RcodeFormatError, dns.ExtendedErrorCodeOther, "")
+	} else {
+		resp, err = callHandler(ctx, s.Handler, conn.RemoteAddr(), req)
+		if err != nil {
+			s.report(conn.RemoteAddr(), req, err)
+			resp = newErrorResponse(req, dns.RcodeServerFailure, extendedErrorCode(err), "")
+		}
+	}
+
+	// The response is copied before it's modified to be written, since
+	// handlers may return messages that are shared, such as cached responses.
+	resp = resp.Copy()
+	resp.Id = 0
+	resp.Compress = true
+
+	if err := writeQUICMsg(stream, resp); err != nil {
+		s.report(conn.RemoteAddr(), req, fmt.Errorf("doh: failed to write quic response: %w", err))
+		stream.CancelWrite(quicInternalError)
+	}
+}
+
+// report logs the given error for the query, if a logger is configured.
+func (s *QUICServer) report(remoteAddr net.Addr, req *dns.Msg, err error) {
+	if s.Logger == nil {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("remote_addr", remoteAddr.String()),
+		slog.String("error", err.Error()),
+	}
+
+	if len(req.Question) > 0 {
+		attrs = append(attrs, slog.String("name", req.Question[0].Name))
+	}
+
+	s.Logger.LogAttrs(context.Background(), slog.LevelError, "doq query failed", attrs...)
+}
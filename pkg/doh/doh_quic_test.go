@@ -0,0 +1,237 @@
+package doh_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+	"github.com/quic-go/quic-go"
+)
+
+// testQUICServer starts a DoQ server for the given handler on a loopback
+// address with a self-signed certificate, returning an upstream for it.
+func testQUICServer(t *testing.T, handler doh.Handler) *doh.QUICUpstream {
+	t.Helper()
+
+	cert, pool := testCertificate(t)
+
+	ln, err := doh.ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	server := doh.NewQUICServer(handler, doh.QUICServerOptions{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, ln)
+	}()
+
+	upstream := &doh.QUICUpstream{
+		Addr:      ln.Addr().String(),
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	}
+
+	t.Cleanup(func() {
+		upstream.Close()
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("quic server did not shut down")
+		}
+	})
+
+	return upstream
+}
+
+func TestQUICServer(t *testing.T) {
+	upstream := testQUICServer(t, testAnswerHandler)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{name: "A", qtype: dns.TypeA},
+		{name: "TXT", qtype: dns.TypeTXT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+
+			req := new(dns.Msg).SetQuestion("example.com.", test.qtype)
+
+			resp, err := upstream.Exchange(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Fatalf("got %d answers, want 1", len(resp.Answer))
+			}
+
+			if got := resp.Answer[0].Header().Rrtype; got != test.qtype {
+				t.Errorf("got type %s, want %s", dns.TypeToString[got], dns.TypeToString[test.qtype])
+			}
+		})
+	}
+}
+
+func TestQUICServer_SharedResponse(t *testing.T) {
+	ctx := testContext(t)
+
+	// The handler returns the same response to every query, like a cache
+	// would, which must not be modified by the server.
+	shared := new(dns.Msg).SetReply(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	sharedID := shared.Id
+
+	upstream := testQUICServer(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return shared, nil
+	})
+
+	if _, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.Id != sharedID || shared.Compress {
+		t.Errorf("got handler's response modified to id %d and compress %v, want id %d", shared.Id, shared.Compress, sharedID)
+	}
+}
+
+func TestQUICServer_Concurrent(t *testing.T) {
+	ctx := testContext(t)
+
+	var calls atomic.Int64
+
+	upstream := testQUICServer(t, countingHandler(testAnswerHandler, &calls))
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 20)
+
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if got := calls.Load(); got != 20 {
+		t.Errorf("got %d handler calls, want 20", got)
+	}
+}
+
+func TestQUICServer_HandlerError(t *testing.T) {
+	ctx := testContext(t)
+
+	failing := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("test error")
+	}
+
+	upstream := testQUICServer(t, failing)
+
+	resp, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got rcode %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestQUICServer_NonZeroID(t *testing.T) {
+	ctx := testContext(t)
+
+	upstream := testQUICServer(t, testAnswerHandler)
+
+	conn, err := quic.DialAddr(ctx, upstream.Addr, &tls.Config{
+		RootCAs:    upstream.TLSConfig.RootCAs,
+		ServerName: "localhost",
+		NextProtos: []string{doh.QUICALPN},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed))))
+	stream.Write(packed)
+	stream.Close()
+
+	_, err = io.ReadAll(stream)
+
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) {
+		t.Fatalf("got error %v, want application error", err)
+	}
+
+	if appErr.ErrorCode != 0x2 {
+		t.Errorf("got error code %#x, want DOQ_PROTOCOL_ERROR (0x2)", appErr.ErrorCode)
+	}
+}
+
+func TestQUICUpstream_Reconnect(t *testing.T) {
+	ctx := testContext(t)
+
+	upstream := testQUICServer(t, testAnswerHandler)
+
+	for i := range 2 {
+		resp, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Errorf("query %d: got %d answers, want 1", i, len(resp.Answer))
+		}
+
+		// Close the connection, so that the next query must reconnect.
+		upstream.Close()
+	}
+}
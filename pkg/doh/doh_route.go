@@ -0,0 +1,52 @@
+package doh
+
+import (
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// RouteHandler returns a DoH handler that routes each query to the handler
+// of the longest domain suffix in routes matching the query name, such as
+// a [Proxy] handler forwarding to an internal resolver, or to defaultHandler
+// if no suffix matches. A suffix also matches itself, and is compared case
+// insensitively.
+//
+// If defaultHandler is nil, queries without a matching route are answered
+// with REFUSED.
+func RouteHandler(routes map[string]Handler, defaultHandler Handler) Handler {
+	canonical := make(map[string]Handler, len(routes))
+	for suffix, handler := range routes {
+		canonical[dns.CanonicalName(suffix)] = handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		handler := defaultHandler
+
+		if len(req.Question) == 1 {
+			if h, ok := matchRoute(canonical, dns.CanonicalName(req.Question[0].Name)); ok {
+				handler = h
+			}
+		}
+
+		if handler == nil {
+			return newErrorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeNotSupported, "no route for query"), nil
+		}
+
+		return handler(w, r, req)
+	}
+}
+
+// matchRoute returns the handler of the longest suffix in routes matching
+// the fully qualified name, with one lookup per label.
+func matchRoute(routes map[string]Handler, name string) (Handler, bool) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if handler, ok := routes[name[off:]]; ok {
+			return handler, true
+		}
+	}
+
+	// The root domain matches every name.
+	handler, ok := routes["."]
+	return handler, ok
+}
@@ -0,0 +1,60 @@
+package doh_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+func TestRouteHandler(t *testing.T) {
+	var got string
+
+	route := func(name string) doh.Handler {
+		return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+			got = name
+			return testAnswerHandler(w, r, req)
+		}
+	}
+
+	routes := map[string]doh.Handler{
+		"corp.example":          route("corp"),
+		"lab.corp.example.":     route("lab"),
+		"168.192.in-addr.arpa.": route("reverse"),
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		fallback  doh.Handler
+		want      string
+		wantRcode int
+	}{
+		{name: "suffix", qname: "www.corp.example.", fallback: route("default"), want: "corp"},
+		{name: "exact", qname: "CORP.example.", fallback: route("default"), want: "corp"},
+		{name: "longest match", qname: "host.lab.corp.example.", fallback: route("default"), want: "lab"},
+		{name: "reverse", qname: "1.0.168.192.in-addr.arpa.", fallback: route("default"), want: "reverse"},
+		{name: "label boundary", qname: "notcorp.example.", fallback: route("default"), want: "default"},
+		{name: "default", qname: "example.com.", fallback: route("default"), want: "default"},
+		{name: "no default", qname: "example.com.", wantRcode: dns.RcodeRefused},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got = ""
+
+			handler := doh.RouteHandler(routes, test.fallback)
+
+			resp := testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion(test.qname, dns.TypeA))
+
+			if got != test.want {
+				t.Errorf("got route %q, want %q", got, test.want)
+			}
+
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+		})
+	}
+}
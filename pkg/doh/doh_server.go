@@ -3,8 +3,14 @@ package doh
 import (
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -15,120 +21,328 @@ var (
 )
 
 // Handler is a function that handles a DNS-over-HTTPS (DoH) request.
+//
+// By default, the server sets the Cache-Control header of the HTTP response
+// from the TTLs of the returned DNS message. A handler can override this by
+// setting the Cache-Control header on the given response writer itself.
 type Handler func(w http.ResponseWriter, httpReq *http.Request, dnsReq *dns.Msg) (*dns.Msg, error)
 
+// DefaultMaxMessageSize is the default maximum size, in bytes, of a DNS
+// message accepted by a [Server] or read by a [Client], which is the largest
+// possible DNS message.
+const DefaultMaxMessageSize = dns.MaxMsgSize
+
+// DefaultPath is the default path of the DoH server endpoint, used by
+// [NewServerMux].
+const DefaultPath = "/dns-query"
+
+// ServerOptions configures a DoH [Server].
+type ServerOptions struct {
+	// Path is the URL path the server responds to, such as "/dns-query".
+	// Requests for other paths are rejected with HTTP 404. If empty, all
+	// paths are accepted, which is useful when the server is mounted in
+	// another router that already matches the path.
+	Path string
+
+	// Methods is the list of allowed HTTP methods, which can be used to
+	// disable either GET or POST. Other methods are rejected with HTTP 405.
+	// If empty, both GET and POST are allowed.
+	Methods []string
+
+	// MaxRequestSize is the maximum size, in bytes, of a DNS request
+	// message. Larger POST bodies are rejected with HTTP 413, and larger
+	// GET "dns" parameters with HTTP 414. If zero, DefaultMaxMessageSize
+	// is used.
+	MaxRequestSize int64
+
+	// OnError is called with each error that causes the server to reply
+	// with a non-200 HTTP response, such as invalid requests, or with a
+	// DNS server failure, such as handler failures.
+	OnError func(r *http.Request, err error)
+
+	// Logger is used to log failed requests. If nil, nothing is logged.
+	Logger *slog.Logger
+
+	// DisablePadding disables padding of responses. By default, responses
+	// to queries with an [RFC 7830] EDNS(0) padding option are padded to a
+	// multiple of ResponsePaddingBlockSize bytes, following the [RFC 8467]
+	// block-length policy. Responses to queries without padding are never
+	// padded.
+	//
+	// [RFC 7830]: https://datatracker.ietf.org/doc/html/rfc7830
+	// [RFC 8467]: https://datatracker.ietf.org/doc/html/rfc8467
+	DisablePadding bool
+}
+
+// Server is an HTTP handler for the DoH server endpoint, supporting the
+// DNS-over-HTTPS (DoH) protocol as defined in [RFC 8484].
+//
+// [RFC 8484]: https://tools.ietf.org/html/rfc8484
+type Server struct {
+	// Handler handles the DNS requests received by the server.
+	Handler Handler
+
+	ServerOptions
+}
+
+// NewHandler returns an HTTP handler for the DoH server endpoint, configured
+// with the given options, which can be mounted in any HTTP router.
+func NewHandler(handler Handler, opts ServerOptions) http.Handler {
+	return &Server{
+		Handler:       handler,
+		ServerOptions: opts,
+	}
+}
+
 // NewServerMux returns an HTTP server mux with an endpoint for the DoH server,
 // supporting the DNS-over-HTTPS (DoH) protocol as defined in [RFC 8484].
 //
+// The endpoint is served at [DefaultPath] with the default [ServerOptions].
+// Use [NewHandler] for more control.
+//
 // [RFC 8484]: https://tools.ietf.org/html/rfc8484
 func NewServerMux(handler Handler) *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
-		// https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
-		switch r.Method {
-		case http.MethodPost:
-			serverHandlePost(w, r, handler)
-		case http.MethodGet:
-			serverHandleGet(w, r, handler)
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		}
-	})
+	mux.Handle(DefaultPath, NewHandler(handler, ServerOptions{Path: DefaultPath}))
 
 	return mux
 }
 
-// serverHandlePost handles a POST request to the DoH server endpoint.
-func serverHandlePost(w http.ResponseWriter, r *http.Request, handler Handler) {
-	switch r.Header.Get("Content-Type") {
+// ServeHTTP implements the [http.Handler] interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Path != "" && r.URL.Path != s.Path {
+		s.error(w, r, http.StatusNotFound, fmt.Errorf("doh: unknown path %q", r.URL.Path))
+		return
+	}
+
+	if !s.allowed(r.Method) {
+		w.Header().Set("Allow", strings.Join(s.methods(), ", "))
+		s.error(w, r, http.StatusMethodNotAllowed, fmt.Errorf("doh: method %s not allowed", r.Method))
+		return
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+	switch r.Method {
+	case http.MethodPost:
+		s.handlePost(w, r)
+	case http.MethodGet:
+		s.handleGet(w, r)
+	default:
+		s.error(w, r, http.StatusMethodNotAllowed, fmt.Errorf("doh: method %s not supported", r.Method))
+	}
+}
+
+// methods returns the allowed HTTP methods.
+func (s *Server) methods() []string {
+	if len(s.Methods) > 0 {
+		return s.Methods
+	}
+	return []string{http.MethodGet, http.MethodPost}
+}
+
+// allowed reports whether the given HTTP method is allowed.
+func (s *Server) allowed(method string) bool {
+	return slices.Contains(s.methods(), method)
+}
+
+// maxRequestSize returns the maximum DNS request message size.
+func (s *Server) maxRequestSize() int64 {
+	if s.MaxRequestSize > 0 {
+		return s.MaxRequestSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// error reports the given error to the error hook and logger, if configured,
+// and replies to the request with the given HTTP status code.
+//
+// Client errors are logged at debug level, since they're caused by the client,
+// and server errors are logged at error level.
+func (s *Server) error(w http.ResponseWriter, r *http.Request, code int, err error) {
+	level := slog.LevelDebug
+	if code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	s.report(r, level, err, slog.Int("status", code))
+
+	http.Error(w, http.StatusText(code), code)
+}
+
+// report reports the given error to the error hook and logger, if configured,
+// logging it at the given level with the given attributes.
+func (s *Server) report(r *http.Request, level slog.Level, err error, attrs ...slog.Attr) {
+	if s.OnError != nil {
+		s.OnError(r, err)
+	}
+
+	if s.Logger != nil {
+		s.Logger.LogAttrs(r.Context(), level, "doh request failed", append([]slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("error", err.Error()),
+		}, attrs...)...)
+	}
+}
+
+// handlePost handles a POST request to the DoH server endpoint.
+func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	switch contentType := r.Header.Get("Content-Type"); contentType {
 	case "application/dns-message":
-		b, err := io.ReadAll(r.Body)
+		if r.ContentLength > s.maxRequestSize() {
+			s.error(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("doh: request body of %d bytes too large", r.ContentLength))
+			return
+		}
+
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxRequestSize()))
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				s.error(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("doh: request body too large: %w", err))
+				return
+			}
+
+			s.error(w, r, http.StatusInternalServerError, fmt.Errorf("doh: failed to read request body: %w", err))
 			return
 		}
 
 		// Unpack the DNS message from the HTTP request.
 		var dnsReq dns.Msg
-		if err := dnsReq.Unpack(b); err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if err := unpackQuery(&dnsReq, b); err != nil {
+			s.error(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		serverHandleDNSReq(w, r, handler, &dnsReq)
+		s.handleDNSReq(w, r, &dnsReq)
 	default:
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		s.error(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("doh: unsupported content type %q", contentType))
 	}
 }
 
-// serverHandleGet handles a GET request to the DoH server endpoint.
-func serverHandleGet(w http.ResponseWriter, r *http.Request, handler Handler) {
+// handleGet handles a GET request to the DoH server endpoint.
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 
 	dnsParam := q.Get("dns")
 
 	if dnsParam == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.error(w, r, http.StatusBadRequest, errors.New("doh: missing dns parameter"))
+		return
+	}
+
+	// Check the encoded length before decoding, to avoid allocating
+	// memory for oversized messages.
+	if int64(len(dnsParam)) > int64(base64.RawURLEncoding.EncodedLen(int(s.maxRequestSize()))) {
+		s.error(w, r, http.StatusRequestURITooLong, fmt.Errorf("doh: dns parameter of %d bytes too large", len(dnsParam)))
 		return
 	}
 
 	dnsParamDecoded, err := base64.RawURLEncoding.DecodeString(dnsParam)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.error(w, r, http.StatusBadRequest, fmt.Errorf("doh: invalid dns parameter: %w", err))
 		return
 	}
 
 	// Unpack the DNS message from the HTTP request.
 	var dnsReq dns.Msg
-	if err := dnsReq.Unpack(dnsParamDecoded); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if err := unpackQuery(&dnsReq, dnsParamDecoded); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	serverHandleDNSReq(w, r, handler, &dnsReq)
+	s.handleDNSReq(w, r, &dnsReq)
 }
 
-// serverHandleDNSReq handles a DNS request to the DoH server endpoint, after unpacking the DNS message
+// unpackQuery unpacks a DNS query message from its wire format, validating
+// that it is a query with at least one question.
+func unpackQuery(dnsReq *dns.Msg, b []byte) error {
+	if err := dnsReq.Unpack(b); err != nil {
+		return fmt.Errorf("doh: invalid dns message: %w", err)
+	}
+
+	if dnsReq.Response {
+		return errors.New("doh: dns message is not a query")
+	}
+
+	if len(dnsReq.Question) == 0 {
+		return errors.New("doh: dns query has no question")
+	}
+
+	return nil
+}
+
+// handleDNSReq handles a DNS request to the DoH server endpoint, after unpacking the DNS message
 // from a GET or POST request to the DoH server. It then calls the handler to process the DNS request,
 // if one is configured, and writes the response back to the HTTP response.
-func serverHandleDNSReq(w http.ResponseWriter, r *http.Request, handler Handler, dnsReq *dns.Msg) {
-	if handler == nil {
-		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+func (s *Server) handleDNSReq(w http.ResponseWriter, r *http.Request, dnsReq *dns.Msg) {
+	if s.Handler == nil {
+		s.error(w, r, http.StatusNotImplemented, errors.New("doh: no handler configured"))
 		return
 	}
 
-	dnsResp, err := handler(w, r, dnsReq)
+	dnsResp, err := s.Handler(w, r, dnsReq)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		// Handler errors are reported to the client as a DNS server failure,
+		// instead of a non-DNS HTTP error, so that it can fail over as usual.
+		s.report(r, slog.LevelError, err, slog.String("rcode", dns.RcodeToString[dns.RcodeServerFailure]))
+
+		dnsResp = newErrorResponse(dnsReq, dns.RcodeServerFailure, extendedErrorCode(err), "")
+	}
+
+	dnsResp = trimResponseEDNS(dnsReq, dnsResp)
+
+	// Responses are only padded if the query was, as described in RFC 8467
+	// section 4.1. The response is copied first, since handlers may return
+	// messages that are shared, such as cached responses.
+	if !s.DisablePadding && hasPadding(dnsReq) {
+		dnsResp = dnsResp.Copy()
+		padMsg(dnsResp, ResponsePaddingBlockSize, dnsReq.IsEdns0().UDPSize())
 	}
 
 	// Pack the DNS response message into the HTTP response.
 	b, err := dnsResp.Pack()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		s.error(w, r, http.StatusInternalServerError, fmt.Errorf("doh: failed to pack dns response: %w", err))
 		return
 	}
 
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", serverCacheControl(dnsResp))
+	}
+
 	w.Header().Set("Content-Type", "application/dns-message")
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
+}
 
+// serverCacheControl returns the Cache-Control header value for a DNS response,
+// with a freshness lifetime based on the smallest TTL in the response, or the
+// SOA minimum for negative answers, as described in [RFC 8484 section 5.1].
+//
+// Responses are only identified by their URL, without an ETag or Last-Modified
+// validator, so GET responses can be cached by HTTP caches and CDNs for as long
+// as they are fresh, but are fetched again once stale.
+//
+// [RFC 8484 section 5.1]: https://datatracker.ietf.org/doc/html/rfc8484#section-5.1
+func serverCacheControl(dnsResp *dns.Msg) string {
+	ttl, ok := ResponseTTL(dnsResp)
+	if !ok {
+		return "no-store"
+	}
+
+	return "max-age=" + strconv.Itoa(int(ttl/time.Second))
 }
 
 // Forwarder returns a DoH handler that forwards DNS queries to multiple DoH servers,
 // effectively acting as a DNS-over-HTTPS (DoH) proxy with failover. It will try each server
 // in order until one succeeds, or return an error if all fail.
+//
+// Servers can also be plain DNS or DNS over TLS servers, given as URLs such as
+// "udp://10.0.0.2:53" or "tls://1.1.1.1:853", as accepted by [ParseUpstream].
+//
+// Use [NewProxy] for other strategies, such as racing all servers at once.
 func Forwarder(httpClient *http.Client, serverURLs ...string) Handler {
-	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
-		for _, serverURL := range serverURLs {
-			respMsg, err := Query(r.Context(), httpClient, serverURL, req)
-			if err == nil {
-				return respMsg, nil
-			}
-		}
-
-		return nil, ErrForwarderFailed
-	}
+	return NewProxy(ProxyOptions{HTTPClient: httpClient}, serverURLs...).Handler()
 }
@@ -3,10 +3,13 @@ package doh_test
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/go-cleanhttp"
@@ -196,6 +199,89 @@ func TestNewServer(t *testing.T) {
 	})
 }
 
+func TestNewServer_CacheControl(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 60,
+	}
+
+	tests := []struct {
+		name    string
+		handler doh.Handler
+		want    string
+	}{
+		{
+			name: "minimum ttl",
+			handler: func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				resp := new(dns.Msg).SetReply(req)
+				resp.Answer = []dns.RR{
+					&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600}, Target: "example.com."},
+					&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IPv4(192, 0, 2, 1)},
+				}
+				return resp, nil
+			},
+			want: "max-age=120",
+		},
+		{
+			name: "negative answer",
+			handler: func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				resp := new(dns.Msg).SetRcode(req, dns.RcodeNameError)
+				resp.Ns = []dns.RR{soa}
+				return resp, nil
+			},
+			want: "max-age=60",
+		},
+		{
+			name: "server failure",
+			handler: func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure), nil
+			},
+			want: "no-store",
+		},
+		{
+			name: "handler override",
+			handler: func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				w.Header().Set("Cache-Control", "max-age=5")
+				return testAnswerHandler(w, r, req)
+			},
+			want: "max-age=5",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+
+			rec := httptest.NewRecorder()
+
+			doh.NewServerMux(test.handler).ServeHTTP(rec, req)
+
+			resp := rec.Result()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status code %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			if got := resp.Header.Get("Cache-Control"); got != test.want {
+				t.Errorf("got Cache-Control %q, want %q", got, test.want)
+			}
+
+			for _, header := range []string{"ETag", "Last-Modified"} {
+				if resp.Header.Get(header) != "" {
+					t.Errorf("got unexpected %s header", header)
+				}
+			}
+		})
+	}
+}
+
 func TestForwarder(t *testing.T) {
 	mux := doh.NewServerMux(doh.Forwarder(cleanhttp.DefaultClient(), doh.Google))
 
@@ -230,3 +316,424 @@ func TestForwarder(t *testing.T) {
 		t.Logf("answer: %s", answer.String())
 	}
 }
+
+func TestServer_MaxRequestSize(t *testing.T) {
+	server := doh.NewHandler(testAnswerHandler, doh.ServerOptions{
+		MaxRequestSize: 64,
+	})
+
+	small, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large, err := new(dns.Msg).SetQuestion(strings.Repeat("a", 63)+".example.com.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := new(dns.Msg).SetReply(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newGet := func(b []byte) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	}
+
+	newPost := func(b []byte) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/dns-message")
+		return req
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{
+			name: "small GET",
+			req:  newGet(small),
+			want: http.StatusOK,
+		},
+		{
+			name: "small POST",
+			req:  newPost(small),
+			want: http.StatusOK,
+		},
+		{
+			name: "large GET",
+			req:  newGet(large),
+			want: http.StatusRequestURITooLong,
+		},
+		{
+			name: "large POST",
+			req:  newPost(large),
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "large POST with unknown length",
+			req: func() *http.Request {
+				req := newPost(large)
+				req.ContentLength = -1
+				return req
+			}(),
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "truncated message",
+			req:  newPost(small[:8]),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "response message",
+			req:  newPost(response),
+			want: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			server.ServeHTTP(rec, test.req)
+
+			if rec.Code != test.want {
+				t.Errorf("got status code %d, want %d", rec.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	b, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotErrs []error
+
+	handler := doh.NewHandler(testAnswerHandler, doh.ServerOptions{
+		Path:    "/tenant-a/dns-query",
+		Methods: []string{http.MethodPost},
+		OnError: func(r *http.Request, err error) {
+			gotErrs = append(gotErrs, err)
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	newPost := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/dns-message")
+		return req
+	}
+
+	tests := []struct {
+		name      string
+		req       *http.Request
+		want      int
+		wantAllow string
+	}{
+		{
+			name: "custom path",
+			req:  newPost("/tenant-a/dns-query"),
+			want: http.StatusOK,
+		},
+		{
+			name: "other path",
+			req:  newPost("/dns-query"),
+			want: http.StatusNotFound,
+		},
+		{
+			name:      "disallowed method",
+			req:       httptest.NewRequest(http.MethodGet, "/tenant-a/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil),
+			want:      http.StatusMethodNotAllowed,
+			wantAllow: http.MethodPost,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, test.req)
+
+			if rec.Code != test.want {
+				t.Errorf("got status code %d, want %d", rec.Code, test.want)
+			}
+
+			if got := rec.Header().Get("Allow"); got != test.wantAllow {
+				t.Errorf("got Allow header %q, want %q", got, test.wantAllow)
+			}
+		})
+	}
+
+	if len(gotErrs) != 2 {
+		t.Errorf("got %d errors reported, want 2: %v", len(gotErrs), gotErrs)
+	}
+}
+
+func TestServer_HandlerError(t *testing.T) {
+	var (
+		gotErr error
+		logs   bytes.Buffer
+	)
+
+	handler := doh.NewHandler(func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return nil, &doh.ForwarderError{
+			Errors: []*doh.UpstreamError{
+				{URL: "https://dns.example/dns-query", Err: doh.ErrFailedHTTPRequest},
+			},
+		}
+	}, doh.ServerOptions{
+		OnError: func(r *http.Request, err error) {
+			gotErr = err
+		},
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+
+	tests := []struct {
+		name    string
+		edns    bool
+		wantEDE bool
+	}{
+		{
+			name: "without edns",
+		},
+		{
+			name:    "with edns",
+			edns:    true,
+			wantEDE: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotErr = nil
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			if test.edns {
+				req.SetEdns0(1232, false)
+			}
+
+			b, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status code %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			var resp dns.Msg
+			if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Rcode != dns.RcodeServerFailure {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[dns.RcodeServerFailure])
+			}
+
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+
+			var ede *dns.EDNS0_EDE
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, option := range opt.Option {
+					if option, ok := option.(*dns.EDNS0_EDE); ok {
+						ede = option
+					}
+				}
+			}
+
+			if (ede != nil) != test.wantEDE {
+				t.Fatalf("got extended error %v, want %v", ede, test.wantEDE)
+			}
+
+			if ede != nil && ede.InfoCode != dns.ExtendedErrorCodeNoReachableAuthority {
+				t.Errorf("got info code %d, want %d", ede.InfoCode, dns.ExtendedErrorCodeNoReachableAuthority)
+			}
+
+			if !errors.Is(gotErr, doh.ErrForwarderFailed) {
+				t.Errorf("got reported error %v, want %v", gotErr, doh.ErrForwarderFailed)
+			}
+		})
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.Contains(line, "level=ERROR") || !strings.Contains(line, "rcode=SERVFAIL") || strings.Contains(line, "status=") {
+			t.Errorf("got log line %q, want an error with the SERVFAIL rcode and no HTTP status", line)
+		}
+	}
+}
+
+func TestServer_Padding(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        doh.ServerOptions
+		padQuery    bool
+		wantPadding bool
+	}{
+		{
+			name:        "padded query",
+			padQuery:    true,
+			wantPadding: true,
+		},
+		{
+			name:        "unpadded query",
+			padQuery:    false,
+			wantPadding: false,
+		},
+		{
+			name:        "disabled",
+			opts:        doh.ServerOptions{DisablePadding: true},
+			padQuery:    true,
+			wantPadding: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := doh.NewHandler(testAnswerHandler, test.opts)
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+			if test.padQuery {
+				req.SetEdns0(1232, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+			}
+
+			b, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status code %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			var resp dns.Msg
+			if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(resp.Answer))
+			}
+
+			if got := testHasPadding(&resp); got != test.wantPadding {
+				t.Errorf("got padding %v, want %v", got, test.wantPadding)
+			}
+
+			if test.wantPadding && rec.Body.Len()%doh.ResponsePaddingBlockSize != 0 {
+				t.Errorf("got response length %d, want a multiple of %d", rec.Body.Len(), doh.ResponsePaddingBlockSize)
+			}
+		})
+	}
+}
+
+func TestProxy_Padding(t *testing.T) {
+	upstream := newTestUpstream(t, 0, false)
+
+	// The proxy's client pads every query it forwards, so the upstream's
+	// responses are padded too.
+	proxy := doh.NewProxy(doh.ProxyOptions{}, upstream.url)
+
+	front := httptest.NewServer(doh.NewServerMux(proxy.Handler()))
+	t.Cleanup(front.Close)
+
+	stubAddr := testStubResolver(t, proxy.Handler())
+
+	exchanges := map[string]func(t *testing.T, req *dns.Msg) *dns.Msg{
+		"doh": func(t *testing.T, req *dns.Msg) *dns.Msg {
+			b, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			httpResp, err := http.Get(front.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer httpResp.Body.Close()
+
+			body, err := io.ReadAll(httpResp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := new(dns.Msg)
+			if err := resp.Unpack(body); err != nil {
+				t.Fatal(err)
+			}
+
+			return resp
+		},
+		"stub": func(t *testing.T, req *dns.Msg) *dns.Msg {
+			resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(req, stubAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return resp
+		},
+	}
+
+	tests := []struct {
+		name        string
+		edns        bool
+		padQuery    bool
+		wantPadding bool
+	}{
+		{
+			name: "no edns",
+		},
+		{
+			name: "edns",
+			edns: true,
+		},
+		{
+			name:        "padded query",
+			edns:        true,
+			padQuery:    true,
+			wantPadding: true,
+		},
+	}
+
+	for transport, exchange := range exchanges {
+		for _, test := range tests {
+			t.Run(transport+" "+test.name, func(t *testing.T) {
+				req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+				if test.edns {
+					req.SetEdns0(1232, false)
+				}
+				if test.padQuery {
+					req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+				}
+
+				resp := exchange(t, req)
+
+				if len(resp.Answer) != 1 {
+					t.Errorf("got %d answers, want 1", len(resp.Answer))
+				}
+
+				if got := resp.IsEdns0() != nil; got != test.edns {
+					t.Errorf("got OPT record %v, want %v", got, test.edns)
+				}
+
+				if got := testHasPadding(resp); got != test.wantPadding {
+					t.Errorf("got padding %v, want %v", got, test.wantPadding)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultStubTimeout is the default maximum time a [StubResolver] waits
+// for its handler to answer a query.
+const DefaultStubTimeout = 5 * time.Second
+
+// StubOptions configures a [StubResolver].
+type StubOptions struct {
+	// Timeout is the maximum time to wait for the handler to answer each
+	// query. If zero, DefaultStubTimeout is used.
+	Timeout time.Duration
+
+	// Logger is used to log failed queries. If nil, nothing is logged.
+	Logger *slog.Logger
+}
+
+// StubResolver is a plain DNS server over UDP and TCP, which answers
+// queries with a DoH [Handler], such as a [Proxy] handler, so that local
+// applications that only speak plain DNS can use encrypted DNS.
+//
+// Handlers are called with a synthesized POST request for [DefaultPath],
+// whose RemoteAddr is the address of the DNS client, and a response writer
+// that discards anything written to it.
+type StubResolver struct {
+	// Handler handles the DNS requests received by the stub resolver.
+	Handler Handler
+
+	StubOptions
+}
+
+// NewStubResolver returns a stub resolver that answers queries with the
+// given handler, configured with the given options.
+func NewStubResolver(handler Handler, opts StubOptions) *StubResolver {
+	return &StubResolver{
+		Handler:     handler,
+		StubOptions: opts,
+	}
+}
+
+// ListenAndServe listens on the given address for both UDP and TCP, and
+// serves DNS queries until the context is canceled. If the address has no
+// port, or port 0, the same port is used for both protocols.
+func (s *StubResolver) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// Use the port chosen for TCP, in case it was picked by the system.
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	return s.Serve(ctx, pc, ln)
+}
+
+// Serve serves DNS queries received on the given UDP connection and TCP
+// listener until the context is canceled, or either fails, closing both
+// when it returns.
+func (s *StubResolver) Serve(ctx context.Context, pc net.PacketConn, ln net.Listener) error {
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: s},
+		{Listener: ln, Handler: s},
+	}
+
+	started := make(chan struct{}, len(servers))
+	errs := make(chan error, len(servers))
+
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() { started <- struct{}{} }
+
+		go func() {
+			errs <- server.ActivateAndServe()
+		}()
+	}
+
+	// Wait for both servers to start, so that they can be shut down.
+	for range servers {
+		select {
+		case <-started:
+		case err := <-errs:
+			pc.Close()
+			ln.Close()
+			return err
+		}
+	}
+
+	var err error
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	for _, server := range servers {
+		server.Shutdown()
+	}
+
+	return err
+}
+
+// ServeDNS implements the [dns.Handler] interface, answering the query with
+// the stub resolver's handler, and truncating UDP responses that don't fit
+// the client's advertised message size.
+func (s *StubResolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := s.answer(w.RemoteAddr(), req)
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = max(size, int(opt.UDPSize()))
+		}
+
+		resp.Truncate(size)
+	} else {
+		resp.Compress = true
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		s.report(w.RemoteAddr(), req, fmt.Errorf("doh: failed to write stub response: %w", err))
+	}
+}
+
+// answer returns the handler's response to the query, or an error response
+// if the query is invalid or the handler fails.
+func (s *StubResolver) answer(remoteAddr net.Addr, req *dns.Msg) *dns.Msg {
+	if req.Response || len(req.Question) == 0 {
+		return newErrorResponse(req, dns.RcodeFormatError, dns.ExtendedErrorCodeOther, "")
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultStubTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := callHandler(ctx, s.Handler, remoteAddr, req)
+	if err != nil {
+		s.report(remoteAddr, req, err)
+		return newErrorResponse(req, dns.RcodeServerFailure, extendedErrorCode(err), "")
+	}
+
+	// The response is copied before it's modified to be written, since
+	// handlers may return messages that are shared, such as cached responses.
+	resp = resp.Copy()
+	resp.Id = req.Id
+
+	return resp
+}
+
+// callHandler calls the DoH handler with a DNS query received over another
+// transport, such as plain DNS, using a synthesized POST request from the
+// given remote address, and a response writer that discards its output.
+// EDNS(0) parts of the response that the query didn't ask for are removed.
+// The response may be shared with other queries, so callers must copy it
+// before modifying it.
+func callHandler(ctx context.Context, handler Handler, remoteAddr net.Addr, req *dns.Msg) (*dns.Msg, error) {
+	httpReq := (&http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: DefaultPath},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: remoteAddr.String(),
+	}).WithContext(ctx)
+
+	resp, err := handler(&discardResponseWriter{}, httpReq, req)
+	if err == nil && resp == nil {
+		err = errors.New("doh: handler returned no response")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return trimResponseEDNS(req, resp), nil
+}
+
+// report logs the given error for the query, if a logger is configured.
+func (s *StubResolver) report(remoteAddr net.Addr, req *dns.Msg, err error) {
+	if s.Logger == nil {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("remote_addr", remoteAddr.String()),
+		slog.String("error", err.Error()),
+	}
+
+	if len(req.Question) > 0 {
+		attrs = append(attrs, slog.String("name", req.Question[0].Name))
+	}
+
+	s.Logger.LogAttrs(context.Background(), slog.LevelError, "dns query failed", attrs...)
+}
@@ -0,0 +1,169 @@
+package doh_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testStubResolver starts a stub resolver with the given handler on a local
+// address, returning the address.
+func testStubResolver(t *testing.T, handler doh.Handler) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := doh.NewStubResolver(handler, doh.StubOptions{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stub.Serve(ctx, pc, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("stub resolver did not shut down")
+		}
+	})
+
+	return ln.Addr().String()
+}
+
+func TestStubResolver(t *testing.T) {
+	failing := newTestUpstream(t, 0, true)
+	working := newTestUpstream(t, 0, false)
+
+	proxy := doh.NewProxy(doh.ProxyOptions{}, failing.url, working.url)
+
+	addr := testStubResolver(t, proxy.Handler())
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			client := &dns.Client{Net: network}
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+
+			resp, _, err := client.Exchange(req, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+
+			if resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("got rcode %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(resp.Answer))
+			}
+		})
+	}
+
+	if failing.queries.Load() == 0 {
+		t.Error("failing upstream was never tried")
+	}
+}
+
+func TestStubResolver_Truncate(t *testing.T) {
+	// The handler returns the same response to every query, like a cache
+	// would, which must not be modified by the stub resolver.
+	shared := new(dns.Msg).SetReply(new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	for i := range 20 {
+		shared.Answer = append(shared.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("%d %s", i, strings.Repeat("x", 100))},
+		})
+	}
+
+	sharedID := shared.Id
+
+	addr := testStubResolver(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		return shared, nil
+	})
+
+	tests := []struct {
+		name          string
+		network       string
+		udpSize       uint16
+		wantTruncated bool
+	}{
+		{name: "udp", network: "udp", wantTruncated: true},
+		{name: "udp edns", network: "udp", udpSize: 4096, wantTruncated: false},
+		{name: "tcp", network: "tcp", wantTruncated: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &dns.Client{Net: test.network, UDPSize: test.udpSize}
+
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+			if test.udpSize > 0 {
+				req.SetEdns0(test.udpSize, false)
+			}
+
+			resp, _, err := client.Exchange(req, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Truncated != test.wantTruncated {
+				t.Errorf("got truncated %v, want %v", resp.Truncated, test.wantTruncated)
+			}
+
+			if !test.wantTruncated && len(resp.Answer) != 20 {
+				t.Errorf("got %d answers, want 20", len(resp.Answer))
+			}
+
+			if resp.Id != req.Id {
+				t.Errorf("got id %d, want %d", resp.Id, req.Id)
+			}
+		})
+	}
+
+	if len(shared.Answer) != 20 || shared.Truncated || shared.Compress || shared.Id != sharedID {
+		t.Error("got handler's response modified by the stub resolver")
+	}
+}
+
+func TestStubResolver_HandlerError(t *testing.T) {
+	failing := newTestUpstream(t, 0, true)
+
+	addr := testStubResolver(t, doh.NewProxy(doh.ProxyOptions{}, failing.url).Handler())
+
+	resp, _, err := new(dns.Client).Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got rcode %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+}
@@ -0,0 +1,185 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrUnsupportedUpstream is returned when an upstream URL has a scheme
+	// that is not supported.
+	ErrUnsupportedUpstream = errors.New("doh: unsupported upstream")
+
+	// ErrFailedDNSExchange is returned when a plain DNS, DNS-over-TLS, or
+	// DNS-over-QUIC exchange with an upstream fails.
+	ErrFailedDNSExchange = errors.New("doh: failed to exchange DNS message")
+)
+
+// Upstream is a DNS server that a [Proxy] forwards queries to, such as a
+// DoH [Client], a [DNSUpstream], or a [QUICUpstream].
+type Upstream interface {
+	// Exchange sends the DNS request to the upstream, returning its
+	// response.
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+
+	// String returns the address of the upstream, used in errors and
+	// status reports.
+	String() string
+}
+
+// DNSUpstream is an [Upstream] speaking plain DNS over UDP or TCP, or DNS
+// over TLS (DoT) as defined in [RFC 7858], which can be used to forward
+// queries to resolvers that don't support DoH.
+//
+// [RFC 7858]: https://datatracker.ietf.org/doc/html/rfc7858
+type DNSUpstream struct {
+	// Network is "udp", "tcp", or "tcp-tls" for DNS over TLS.
+	Network string
+
+	// Addr is the host and port of the DNS server.
+	Addr string
+
+	// TLSConfig is used for DNS over TLS. If nil, the default configuration
+	// is used, verifying the server's certificate for the host of Addr.
+	TLSConfig *tls.Config
+}
+
+// Exchange sends the DNS request to the upstream, returning its response.
+// Truncated UDP responses are retried over TCP.
+//
+// The request is sent with a random ID, since DoH clients use ID 0 as
+// recommended by [RFC 8484 section 4.1], which would leave the source port as
+// the only protection against spoofed responses. The response has the ID of
+// the given request.
+//
+// [RFC 8484 section 4.1]: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+func (u *DNSUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	msg := req.Copy()
+	msg.Id = dns.Id()
+
+	resp, err := u.exchange(ctx, u.Network, msg)
+	if err == nil && resp.Truncated && u.Network == "udp" {
+		resp, err = u.exchange(ctx, "tcp", msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Id = req.Id
+
+	return resp, nil
+}
+
+// exchange sends the DNS request to the upstream over the given network.
+func (u *DNSUpstream) exchange(ctx context.Context, network string, req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:       network,
+		TLSConfig: u.TLSConfig,
+	}
+
+	if network == "tcp-tls" && client.TLSConfig == nil {
+		host, _, err := net.SplitHostPort(u.Addr)
+		if err != nil {
+			host = u.Addr
+		}
+
+		client.TLSConfig = &tls.Config{
+			ServerName: host,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, req, u.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailedDNSExchange, err)
+	}
+
+	return resp, nil
+}
+
+// String returns the URL of the upstream, as accepted by [ParseUpstream].
+func (u *DNSUpstream) String() string {
+	scheme := u.Network
+	if scheme == "tcp-tls" {
+		scheme = "tls"
+	}
+
+	return scheme + "://" + u.Addr
+}
+
+// ParseUpstream returns the upstream for the given URL, which is one of:
+//
+//   - a DoH server URL, such as "https://dns.google/dns-query", using the
+//     given HTTP client, or a pooled client if nil
+//   - a plain DNS server over UDP, such as "udp://10.0.0.2:53"
+//   - a plain DNS server over TCP, such as "tcp://10.0.0.2:53"
+//   - a DNS over TLS server, such as "tls://1.1.1.1:853"
+//   - a DNS over QUIC server, such as "quic://dns.adguard-dns.com:853"
+//
+// The port defaults to 53 for plain DNS, and 853 for DNS over TLS or QUIC.
+func ParseUpstream(rawURL string, httpClient *http.Client) (Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedUpstream, err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: missing host in %q", ErrUnsupportedUpstream, rawURL)
+	}
+
+	switch u.Scheme {
+	case "https", "http":
+		return NewClient(WithHTTPClient(httpClient), WithServers(rawURL)), nil
+	case "udp", "tcp":
+		return &DNSUpstream{
+			Network: u.Scheme,
+			Addr:    hostWithDefaultPort(u, "53"),
+		}, nil
+	case "tls":
+		return &DNSUpstream{
+			Network: "tcp-tls",
+			Addr:    hostWithDefaultPort(u, "853"),
+		}, nil
+	case "quic":
+		return &QUICUpstream{
+			Addr: hostWithDefaultPort(u, "853"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme in %q", ErrUnsupportedUpstream, rawURL)
+	}
+}
+
+// hostWithDefaultPort returns the host and port of the URL, using the given
+// port if the URL has none.
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// errorUpstream is an upstream that always fails with an error, used for
+// upstream URLs that can't be parsed, so that the error is reported for
+// each query.
+type errorUpstream struct {
+	url string
+	err error
+}
+
+// Exchange implements the Upstream interface.
+func (u *errorUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, u.err
+}
+
+// String implements the Upstream interface.
+func (u *errorUpstream) String() string {
+	return u.url
+}
@@ -0,0 +1,340 @@
+package doh_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testCertificate returns a self-signed TLS certificate for the loopback
+// addresses, and a pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// testDNSServer starts a plain DNS server on the given network answering
+// with the given handler, returning its address.
+func testDNSServer(t *testing.T, network string, handler dns.HandlerFunc, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	server := &dns.Server{Handler: handler}
+
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+	case "tcp":
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = ln
+	case "tcp-tls":
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = ln
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+
+	go server.ActivateAndServe()
+
+	<-started
+
+	t.Cleanup(func() { server.Shutdown() })
+
+	if server.PacketConn != nil {
+		return server.PacketConn.LocalAddr().String()
+	}
+
+	return server.Listener.Addr().String()
+}
+
+// testDNSHandler answers A queries with a single record, and TXT queries
+// with a response too large for UDP without EDNS(0).
+func testDNSHandler(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg).SetReply(req)
+
+	q := req.Question[0]
+
+	switch q.Qtype {
+	case dns.TypeA:
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+	case dns.TypeTXT:
+		for i := range 20 {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{fmt.Sprintf("%d %s", i, strings.Repeat("x", 100))},
+			})
+		}
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		resp.Truncate(dns.MinMsgSize)
+	}
+
+	w.WriteMsg(resp)
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantErr error
+	}{
+		{url: "https://dns.google/dns-query", want: "https://dns.google/dns-query"},
+		{url: "udp://10.0.0.2", want: "udp://10.0.0.2:53"},
+		{url: "udp://10.0.0.2:5353", want: "udp://10.0.0.2:5353"},
+		{url: "tcp://[fd00::2]", want: "tcp://[fd00::2]:53"},
+		{url: "tls://1.1.1.1", want: "tls://1.1.1.1:853"},
+		{url: "tls://dns.example:8853", want: "tls://dns.example:8853"},
+		{url: "quic://dns.example", want: "quic://dns.example:853"},
+		{url: "ftp://dns.example", wantErr: doh.ErrUnsupportedUpstream},
+		{url: "dns.example", wantErr: doh.ErrUnsupportedUpstream},
+		{url: "udp://", wantErr: doh.ErrUnsupportedUpstream},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			upstream, err := doh.ParseUpstream(test.url, nil)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := upstream.String(); got != test.want {
+				t.Errorf("got upstream %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDNSUpstream(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	udpAddr := testDNSServer(t, "udp", testDNSHandler, nil)
+
+	tests := []struct {
+		name     string
+		upstream *doh.DNSUpstream
+	}{
+		{
+			name:     "udp",
+			upstream: &doh.DNSUpstream{Network: "udp", Addr: udpAddr},
+		},
+		{
+			name:     "tcp",
+			upstream: &doh.DNSUpstream{Network: "tcp", Addr: testDNSServer(t, "tcp", testDNSHandler, nil)},
+		},
+		{
+			name: "tls",
+			upstream: &doh.DNSUpstream{
+				Network:   "tcp-tls",
+				Addr:      testDNSServer(t, "tcp-tls", testDNSHandler, &tls.Config{Certificates: []tls.Certificate{cert}}),
+				TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+
+			resp, err := test.upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(resp.Answer) != 1 {
+				t.Errorf("got %d answers, want 1", len(resp.Answer))
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		ctx := testContext(t)
+
+		// The TCP server listens on the same port as the UDP server, so that
+		// truncated responses are retried against it.
+		ln, err := net.Listen("tcp", udpAddr)
+		if err != nil {
+			t.Skipf("can't listen on the udp server's port over tcp: %v", err)
+		}
+
+		started := make(chan struct{})
+
+		server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(testDNSHandler), NotifyStartedFunc: func() { close(started) }}
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+
+		upstream := &doh.DNSUpstream{Network: "udp", Addr: udpAddr}
+
+		resp, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Truncated {
+			t.Error("got truncated response")
+		}
+
+		if len(resp.Answer) != 20 {
+			t.Errorf("got %d answers, want 20", len(resp.Answer))
+		}
+	})
+
+	t.Run("random id", func(t *testing.T) {
+		ctx := testContext(t)
+
+		gotIDs := make(chan uint16, 3)
+
+		addr := testDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+			gotIDs <- req.Id
+			testDNSHandler(w, req)
+		}, nil)
+
+		upstream := &doh.DNSUpstream{Network: "udp", Addr: addr}
+
+		for range 3 {
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			req.Id = 0
+
+			resp, err := upstream.Exchange(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Id != 0 {
+				t.Errorf("got response id %d, want 0", resp.Id)
+			}
+
+			if req.Id != 0 {
+				t.Errorf("got request id %d changed, want 0", req.Id)
+			}
+		}
+
+		var ids []uint16
+		for range 3 {
+			ids = append(ids, <-gotIDs)
+		}
+
+		if !slices.ContainsFunc(ids, func(id uint16) bool { return id != 0 }) {
+			t.Errorf("got upstream ids %v, want random ids", ids)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		ctx := testContext(t)
+
+		upstream := &doh.DNSUpstream{Network: "tcp", Addr: freeTCPAddr(t)}
+
+		_, err := upstream.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if !errors.Is(err, doh.ErrFailedDNSExchange) {
+			t.Errorf("got error %v, want %v", err, doh.ErrFailedDNSExchange)
+		}
+	})
+}
+
+// freeTCPAddr returns a local TCP address that nothing is listening on.
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestProxy_MixedUpstreams(t *testing.T) {
+	ctx := testContext(t)
+
+	failing := newTestUpstream(t, 0, true)
+
+	dnsAddr := testDNSServer(t, "tcp", testDNSHandler, nil)
+
+	proxy := doh.NewProxy(doh.ProxyOptions{}, "ftp://invalid.example", failing.url, "tcp://"+dnsAddr)
+
+	resp, err := proxy.Exchange(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 {
+		t.Errorf("got %d answers, want 1", len(resp.Answer))
+	}
+
+	statuses := proxy.Status()
+
+	if len(statuses) != 3 {
+		t.Fatalf("got %d statuses, want 3", len(statuses))
+	}
+
+	if statuses[2].URL != "tcp://"+dnsAddr {
+		t.Errorf("got url %q, want %q", statuses[2].URL, "tcp://"+dnsAddr)
+	}
+
+	if !strings.Contains(statuses[0].LastError, doh.ErrUnsupportedUpstream.Error()) {
+		t.Errorf("got last error %q, want %q", statuses[0].LastError, doh.ErrUnsupportedUpstream)
+	}
+}
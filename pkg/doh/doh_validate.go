@@ -0,0 +1,1065 @@
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/dj"
+)
+
+var (
+	// ErrBogus is returned by a [Validator] for responses that fail DNSSEC
+	// validation.
+	ErrBogus = errors.New("doh: DNSSEC validation failed")
+
+	// ErrInvalidTrustAnchor is returned when trust anchors can't be parsed.
+	ErrInvalidTrustAnchor = errors.New("doh: invalid trust anchor")
+)
+
+// maxValidationQueries is the maximum number of queries sent to validate a
+// single response, which limits the work done for long chains of trust.
+const maxValidationQueries = 64
+
+// maxNSEC3Iterations is the maximum number of additional hash iterations of
+// the NSEC3 records of a response, above which the response is insecure, as
+// described in [RFC 9276 section 3.2], since every name checked against the
+// records is hashed that many times.
+//
+// [RFC 9276 section 3.2]: https://datatracker.ietf.org/doc/html/rfc9276#section-3.2
+const maxNSEC3Iterations = 150
+
+// RootTrustAnchors are the DS records of the root zone's key signing keys,
+// KSK-2017 and KSK-2024, as published by IANA at
+// https://data.iana.org/root-anchors/root-anchors.xml.
+var RootTrustAnchors = []dns.RR{
+	&dns.DS{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	},
+	&dns.DS{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	},
+}
+
+// ParseTrustAnchors parses DS or DNSKEY records in RFC 1035 zone file
+// format, such as a root.key file, for use as [ValidatorOptions]
+// TrustAnchors. Other records are ignored.
+func ParseTrustAnchors(r io.Reader) ([]dns.RR, error) {
+	zp := dns.NewZoneParser(r, ".", "")
+
+	var anchors []dns.RR
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, rr)
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTrustAnchor, err)
+	}
+
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%w: no DS or DNSKEY records", ErrInvalidTrustAnchor)
+	}
+
+	return anchors, nil
+}
+
+// ValidationStatus is the DNSSEC security status of a response, or of an
+// RRset in it, as defined in [RFC 4033 section 5].
+//
+// [RFC 4033 section 5]: https://datatracker.ietf.org/doc/html/rfc4033#section-5
+type ValidationStatus int
+
+const (
+	// ValidationIndeterminate means there is no trust anchor for the zone,
+	// or the response could not be validated, such as a SERVFAIL.
+	ValidationIndeterminate ValidationStatus = iota
+
+	// ValidationSecure means the chain of trust from a trust anchor to the
+	// records, or to the proof of their non-existence, is valid.
+	ValidationSecure
+
+	// ValidationInsecure means there is a proof that the zone is not
+	// signed, from a trust anchor to its unsigned delegation.
+	ValidationInsecure
+
+	// ValidationBogus means the chain of trust is broken, such as by a
+	// missing or invalid signature, or a missing proof of non-existence.
+	ValidationBogus
+)
+
+// String returns the name of the validation status.
+func (s ValidationStatus) String() string {
+	switch s {
+	case ValidationIndeterminate:
+		return "indeterminate"
+	case ValidationSecure:
+		return "secure"
+	case ValidationInsecure:
+		return "insecure"
+	case ValidationBogus:
+		return "bogus"
+	default:
+		return "unknown"
+	}
+}
+
+// rank orders the validation statuses from secure to bogus, so that the
+// status of a response is the worst status of its parts.
+func (s ValidationStatus) rank() int {
+	switch s {
+	case ValidationSecure:
+		return 0
+	case ValidationInsecure:
+		return 1
+	case ValidationIndeterminate:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Validation is the result of validating a DNS response with a [Validator].
+type Validation struct {
+	// Status is the worst status of the answer RRsets, and of the proof of
+	// non-existence for negative responses.
+	Status ValidationStatus
+
+	// Err is the reason the response is not secure, if any.
+	Err error
+
+	// Answers are the statuses of the RRsets in the answer section.
+	Answers []RRsetValidation
+}
+
+// RRsetValidation is the validation status of an RRset.
+type RRsetValidation struct {
+	Name   string
+	Type   uint16
+	Status ValidationStatus
+	Err    error
+}
+
+// update sets the status of the validation to the given status, if it is
+// worse than the current one.
+func (v *Validation) update(status ValidationStatus, err error) {
+	if status.rank() > v.Status.rank() {
+		v.Status = status
+		v.Err = err
+	}
+}
+
+// ValidatorOptions configures a [Validator].
+type ValidatorOptions struct {
+	// TrustAnchors are the DS or DNSKEY records of the zones whose keys are
+	// trusted, usually the root zone. If empty, RootTrustAnchors are used.
+	TrustAnchors []dns.RR
+
+	// Now returns the time at which signatures must be valid. If nil,
+	// time.Now is used.
+	Now func() time.Time
+}
+
+// Validator is an [Upstream] validating DNSSEC responses from another
+// upstream, such as a DoH [Client], itself, instead of trusting the
+// upstream's Authenticated Data (AD) bit.
+//
+// The chain of trust is followed from the signer of each answer up to a
+// trust anchor, by fetching the DNSKEY and DS records of each zone, as
+// described in [RFC 4035 section 5]. Negative responses are validated with
+// their NSEC or NSEC3 records, as described in [RFC 5155 section 8].
+//
+// Queries are sent with the DO and CD bits set, so that the upstream
+// returns the DNSSEC records of its answers, even if it fails to validate
+// them itself.
+//
+// [RFC 4035 section 5]: https://datatracker.ietf.org/doc/html/rfc4035#section-5
+// [RFC 5155 section 8]: https://datatracker.ietf.org/doc/html/rfc5155#section-8
+type Validator struct {
+	Upstream Upstream
+	ValidatorOptions
+}
+
+// NewValidator returns a new validator for responses from the upstream.
+func NewValidator(upstream Upstream, opts ValidatorOptions) *Validator {
+	return &Validator{
+		Upstream:         upstream,
+		ValidatorOptions: opts,
+	}
+}
+
+// Exchange sends the DNS request to the upstream, returning its validated
+// response, with the AD bit set if it is secure. Bogus responses fail with
+// ErrBogus, unless the request has the CD bit set.
+func (v *Validator) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, validation, err := v.Validate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if validation.Status == ValidationBogus && !req.CheckingDisabled {
+		return nil, fmt.Errorf("%w: %w", ErrBogus, validation.Err)
+	}
+
+	return resp, nil
+}
+
+// String returns the address of the upstream.
+func (v *Validator) String() string {
+	return v.Upstream.String()
+}
+
+// Validate sends the DNS request to the upstream, returning its response,
+// with the AD bit set if it is secure, and the result of its validation.
+// An error is only returned if the response can't be fetched.
+//
+// The given DNS message is not modified.
+func (v *Validator) Validate(ctx context.Context, req *dns.Msg) (*dns.Msg, *Validation, error) {
+	if len(req.Question) != 1 {
+		return nil, nil, fmt.Errorf("%w: %d questions", ErrFailedDNSExchange, len(req.Question))
+	}
+
+	query := req.Copy()
+	query.CheckingDisabled = true
+
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	resp, err := v.Upstream.Exchange(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &chain{
+		validator: v,
+		ctx:       ctx,
+		now:       time.Now(),
+		keys:      make(map[string]*zoneKeys),
+	}
+
+	if v.Now != nil {
+		c.now = v.Now()
+	}
+
+	validation := c.validate(req.Question[0], resp)
+
+	resp.AuthenticatedData = validation.Status == ValidationSecure
+
+	return resp, validation, nil
+}
+
+// SimpleQuery performs a DNS query using the dj (DNS JSON) format types
+// to represent the request and response, returning the result of its
+// validation.
+func (v *Validator) SimpleQuery(ctx context.Context, req *dj.Request) (*dj.Response, *Validation, error) {
+	dnsResp, validation, err := v.Validate(ctx, newDNSRequest(req))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newDJResponse(dnsResp), validation, nil
+}
+
+// trustAnchors returns the configured trust anchors, or the root trust
+// anchors if none are configured.
+func (v *Validator) trustAnchors() []dns.RR {
+	if len(v.TrustAnchors) > 0 {
+		return v.TrustAnchors
+	}
+	return RootTrustAnchors
+}
+
+// chain is the state of validating a single response, caching the keys of
+// the zones in its chain of trust.
+type chain struct {
+	validator *Validator
+	ctx       context.Context
+	now       time.Time
+	queries   int
+	keys      map[string]*zoneKeys
+}
+
+// zoneKeys are the validated DNSKEY records of a zone, or the reason there
+// are none.
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	status ValidationStatus
+	err    error
+}
+
+// validate returns the validation of the response to the question.
+func (c *chain) validate(q dns.Question, resp *dns.Msg) *Validation {
+	validation := &Validation{Status: ValidationSecure}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		validation.update(ValidationIndeterminate, fmt.Errorf("unexpected response code %s", dns.RcodeToString[resp.Rcode]))
+		return validation
+	}
+
+	name := dns.CanonicalName(q.Name)
+	answered := false
+
+	for _, rrset := range rrsets(resp.Answer) {
+		hdr := rrset[0].Header()
+		owner := dns.CanonicalName(hdr.Name)
+
+		signedOwner, signed, sigs := owner, rrset, rrsigs(resp.Answer, owner, hdr.Rrtype)
+
+		// CNAMEs synthesized from a DNAME are unsigned, and as secure as the
+		// DNAME they match, as described in RFC 6672 section 5.3.1.
+		if hdr.Rrtype == dns.TypeCNAME && len(sigs) == 0 {
+			if dname := synthesizingDNAME(resp.Answer, rrset[0].(*dns.CNAME)); dname != nil {
+				signedOwner = dns.CanonicalName(dname.Hdr.Name)
+				signed, sigs = []dns.RR{dname}, rrsigs(resp.Answer, signedOwner, dns.TypeDNAME)
+			}
+		}
+
+		status, sig, err := c.verify(signed, sigs, signedOwner)
+
+		// Answers synthesized from a wildcard must come with a proof that
+		// the name itself doesn't exist.
+		if status == ValidationSecure && int(sig.Labels) < dns.CountLabel(signedOwner) {
+			status, err = c.wildcardProof(resp, signedOwner, sig)
+		}
+
+		validation.Answers = append(validation.Answers, RRsetValidation{
+			Name:   hdr.Name,
+			Type:   hdr.Rrtype,
+			Status: status,
+			Err:    err,
+		})
+
+		validation.update(status, err)
+
+		if owner != name {
+			continue
+		}
+
+		switch {
+		case hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+			answered = true
+		case hdr.Rrtype == dns.TypeCNAME:
+			name = dns.CanonicalName(rrset[0].(*dns.CNAME).Target)
+		}
+	}
+
+	if !answered {
+		validation.update(c.denial(resp, name, q.Qtype))
+	}
+
+	return validation
+}
+
+// verify returns the status of the RRset owned by a name in the given zone,
+// and the signature it was verified with, if it is secure.
+func (c *chain) verify(rrset []dns.RR, sigs []*dns.RRSIG, zone string) (ValidationStatus, *dns.RRSIG, error) {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+
+	if len(sigs) == 0 {
+		status, err := c.unsigned(zone)
+		return status, nil, err
+	}
+
+	var (
+		errs []error
+
+		// The worst status of the signers whose keys aren't secure, which
+		// is only used if no other signature verifies.
+		keyStatus = ValidationSecure
+		keyErr    error
+	)
+
+	for _, sig := range sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+
+		// DS records are signed by the parent zone.
+		if !dns.IsSubDomain(signer, owner) || (rrset[0].Header().Rrtype == dns.TypeDS && signer == owner) {
+			errs = append(errs, fmt.Errorf("%s is not a valid signer for %s", signer, owner))
+			continue
+		}
+
+		keys := c.zoneKeys(signer)
+		if keys.status != ValidationSecure {
+			if keys.status.rank() > keyStatus.rank() {
+				keyStatus, keyErr = keys.status, keys.err
+			}
+			continue
+		}
+
+		if err := c.verifySignature(sig, keys.keys, rrset); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return ValidationSecure, sig, nil
+	}
+
+	if len(errs) == 0 {
+		return keyStatus, nil, keyErr
+	}
+
+	return ValidationBogus, nil, fmt.Errorf("no valid signature for %s %s: %w", owner, dns.Type(rrset[0].Header().Rrtype), errors.Join(append(errs, keyErr)...))
+}
+
+// verifySignature verifies the signature over the RRset with the matching
+// key, checking its validity period.
+func (c *chain) verifySignature(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	if !sig.ValidityPeriod(c.now) {
+		return fmt.Errorf("signature by key %d is expired or not yet valid", sig.KeyTag)
+	}
+
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+
+		if err := sig.Verify(key, rrset); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature by key %d does not verify", sig.KeyTag)
+}
+
+// unsigned returns the status of unsigned records owned by the name, which
+// are insecure if their zone is, and bogus if their zone is signed.
+func (c *chain) unsigned(name string) (ValidationStatus, error) {
+	zone, err := c.zoneOf(name)
+	if err != nil {
+		return ValidationBogus, err
+	}
+
+	keys := c.zoneKeys(zone)
+	if keys.status == ValidationSecure {
+		return ValidationBogus, fmt.Errorf("missing signatures for %s in signed zone %s", name, zone)
+	}
+
+	return keys.status, keys.err
+}
+
+// zoneOf returns the zone containing the name, from the owner of the SOA
+// record returned for it. The zone isn't trusted until its keys, or its
+// unsigned delegation, are validated.
+func (c *chain) zoneOf(name string) (string, error) {
+	resp, err := c.query(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(dns.CanonicalName(soa.Hdr.Name), name) {
+			return dns.CanonicalName(soa.Hdr.Name), nil
+		}
+	}
+
+	return "", fmt.Errorf("no zone found for %s", name)
+}
+
+// zoneKeys returns the validated keys of the zone, following its chain of
+// trust up to a trust anchor.
+func (c *chain) zoneKeys(zone string) *zoneKeys {
+	if keys, ok := c.keys[zone]; ok {
+		return keys
+	}
+
+	// Guard against loops while the chain of trust is followed.
+	c.keys[zone] = &zoneKeys{status: ValidationBogus, err: fmt.Errorf("loop in chain of trust at %s", zone)}
+
+	keys := c.fetchZoneKeys(zone)
+
+	c.keys[zone] = keys
+
+	return keys
+}
+
+// fetchZoneKeys fetches and validates the keys of the zone, with the DS
+// records from its parent zone, or the trust anchors of the zone.
+func (c *chain) fetchZoneKeys(zone string) *zoneKeys {
+	var anchors, parents []dns.RR
+
+	for _, anchor := range c.validator.trustAnchors() {
+		switch owner := dns.CanonicalName(anchor.Header().Name); {
+		case owner == zone:
+			anchors = append(anchors, anchor)
+		case dns.IsSubDomain(owner, zone):
+			parents = append(parents, anchor)
+		}
+	}
+
+	if len(anchors) > 0 {
+		return c.fetchDNSKEY(zone, anchors)
+	}
+
+	if len(parents) == 0 || zone == "." {
+		return &zoneKeys{status: ValidationIndeterminate, err: fmt.Errorf("no trust anchor for %s", zone)}
+	}
+
+	resp, err := c.query(zone, dns.TypeDS)
+	if err != nil {
+		return &zoneKeys{status: ValidationBogus, err: err}
+	}
+
+	var dsSet []dns.RR
+
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && dns.CanonicalName(rr.Header().Name) == zone {
+			dsSet = append(dsSet, rr)
+		}
+	}
+
+	if len(dsSet) == 0 {
+		status, err := c.insecureDelegation(resp, zone)
+		return &zoneKeys{status: status, err: err}
+	}
+
+	status, _, err := c.verify(dsSet, rrsigs(resp.Answer, zone, dns.TypeDS), parentZone(zone))
+	if status != ValidationSecure {
+		return &zoneKeys{status: status, err: err}
+	}
+
+	var supported []dns.RR
+
+	for _, rr := range dsSet {
+		if supportedDS(rr.(*dns.DS)) {
+			supported = append(supported, rr)
+		}
+	}
+
+	// Zones only signed with unsupported algorithms are treated as
+	// unsigned, as described in RFC 4035 section 5.2.
+	if len(supported) == 0 {
+		return &zoneKeys{status: ValidationInsecure, err: fmt.Errorf("no supported DS records for %s", zone)}
+	}
+
+	return c.fetchDNSKEY(zone, supported)
+}
+
+// fetchDNSKEY fetches the DNSKEY records of the zone, which are valid if
+// they are signed by a key matching one of the given DS or DNSKEY records.
+func (c *chain) fetchDNSKEY(zone string, anchors []dns.RR) *zoneKeys {
+	resp, err := c.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return &zoneKeys{status: ValidationBogus, err: err}
+	}
+
+	var (
+		keySet []dns.RR
+		keys   []*dns.DNSKEY
+	)
+
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && dns.CanonicalName(key.Hdr.Name) == zone {
+			keySet = append(keySet, key)
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return &zoneKeys{status: ValidationBogus, err: fmt.Errorf("no DNSKEY records for %s", zone)}
+	}
+
+	var trusted []*dns.DNSKEY
+
+	for _, key := range keys {
+		for _, anchor := range anchors {
+			if matchesAnchor(key, anchor) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+
+	if len(trusted) == 0 {
+		return &zoneKeys{status: ValidationBogus, err: fmt.Errorf("no DNSKEY of %s matches its DS records", zone)}
+	}
+
+	sigs := rrsigs(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(sigs) == 0 {
+		return &zoneKeys{status: ValidationBogus, err: fmt.Errorf("no signatures for %s DNSKEY", zone)}
+	}
+
+	var errs []error
+
+	for _, sig := range sigs {
+		if err := c.verifySignature(sig, trusted, keySet); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return &zoneKeys{keys: keys, status: ValidationSecure}
+	}
+
+	return &zoneKeys{status: ValidationBogus, err: fmt.Errorf("no valid signature for %s DNSKEY: %w", zone, errors.Join(errs...))}
+}
+
+// insecureDelegation returns whether the negative response to a DS query
+// proves that the zone is an unsigned delegation from a signed parent zone,
+// as described in RFC 4035 section 5.2.
+func (c *chain) insecureDelegation(resp *dns.Msg, zone string) (ValidationStatus, error) {
+	status, nsecs, nsec3s, err := c.authority(resp, parentZone(zone))
+	if status != ValidationSecure {
+		return status, err
+	}
+
+	delegation := func(types []uint16) bool {
+		return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeDS) && !hasType(types, dns.TypeSOA)
+	}
+
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == zone && delegation(nsec.TypeBitMap) {
+			return ValidationInsecure, fmt.Errorf("%s is an unsigned delegation", zone)
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(zone) && delegation(nsec3.TypeBitMap) {
+			return ValidationInsecure, fmt.Errorf("%s is an unsigned delegation", zone)
+		}
+	}
+
+	// An opt-out NSEC3 record covering the delegation means it may be
+	// unsigned, as described in RFC 5155 section 8.6.
+	if _, cover, ok := closestEncloserProof(nsec3s, zone); ok && cover.Flags&1 == 1 {
+		return ValidationInsecure, fmt.Errorf("%s is an opt-out delegation", zone)
+	}
+
+	return ValidationBogus, fmt.Errorf("no proof that %s is unsigned", zone)
+}
+
+// denial returns the status of the proof that the name, or its records of
+// the given type, don't exist, from the authority section of the response.
+func (c *chain) denial(resp *dns.Msg, name string, qtype uint16) (ValidationStatus, error) {
+	status, nsecs, nsec3s, err := c.authority(resp, name)
+	if status != ValidationSecure {
+		return status, err
+	}
+
+	nxdomain := resp.Rcode == dns.RcodeNameError
+
+	if nsecDenies(nsecs, name, qtype, nxdomain) {
+		return ValidationSecure, nil
+	}
+
+	if ok, optOut := nsec3Denies(nsec3s, name, qtype, nxdomain); ok {
+		if optOut {
+			return ValidationInsecure, fmt.Errorf("%s is covered by an opt-out NSEC3 record", name)
+		}
+		return ValidationSecure, nil
+	}
+
+	if nxdomain {
+		return ValidationBogus, fmt.Errorf("no proof that %s doesn't exist", name)
+	}
+
+	return ValidationBogus, fmt.Errorf("no proof that %s has no %s records", name, dns.Type(qtype))
+}
+
+// wildcardProof returns the status of the proof that the owner of an RRset
+// synthesized from a wildcard doesn't exist, as described in RFC 4035
+// section 5.3.4.
+func (c *chain) wildcardProof(resp *dns.Msg, owner string, sig *dns.RRSIG) (ValidationStatus, error) {
+	status, nsecs, nsec3s, err := c.authority(resp, owner)
+	if status != ValidationSecure {
+		return status, err
+	}
+
+	labels := dns.SplitDomainName(owner)
+	encloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels):], "."))
+
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, owner) {
+			return ValidationSecure, nil
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser(owner, encloser)) {
+			return ValidationSecure, nil
+		}
+	}
+
+	return ValidationBogus, fmt.Errorf("no proof that %s doesn't exist for its wildcard answer", owner)
+}
+
+// authority validates the RRsets in the authority section of a negative
+// response for the name, returning the NSEC and NSEC3 records among them.
+func (c *chain) authority(resp *dns.Msg, name string) (ValidationStatus, []*dns.NSEC, []*dns.NSEC3, error) {
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+		signed bool
+	)
+
+	for _, rrset := range rrsets(resp.Ns) {
+		hdr := rrset[0].Header()
+		owner := dns.CanonicalName(hdr.Name)
+
+		// NS records of delegations are not signed.
+		if hdr.Rrtype == dns.TypeNS {
+			continue
+		}
+
+		status, _, err := c.verify(rrset, rrsigs(resp.Ns, owner, hdr.Rrtype), name)
+		if status != ValidationSecure {
+			return status, nil, nil, err
+		}
+
+		signed = true
+
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				// NSEC3 records with unknown hash algorithms are ignored, as
+				// described in RFC 5155 section 8.1.
+				if rr.Hash != dns.SHA1 {
+					continue
+				}
+
+				if rr.Iterations > maxNSEC3Iterations {
+					return ValidationInsecure, nil, nil, fmt.Errorf("NSEC3 record %s has %d iterations, more than %d", rr.Hdr.Name, rr.Iterations, maxNSEC3Iterations)
+				}
+
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	if !signed {
+		status, err := c.unsigned(name)
+		return status, nil, nil, err
+	}
+
+	return ValidationSecure, nsecs, nsec3s, nil
+}
+
+// query sends a DNSSEC query for the name and type to the upstream.
+func (c *chain) query(name string, qtype uint16) (*dns.Msg, error) {
+	c.queries++
+	if c.queries > maxValidationQueries {
+		return nil, fmt.Errorf("more than %d queries to validate the response", maxValidationQueries)
+	}
+
+	req := new(dns.Msg).SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(dns.DefaultMsgSize, true)
+
+	resp, err := c.validator.Upstream.Exchange(c.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s query failed with %s", name, dns.Type(qtype), dns.RcodeToString[resp.Rcode])
+	}
+
+	return resp, nil
+}
+
+// nsecDenies returns whether the NSEC records prove that the name doesn't
+// exist, or has no records of the type, as described in RFC 4035 section
+// 5.4.
+func nsecDenies(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	nodata := func(types []uint16) bool {
+		return !hasType(types, qtype) && !hasType(types, dns.TypeCNAME)
+	}
+
+	for _, nsec := range nsecs {
+		owner := dns.CanonicalName(nsec.Hdr.Name)
+
+		if owner == name {
+			// The NSEC record of a delegation in the parent zone only proves
+			// the absence of DS records.
+			return !nxdomain && nodata(nsec.TypeBitMap) && (!parentSideDelegation(nsec.TypeBitMap) || qtype == dns.TypeDS)
+		}
+
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+
+		next := dns.CanonicalName(nsec.NextDomain)
+
+		// An empty non-terminal has names below it, but no records.
+		if !nxdomain && dns.IsSubDomain(name, next) {
+			return true
+		}
+
+		// The wildcard at the closest encloser must not exist for NXDOMAIN
+		// responses, or not have the type for no data responses.
+		encloser := commonAncestor(name, owner)
+		if other := commonAncestor(name, next); dns.CountLabel(other) > dns.CountLabel(encloser) {
+			encloser = other
+		}
+
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+
+		for _, other := range nsecs {
+			switch {
+			case nxdomain && nsecCovers(other, wildcard):
+				return true
+			case !nxdomain && dns.CanonicalName(other.Hdr.Name) == wildcard && nodata(other.TypeBitMap):
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nsec3Denies returns whether the NSEC3 records prove that the name doesn't
+// exist, or has no records of the type, as described in RFC 5155 sections
+// 8.4 to 8.7, and whether the proof relies on an opt-out NSEC3 record.
+func nsec3Denies(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) (ok, optOut bool) {
+	nodata := func(types []uint16) bool {
+		return !hasType(types, qtype) && !hasType(types, dns.TypeCNAME)
+	}
+
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				// The NSEC3 record of a delegation in the parent zone only
+				// proves the absence of DS records.
+				return nodata(nsec3.TypeBitMap) && (!parentSideDelegation(nsec3.TypeBitMap) || qtype == dns.TypeDS), false
+			}
+		}
+	}
+
+	encloser, cover, ok := closestEncloserProof(nsec3s, name)
+	if !ok {
+		return false, false
+	}
+
+	optOut = cover.Flags&1 == 1
+
+	// DS queries for unsigned delegations in opt-out ranges have no
+	// matching NSEC3 record.
+	if !nxdomain && qtype == dns.TypeDS && optOut {
+		return true, true
+	}
+
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+
+	for _, nsec3 := range nsec3s {
+		switch {
+		case nxdomain && nsec3.Cover(wildcard):
+			return true, optOut
+		case !nxdomain && nsec3.Match(wildcard) && nodata(nsec3.TypeBitMap):
+			return true, false
+		}
+	}
+
+	return false, false
+}
+
+// closestEncloserProof returns the closest encloser of the name, proven by
+// an NSEC3 record matching it, and an NSEC3 record covering its next closer
+// name, as described in RFC 5155 section 8.3.
+func closestEncloserProof(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3, bool) {
+	if len(nsec3s) == 0 {
+		return "", nil, false
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+
+		var match *dns.NSEC3
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(encloser) {
+				match = nsec3
+				break
+			}
+		}
+
+		if match == nil {
+			continue
+		}
+
+		// Names below a delegation or DNAME aren't in the zone, so its
+		// NSEC3 record can't prove that they don't exist.
+		if parentSideDelegation(match.TypeBitMap) || hasType(match.TypeBitMap, dns.TypeDNAME) {
+			return "", nil, false
+		}
+
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(nextCloser(name, encloser)) {
+				return encloser, nsec3, true
+			}
+		}
+
+		return "", nil, false
+	}
+
+	return "", nil, false
+}
+
+// parentSideDelegation returns whether the type bit map of an NSEC or NSEC3
+// record is that of a delegation in the parent zone, with NS records but no
+// SOA record.
+func parentSideDelegation(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)
+}
+
+// commonAncestor returns the longest common ancestor of the names.
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+
+	labels := dns.SplitDomainName(a)
+
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// parentZone returns the name one label shorter than the zone.
+func parentZone(zone string) string {
+	off, end := dns.NextLabel(zone, 0)
+	if end {
+		return "."
+	}
+	return zone[off:]
+}
+
+// matchesAnchor returns whether the key matches the trust anchor, which is
+// either a DS record with its digest, or the DNSKEY record itself.
+func matchesAnchor(key *dns.DNSKEY, anchor dns.RR) bool {
+	switch anchor := anchor.(type) {
+	case *dns.DS:
+		if key.KeyTag() != anchor.KeyTag || key.Algorithm != anchor.Algorithm {
+			return false
+		}
+
+		ds := key.ToDS(anchor.DigestType)
+
+		return ds != nil && strings.EqualFold(ds.Digest, anchor.Digest)
+	case *dns.DNSKEY:
+		return key.Flags == anchor.Flags && key.Protocol == anchor.Protocol && key.Algorithm == anchor.Algorithm &&
+			strings.ReplaceAll(key.PublicKey, " ", "") == strings.ReplaceAll(anchor.PublicKey, " ", "")
+	default:
+		return false
+	}
+}
+
+// supportedDS returns whether the key algorithm and digest type of the DS
+// record are supported for validation.
+func supportedDS(ds *dns.DS) bool {
+	switch ds.Algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+	default:
+		return false
+	}
+
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	default:
+		return false
+	}
+}
+
+// rrsets groups the records, except RRSIG and OPT records, into RRsets by
+// owner name, type, and class, in the order they first appear.
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		i := -1
+		for j, set := range sets {
+			other := set[0].Header()
+			if other.Rrtype == hdr.Rrtype && other.Class == hdr.Class && strings.EqualFold(other.Name, hdr.Name) {
+				i = j
+				break
+			}
+		}
+
+		if i < 0 {
+			sets = append(sets, nil)
+			i = len(sets) - 1
+		}
+
+		sets[i] = append(sets[i], rr)
+	}
+
+	return sets
+}
+
+// synthesizingDNAME returns the DNAME record among the records that the
+// CNAME record was synthesized from, by replacing the DNAME's owner name at
+// the end of the CNAME's owner name with the DNAME's target, as described in
+// [RFC 6672 section 2.2], or nil if there is none.
+//
+// [RFC 6672 section 2.2]: https://datatracker.ietf.org/doc/html/rfc6672#section-2.2
+func synthesizingDNAME(rrs []dns.RR, cname *dns.CNAME) *dns.DNAME {
+	owner, target := dns.CanonicalName(cname.Hdr.Name), dns.CanonicalName(cname.Target)
+
+	for _, rr := range rrs {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+
+		dnameOwner := dns.CanonicalName(dname.Hdr.Name)
+		if dnameOwner == owner || !dns.IsSubDomain(dnameOwner, owner) {
+			continue
+		}
+
+		synthesized := strings.TrimSuffix(owner, dnameOwner)
+		if dnameOwner == "." {
+			synthesized = owner
+		}
+
+		if dnameTarget := dns.CanonicalName(dname.Target); dnameTarget != "." {
+			synthesized += dnameTarget
+		}
+
+		if synthesized == target {
+			return dname
+		}
+	}
+
+	return nil
+}
+
+// rrsigs returns the RRSIG records owned by the name that cover the type.
+func rrsigs(rrs []dns.RR, name string, covered uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == covered && dns.CanonicalName(sig.Hdr.Name) == name {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
@@ -0,0 +1,1032 @@
+package doh_test
+
+import (
+	"crypto"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+// testSignZone returns a zone with the given records, and an SOA, NS, and
+// DNSKEY record at its origin, signed with a new key using NSEC or NSEC3
+// records, and the DS record of its key. Names with NS records are
+// delegations, whose NS records are not signed.
+func testSignZone(t *testing.T, origin string, nsec3 bool, records ...string) (*testZone, *dns.DS) {
+	t.Helper()
+
+	return testSignZoneIterations(t, origin, nsec3, 0, records...)
+}
+
+// testSignZoneIterations is like testSignZone, with the given number of
+// additional hash iterations for NSEC3 records.
+func testSignZoneIterations(t *testing.T, origin string, nsec3 bool, iterations uint16, records ...string) (*testZone, *dns.DS) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := dns.Fqdn("ns." + strings.TrimSuffix(origin, "."))
+	hostmaster := dns.Fqdn("hostmaster." + strings.TrimSuffix(origin, "."))
+
+	records = append(records,
+		origin+" 3600 IN SOA "+ns+" "+hostmaster+" 1 7200 3600 1209600 300",
+		origin+" 3600 IN NS "+ns,
+	)
+
+	rrs := []dns.RR{key}
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	if nsec3 {
+		rrs = append(rrs, &dns.NSEC3PARAM{
+			Hdr:        dns.RR_Header{Name: origin, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			Iterations: iterations,
+			SaltLength: 2,
+			Salt:       "AABB",
+		})
+	}
+
+	// Group the records into RRsets by owner name and type.
+	types := make(map[string]map[uint16][]dns.RR)
+
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if types[name] == nil {
+			types[name] = make(map[uint16][]dns.RR)
+		}
+		types[name][rr.Header().Rrtype] = append(types[name][rr.Header().Rrtype], rr)
+	}
+
+	delegation := func(name string) bool {
+		_, ok := types[name][dns.TypeNS]
+		return ok && name != dns.CanonicalName(origin)
+	}
+
+	// The type bit map of each name, including the RRSIG and NSEC records
+	// added below.
+	bitmap := func(name string) []uint16 {
+		var bits []uint16
+		for rrtype := range types[name] {
+			bits = append(bits, rrtype)
+		}
+		if len(bits) > 0 && (!delegation(name) || !nsec3 || slices.Contains(bits, dns.TypeDS)) {
+			bits = append(bits, dns.TypeRRSIG)
+		}
+		if !nsec3 {
+			bits = append(bits, dns.TypeNSEC)
+		}
+		slices.Sort(bits)
+		return bits
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+
+	var denial []dns.RR
+
+	if nsec3 {
+		// Empty non-terminals have NSEC3 records too.
+		for _, name := range names {
+			for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(origin, name[off:]); off, end = dns.NextLabel(name, off) {
+				if _, ok := types[name[off:]]; !ok {
+					types[name[off:]] = nil
+					names = append(names, name[off:])
+				}
+			}
+		}
+
+		hashes := make(map[string]string)
+		for _, name := range names {
+			hashes[dns.HashName(name, dns.SHA1, iterations, "AABB")] = name
+		}
+
+		sorted := make([]string, 0, len(hashes))
+		for hash := range hashes {
+			sorted = append(sorted, hash)
+		}
+		slices.Sort(sorted)
+
+		for i, hash := range sorted {
+			next := sorted[(i+1)%len(sorted)]
+			denial = append(denial, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + origin, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				Iterations: iterations,
+				SaltLength: 2,
+				Salt:       "AABB",
+				HashLength: 20,
+				NextDomain: next,
+				TypeBitMap: bitmap(hashes[hash]),
+			})
+		}
+	} else {
+		slices.SortFunc(names, testCanonicalCompare)
+
+		for i, name := range names {
+			denial = append(denial, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: bitmap(name),
+			})
+		}
+	}
+
+	for _, rr := range denial {
+		name := dns.CanonicalName(rr.Header().Name)
+		if types[name] == nil {
+			types[name] = make(map[uint16][]dns.RR)
+		}
+		types[name][rr.Header().Rrtype] = []dns.RR{rr}
+		rrs = append(rrs, rr)
+	}
+
+	now := time.Now()
+
+	for name, sets := range types {
+		for rrtype, rrset := range sets {
+			if delegation(name) && rrtype != dns.TypeDS && rrtype != dns.TypeNSEC {
+				continue
+			}
+
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+				Algorithm:  key.Algorithm,
+				Expiration: uint32(now.Add(time.Hour).Unix()),
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				KeyTag:     key.KeyTag(),
+				SignerName: origin,
+			}
+
+			if err := sig.Sign(priv.(crypto.Signer), rrset); err != nil {
+				t.Fatal(err)
+			}
+
+			rrs = append(rrs, sig)
+		}
+	}
+
+	return newTestZone(origin, rrs), key.ToDS(dns.SHA256)
+}
+
+// testZone is a zone answering queries like an authoritative server, which
+// adds the RRSIG records of its answers, and the NSEC or NSEC3 records
+// proving the non-existence of names and types, to queries with the DO bit
+// set, as described in RFC 4035 section 3.1.
+type testZone struct {
+	origin string
+	soa    *dns.SOA
+	nsec   []*dns.NSEC
+	nsec3  []*dns.NSEC3
+
+	// names are the records of the zone by canonical owner name, which
+	// includes empty non-terminals with no records.
+	names map[string][]dns.RR
+}
+
+// newTestZone returns a zone with the given records, which must include an
+// SOA record at its origin.
+func newTestZone(origin string, rrs []dns.RR) *testZone {
+	z := &testZone{
+		origin: dns.CanonicalName(origin),
+		names:  make(map[string][]dns.RR),
+	}
+
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			z.soa = rr
+		case *dns.NSEC:
+			z.nsec = append(z.nsec, rr)
+		case *dns.NSEC3:
+			z.nsec3 = append(z.nsec3, rr)
+		}
+
+		z.names[name] = append(z.names[name], rr)
+
+		for off, end := dns.NextLabel(name, 0); !end && name[off:] != z.origin && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+			if _, ok := z.names[name[off:]]; !ok {
+				z.names[name[off:]] = nil
+			}
+		}
+	}
+
+	return z
+}
+
+// testZoneHandler returns a DoH handler answering queries from the most
+// specific of the zones, except for DS queries, which are answered by the
+// parent zone, and refusing queries outside of them.
+func testZoneHandler(zones ...*testZone) doh.Handler {
+	zones = slices.Clone(zones)
+
+	slices.SortStableFunc(zones, func(a, b *testZone) int {
+		return dns.CountLabel(b.origin) - dns.CountLabel(a.origin)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		q := req.Question[0]
+		name := dns.CanonicalName(q.Name)
+
+		for _, zone := range zones {
+			if !dns.IsSubDomain(zone.origin, name) || (q.Qtype == dns.TypeDS && name == zone.origin && name != ".") {
+				continue
+			}
+
+			return zone.answer(req, name, q.Qtype), nil
+		}
+
+		return new(dns.Msg).SetRcode(req, dns.RcodeRefused), nil
+	}
+}
+
+// answer returns the zone's response to the query, following CNAME records
+// within the zone and expanding wildcards.
+func (z *testZone) answer(req *dns.Msg, name string, qtype uint16) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	resp.Authoritative = true
+
+	var dnssec bool
+
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		dnssec = reqOpt.Do()
+	}
+
+	for range 8 {
+		rrs, ok := z.lookup(name)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			z.addDenial(resp, name, false, dnssec)
+			return resp
+		}
+
+		if answers := testRecordsOfType(rrs, qtype); len(answers) > 0 {
+			resp.Answer = append(resp.Answer, answers...)
+
+			if dnssec {
+				resp.Answer = append(resp.Answer, testSignatures(rrs, qtype)...)
+				z.addWildcardProof(resp, name)
+			}
+
+			return resp
+		}
+
+		cnames := testRecordsOfType(rrs, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			z.addDenial(resp, name, true, dnssec)
+			return resp
+		}
+
+		resp.Answer = append(resp.Answer, cnames[0])
+
+		if dnssec {
+			resp.Answer = append(resp.Answer, testSignatures(rrs, dns.TypeCNAME)...)
+			z.addWildcardProof(resp, name)
+		}
+
+		name = dns.CanonicalName(cnames[0].(*dns.CNAME).Target)
+
+		if !dns.IsSubDomain(z.origin, name) {
+			return resp
+		}
+	}
+
+	return resp
+}
+
+// lookup returns the records for the name, expanding the wildcard at its
+// closest encloser if the name doesn't exist, or false if neither exist.
+func (z *testZone) lookup(name string) ([]dns.RR, bool) {
+	if rrs, ok := z.names[name]; ok {
+		return rrs, true
+	}
+
+	wildcard, ok := z.names["*."+z.closestEncloser(name)]
+	if !ok {
+		return nil, false
+	}
+
+	rrs := make([]dns.RR, 0, len(wildcard))
+	for _, rr := range wildcard {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, true
+}
+
+// closestEncloser returns the longest existing ancestor of the name in the
+// zone, or the name itself if it exists.
+func (z *testZone) closestEncloser(name string) string {
+	for off, end := 0, false; !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+		if _, ok := z.names[name[off:]]; ok {
+			return name[off:]
+		}
+	}
+
+	return z.origin
+}
+
+// addDenial adds the SOA record to the authority section of a negative
+// response and, if dnssec is true, the records proving that the name doesn't
+// exist, or that it has no records of the queried type if nodata is true, as
+// described in RFC 4035 section 3.1.3 and RFC 5155 section 7.2.
+func (z *testZone) addDenial(resp *dns.Msg, name string, nodata, dnssec bool) {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	resp.Ns = append(resp.Ns, soa)
+
+	if !dnssec {
+		return
+	}
+
+	resp.Ns = append(resp.Ns, testSignatures(z.names[z.origin], dns.TypeSOA)...)
+
+	_, exists := z.names[name]
+
+	encloser := z.closestEncloser(name)
+	wildcard := "*." + encloser
+
+	var proof []dns.RR
+
+	if len(z.nsec3) > 0 {
+		switch {
+		case exists:
+			proof = append(proof, z.matchingNSEC3(name)...)
+		case nodata:
+			// The name was synthesized from a wildcard without the type.
+			proof = append(proof, z.matchingNSEC3(encloser)...)
+			proof = append(proof, z.coveringNSEC3(testNextCloser(name, encloser))...)
+			proof = append(proof, z.matchingNSEC3(wildcard)...)
+		default:
+			proof = append(proof, z.matchingNSEC3(encloser)...)
+			proof = append(proof, z.coveringNSEC3(testNextCloser(name, encloser))...)
+			proof = append(proof, z.coveringNSEC3(wildcard)...)
+		}
+	} else {
+		switch {
+		case exists:
+			// Empty non-terminals have no NSEC record of their own, but are
+			// covered by the NSEC record of the name before them.
+			if matching := z.matchingNSEC(name); len(matching) > 0 {
+				proof = append(proof, matching...)
+			} else {
+				proof = append(proof, z.coveringNSEC(name)...)
+			}
+		case nodata:
+			proof = append(proof, z.coveringNSEC(name)...)
+			proof = append(proof, z.matchingNSEC(wildcard)...)
+		default:
+			proof = append(proof, z.coveringNSEC(name)...)
+			proof = append(proof, z.coveringNSEC(wildcard)...)
+		}
+	}
+
+	z.addProof(resp, proof)
+}
+
+// addWildcardProof adds the records proving that the name doesn't exist to
+// the authority section of a response synthesized from a wildcard, unless
+// the name exists.
+func (z *testZone) addWildcardProof(resp *dns.Msg, name string) {
+	if _, ok := z.names[name]; ok {
+		return
+	}
+
+	if len(z.nsec3) > 0 {
+		z.addProof(resp, z.coveringNSEC3(testNextCloser(name, z.closestEncloser(name))))
+	} else {
+		z.addProof(resp, z.coveringNSEC(name))
+	}
+}
+
+// addProof adds the NSEC or NSEC3 records, and their RRSIG records, to the
+// authority section of the response, skipping duplicates.
+func (z *testZone) addProof(resp *dns.Msg, proof []dns.RR) {
+	for _, rr := range proof {
+		if slices.Contains(resp.Ns, rr) {
+			continue
+		}
+
+		resp.Ns = append(resp.Ns, rr)
+		resp.Ns = append(resp.Ns, testSignatures(z.names[dns.CanonicalName(rr.Header().Name)], rr.Header().Rrtype)...)
+	}
+}
+
+// matchingNSEC returns the NSEC record owned by the name, if any.
+func (z *testZone) matchingNSEC(name string) []dns.RR {
+	for _, nsec := range z.nsec {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return []dns.RR{nsec}
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC returns the NSEC record covering the name, if any.
+func (z *testZone) coveringNSEC(name string) []dns.RR {
+	for _, nsec := range z.nsec {
+		owner, next := dns.CanonicalName(nsec.Hdr.Name), dns.CanonicalName(nsec.NextDomain)
+
+		// The last NSEC record of the zone wraps around to its origin.
+		if testCanonicalCompare(owner, name) < 0 && (testCanonicalCompare(name, next) < 0 || testCanonicalCompare(next, owner) <= 0) {
+			return []dns.RR{nsec}
+		}
+	}
+
+	return nil
+}
+
+// matchingNSEC3 returns the NSEC3 record matching the hash of the name, if
+// any.
+func (z *testZone) matchingNSEC3(name string) []dns.RR {
+	for _, nsec3 := range z.nsec3 {
+		if nsec3.Match(name) {
+			return []dns.RR{nsec3}
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 record covering the hash of the name, if
+// any.
+func (z *testZone) coveringNSEC3(name string) []dns.RR {
+	for _, nsec3 := range z.nsec3 {
+		if nsec3.Cover(name) {
+			return []dns.RR{nsec3}
+		}
+	}
+
+	return nil
+}
+
+// testNextCloser returns the ancestor of the name, or the name itself, with
+// one more label than its closest encloser.
+func testNextCloser(name, encloser string) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(encloser)-1:], "."))
+}
+
+// testSignatures returns the RRSIG records covering the given type.
+func testSignatures(rrs []dns.RR, covered uint16) []dns.RR {
+	var sigs []dns.RR
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == covered {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// testRecordsOfType returns the records of the given type.
+func testRecordsOfType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var filtered []dns.RR
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
+
+// testCanonicalCompare compares two domain names in canonical DNSSEC order.
+func testCanonicalCompare(a, b string) int {
+	aLabels := dns.SplitDomainName(a)
+	bLabels := dns.SplitDomainName(b)
+
+	slices.Reverse(aLabels)
+	slices.Reverse(bLabels)
+
+	return slices.Compare(aLabels, bLabels)
+}
+
+// testSignedServerURL starts a DoH server for a signed root zone, with a
+// signed "example." zone using NSEC, a signed "nsec3." zone using NSEC3, an
+// unsigned "insecure." zone, and a "bogus." zone whose DS record doesn't
+// match its key, returning its URL and the root trust anchor.
+//
+// The handler can modify responses, such as to tamper with them.
+func testSignedServerURL(t *testing.T, modify func(*dns.Msg)) (string, *dns.DS) {
+	t.Helper()
+
+	example, exampleDS := testSignZone(t, "example.", false,
+		"www.example. 300 IN A 192.0.2.1",
+		"alias.example. 300 IN CNAME www.example.",
+		"a.b.example. 300 IN TXT \"empty non-terminal\"",
+		"*.wild.example. 300 IN A 192.0.2.2",
+		"dname.example. 300 IN DNAME example.",
+	)
+
+	nsec3, nsec3DS := testSignZone(t, "nsec3.", true,
+		"www.nsec3. 300 IN A 192.0.2.3",
+		"*.wild.nsec3. 300 IN A 192.0.2.4",
+	)
+
+	var insecureRRs []dns.RR
+	for _, record := range []string{
+		"insecure. 3600 IN SOA ns.insecure. hostmaster.insecure. 1 7200 3600 1209600 300",
+		"www.insecure. 300 IN A 192.0.2.5",
+	} {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insecureRRs = append(insecureRRs, rr)
+	}
+
+	insecure := newTestZone("insecure.", insecureRRs)
+
+	bogus, _ := testSignZone(t, "bogus.", false, "www.bogus. 300 IN A 192.0.2.6")
+	_, otherDS := testSignZone(t, "bogus.", false)
+
+	root, rootDS := testSignZone(t, ".", false,
+		"example. 3600 IN NS ns.example.",
+		exampleDS.String(),
+		"nsec3. 3600 IN NS ns.nsec3.",
+		nsec3DS.String(),
+		"insecure. 3600 IN NS ns.insecure.",
+		"bogus. 3600 IN NS ns.bogus.",
+		otherDS.String(),
+	)
+
+	handler := testZoneHandler(root, example, nsec3, insecure, bogus)
+
+	// The test zones don't synthesize CNAMEs from DNAMEs, so answer names
+	// below dname.example. the way an authoritative server would.
+	synthesize := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		q := req.Question[0]
+		if !dns.IsSubDomain("dname.example.", q.Name) || dns.CanonicalName(q.Name) == "dname.example." {
+			return handler(w, r, req)
+		}
+
+		dnameReq := req.Copy()
+		dnameReq.Question[0] = dns.Question{Name: "dname.example.", Qtype: dns.TypeDNAME, Qclass: dns.ClassINET}
+
+		dnameResp, err := handler(w, r, dnameReq)
+		if err != nil {
+			return nil, err
+		}
+
+		cname := &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: strings.TrimSuffix(dns.CanonicalName(q.Name), "dname.example.") + "example.",
+		}
+
+		targetReq := req.Copy()
+		targetReq.Question[0].Name = cname.Target
+
+		targetResp, err := handler(w, r, targetReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = append(append(dnameResp.Answer, cname), targetResp.Answer...)
+		resp.Ns = targetResp.Ns
+		resp.Extra = targetResp.Extra
+		return resp, nil
+	}
+
+	return testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		resp, err := synthesize(w, r, req)
+		if err == nil && modify != nil {
+			modify(resp)
+		}
+		return resp, err
+	}), rootDS
+}
+
+func TestValidator(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL, rootDS := testSignedServerURL(t, nil)
+
+	validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+		TrustAnchors: []dns.RR{rootDS},
+	})
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		wantStatus  doh.ValidationStatus
+		wantRcode   int
+		wantAnswers int
+	}{
+		{name: "www.example.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 1},
+		{name: "alias.example.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 2},
+		{name: "www.dname.example.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 3},
+		{name: "example.", qtype: dns.TypeDNSKEY, wantStatus: doh.ValidationSecure, wantAnswers: 1},
+		{name: "nope.example.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantRcode: dns.RcodeNameError},
+		{name: "www.example.", qtype: dns.TypeTXT, wantStatus: doh.ValidationSecure},
+		{name: "b.example.", qtype: dns.TypeTXT, wantStatus: doh.ValidationSecure},
+		{name: "x.wild.example.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 1},
+		{name: "x.wild.example.", qtype: dns.TypeTXT, wantStatus: doh.ValidationSecure},
+		{name: "www.nsec3.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 1},
+		{name: "nope.nsec3.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantRcode: dns.RcodeNameError},
+		{name: "www.nsec3.", qtype: dns.TypeTXT, wantStatus: doh.ValidationSecure},
+		{name: "x.wild.nsec3.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantAnswers: 1},
+		{name: "x.wild.nsec3.", qtype: dns.TypeTXT, wantStatus: doh.ValidationSecure},
+		{name: "nope.", qtype: dns.TypeA, wantStatus: doh.ValidationSecure, wantRcode: dns.RcodeNameError},
+		{name: "www.insecure.", qtype: dns.TypeA, wantStatus: doh.ValidationInsecure, wantAnswers: 1},
+		{name: "nope.insecure.", qtype: dns.TypeA, wantStatus: doh.ValidationInsecure, wantRcode: dns.RcodeNameError},
+		{name: "www.bogus.", qtype: dns.TypeA, wantStatus: doh.ValidationBogus, wantAnswers: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name+" "+dns.Type(test.qtype).String(), func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion(test.name, test.qtype)
+
+			resp, validation, err := validator.Validate(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if validation.Status != test.wantStatus {
+				t.Errorf("got status %v (%v), want %v", validation.Status, validation.Err, test.wantStatus)
+			}
+
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+
+			if len(validation.Answers) != test.wantAnswers {
+				t.Errorf("got %d validated answers, want %d", len(validation.Answers), test.wantAnswers)
+			}
+
+			for _, answer := range validation.Answers {
+				if answer.Status != test.wantStatus {
+					t.Errorf("got %s %s status %v (%v), want %v", answer.Name, dns.Type(answer.Type), answer.Status, answer.Err, test.wantStatus)
+				}
+			}
+
+			if got, want := resp.AuthenticatedData, test.wantStatus == doh.ValidationSecure; got != want {
+				t.Errorf("got AD %v, want %v", got, want)
+			}
+
+			if req.IsEdns0() != nil || req.CheckingDisabled {
+				t.Error("request message was modified")
+			}
+		})
+	}
+}
+
+func TestValidator_ExtraSignature(t *testing.T) {
+	ctx := testContext(t)
+
+	// Signatures that don't verify, listed before the valid one, don't make
+	// the RRset bogus, whether their signer's keys are secure or not.
+	serverURL, rootDS := testSignedServerURL(t, func(resp *dns.Msg) {
+		if resp.Question[0].Name != "www.example." || resp.Question[0].Qtype != dns.TypeA {
+			return
+		}
+
+		var extra []dns.RR
+
+		for _, rr := range resp.Answer {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				otherSigner := dns.Copy(sig).(*dns.RRSIG)
+				otherSigner.SignerName = "www.example."
+
+				otherKey := dns.Copy(sig).(*dns.RRSIG)
+				otherKey.KeyTag++
+
+				extra = append(extra, otherSigner, otherKey)
+			}
+		}
+
+		resp.Answer = append(extra, resp.Answer...)
+	})
+
+	validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+		TrustAnchors: []dns.RR{rootDS},
+	})
+
+	_, validation, err := validator.Validate(ctx, new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if validation.Status != doh.ValidationSecure {
+		t.Errorf("got status %v (%v), want %v", validation.Status, validation.Err, doh.ValidationSecure)
+	}
+}
+
+func TestValidator_Bogus(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		modify func(*dns.Msg)
+		now    func() time.Time
+		anchor bool
+	}{
+		{
+			name:  "tampered answer",
+			qname: "www.example.",
+			qtype: dns.TypeA,
+			modify: func(resp *dns.Msg) {
+				for _, rr := range resp.Answer {
+					if a, ok := rr.(*dns.A); ok {
+						a.A = net.IPv4(203, 0, 113, 1)
+					}
+				}
+			},
+		},
+		{
+			name:  "stripped signatures",
+			qname: "www.example.",
+			qtype: dns.TypeA,
+			modify: func(resp *dns.Msg) {
+				if resp.Question[0].Qtype == dns.TypeA {
+					resp.Answer = slices.DeleteFunc(resp.Answer, func(rr dns.RR) bool {
+						return rr.Header().Rrtype == dns.TypeRRSIG
+					})
+				}
+			},
+		},
+		{
+			name:  "mismatched dname synthesis",
+			qname: "www.dname.example.",
+			qtype: dns.TypeA,
+			modify: func(resp *dns.Msg) {
+				for _, rr := range resp.Answer {
+					if cname, ok := rr.(*dns.CNAME); ok {
+						cname.Target = "alias.example."
+					}
+				}
+			},
+		},
+		{
+			name:  "stripped denial",
+			qname: "nope.example.",
+			qtype: dns.TypeA,
+			modify: func(resp *dns.Msg) {
+				resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) bool {
+					return rr.Header().Rrtype == dns.TypeNSEC
+				})
+			},
+		},
+		{
+			name:  "forged nxdomain",
+			qname: "www.nsec3.",
+			qtype: dns.TypeA,
+			modify: func(resp *dns.Msg) {
+				if resp.Question[0].Name == "www.nsec3." && resp.Question[0].Qtype == dns.TypeA {
+					resp.Rcode = dns.RcodeNameError
+					resp.Answer = nil
+				}
+			},
+		},
+		{
+			name:  "expired signatures",
+			qname: "www.example.",
+			qtype: dns.TypeA,
+			now:   func() time.Time { return time.Now().Add(2 * time.Hour) },
+		},
+		{
+			name:   "wrong trust anchor",
+			qname:  "www.example.",
+			qtype:  dns.TypeA,
+			anchor: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+
+			serverURL, rootDS := testSignedServerURL(t, test.modify)
+
+			if test.anchor {
+				_, rootDS = testSignZone(t, ".", false)
+			}
+
+			validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+				TrustAnchors: []dns.RR{rootDS},
+				Now:          test.now,
+			})
+
+			req := new(dns.Msg).SetQuestion(test.qname, test.qtype)
+
+			_, validation, err := validator.Validate(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if validation.Status != doh.ValidationBogus {
+				t.Errorf("got status %v, want %v", validation.Status, doh.ValidationBogus)
+			}
+
+			if validation.Err == nil {
+				t.Error("got no error for bogus response")
+			}
+
+			if _, err := validator.Exchange(ctx, req); !errors.Is(err, doh.ErrBogus) {
+				t.Errorf("got error %v, want %v", err, doh.ErrBogus)
+			}
+
+			// Bogus responses are returned to queries with the CD bit set.
+			req.CheckingDisabled = true
+
+			resp, err := validator.Exchange(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.AuthenticatedData {
+				t.Error("got AD set for bogus response")
+			}
+		})
+	}
+}
+
+func TestValidator_ReplayedDelegation(t *testing.T) {
+	child, childDS := testSignZone(t, "child.parent.", false,
+		"child.parent. 300 IN A 192.0.2.7",
+		"www.child.parent. 300 IN A 192.0.2.8",
+	)
+
+	parent, parentDS := testSignZone(t, "parent.", true,
+		"child.parent. 3600 IN NS ns.child.parent.",
+		childDS.String(),
+	)
+
+	root, rootDS := testSignZone(t, ".", false,
+		"parent. 3600 IN NS ns.parent.",
+		parentDS.String(),
+	)
+
+	handler := testZoneHandler(root, parent, child)
+
+	tests := []struct {
+		name       string
+		qname      string
+		replay     bool
+		nxdomain   bool
+		wantStatus doh.ValidationStatus
+	}{
+		{name: "apex", qname: "child.parent.", wantStatus: doh.ValidationSecure},
+		{name: "below apex", qname: "www.child.parent.", wantStatus: doh.ValidationSecure},
+		{name: "replayed nodata", qname: "child.parent.", replay: true, wantStatus: doh.ValidationBogus},
+		{name: "replayed nxdomain", qname: "www.child.parent.", replay: true, nxdomain: true, wantStatus: doh.ValidationBogus},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+
+			// Replace the child zone's answer with a denial using the parent
+			// zone's NSEC3 record of the delegation, which is validly signed.
+			serverURL := testServerURL(t, func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+				resp, err := handler(w, r, req)
+
+				if q := req.Question[0]; err == nil && test.replay && q.Name == test.qname && q.Qtype == dns.TypeA {
+					resp.Answer, resp.Ns = nil, nil
+					if test.nxdomain {
+						resp.Rcode = dns.RcodeNameError
+					}
+					parent.addDenial(resp, test.qname, !test.nxdomain, true)
+				}
+
+				return resp, err
+			})
+
+			validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+				TrustAnchors: []dns.RR{rootDS},
+			})
+
+			_, validation, err := validator.Validate(ctx, new(dns.Msg).SetQuestion(test.qname, dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if validation.Status != test.wantStatus {
+				t.Errorf("got status %v (%v), want %v", validation.Status, validation.Err, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestValidator_NSEC3Iterations(t *testing.T) {
+	tests := []struct {
+		name       string
+		iterations uint16
+		wantStatus doh.ValidationStatus
+	}{
+		{name: "at limit", iterations: 150, wantStatus: doh.ValidationSecure},
+		{name: "over limit", iterations: 151, wantStatus: doh.ValidationInsecure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+
+			zone, zoneDS := testSignZoneIterations(t, "slow.", true, test.iterations, "www.slow. 300 IN A 192.0.2.9")
+
+			root, rootDS := testSignZone(t, ".", false,
+				"slow. 3600 IN NS ns.slow.",
+				zoneDS.String(),
+			)
+
+			serverURL := testServerURL(t, testZoneHandler(root, zone))
+
+			validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+				TrustAnchors: []dns.RR{rootDS},
+			})
+
+			for _, qname := range []string{"nope.slow.", "www.slow."} {
+				_, validation, err := validator.Validate(ctx, new(dns.Msg).SetQuestion(qname, dns.TypeTXT))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if validation.Status != test.wantStatus {
+					t.Errorf("got %s status %v (%v), want %v", qname, validation.Status, validation.Err, test.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestValidator_Indeterminate(t *testing.T) {
+	ctx := testContext(t)
+
+	serverURL, _ := testSignedServerURL(t, nil)
+
+	_, otherDS := testSignZone(t, "other.", false)
+
+	validator := doh.NewValidator(doh.NewClient(doh.WithServers(serverURL)), doh.ValidatorOptions{
+		TrustAnchors: []dns.RR{otherDS},
+	})
+
+	resp, err := validator.Exchange(ctx, new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.AuthenticatedData {
+		t.Error("got AD set without a trust anchor")
+	}
+
+	_, validation, err := validator.Validate(ctx, new(dns.Msg).SetQuestion("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if validation.Status != doh.ValidationIndeterminate {
+		t.Errorf("got status %v, want %v", validation.Status, doh.ValidationIndeterminate)
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	anchors, err := doh.ParseTrustAnchors(strings.NewReader(`
+; root trust anchors
+. 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. 172800 IN NS a.root-servers.net.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(anchors) != 1 || anchors[0].Header().Rrtype != dns.TypeDS {
+		t.Errorf("got anchors %v, want one DS record", anchors)
+	}
+
+	if _, err := doh.ParseTrustAnchors(strings.NewReader(". 172800 IN NS a.root-servers.net.\n")); !errors.Is(err, doh.ErrInvalidTrustAnchor) {
+		t.Errorf("got error %v, want %v", err, doh.ErrInvalidTrustAnchor)
+	}
+}
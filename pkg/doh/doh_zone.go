@@ -0,0 +1,367 @@
+package doh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNotInZone is returned when adding a record whose owner name is
+	// outside of the zone's origin.
+	ErrNotInZone = errors.New("doh: record is not in zone")
+
+	// ErrInvalidZone is returned when a zone file can't be parsed, or is
+	// not a valid zone.
+	ErrInvalidZone = errors.New("doh: invalid zone")
+)
+
+// DefaultHostsTTL is the TTL, in seconds, of records loaded from hosts files
+// by [ParseHosts].
+const DefaultHostsTTL = 60
+
+// maxCNAMEChain is the maximum number of CNAME records followed when
+// answering a query from a zone.
+const maxCNAMEChain = 8
+
+// Zone is a set of DNS records under an origin, which a [ZoneHandler]
+// answers queries for.
+//
+// A zone with an SOA record, such as one loaded from a zone file with
+// [ParseZone], is authoritative for all names under its origin: names
+// without records are answered with NXDOMAIN, and types without records
+// with no data, with the SOA record in the authority section.
+//
+// A zone without an SOA record, such as one loaded from a hosts file with
+// [ParseHosts], only answers queries for names it has records for.
+//
+// A zone must not be modified after it is passed to a ZoneHandler.
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+
+	// names are the records of the zone by canonical owner name, which
+	// includes empty non-terminals with no records.
+	names map[string][]dns.RR
+}
+
+// NewZone returns a new, empty zone with the given origin.
+func NewZone(origin string) *Zone {
+	return &Zone{
+		origin: dns.CanonicalName(origin),
+		names:  make(map[string][]dns.RR),
+	}
+}
+
+// Origin returns the origin of the zone.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// SOA returns the SOA record of the zone, or nil if it has none.
+func (z *Zone) SOA() *dns.SOA {
+	return z.soa
+}
+
+// Add adds the given records to the zone, returning ErrNotInZone if any of
+// them are outside of the zone's origin. An SOA record at the origin makes
+// the zone authoritative.
+func (z *Zone) Add(rrs ...dns.RR) error {
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+
+		if !dns.IsSubDomain(z.origin, name) {
+			return fmt.Errorf("%w: %s is not under %s", ErrNotInZone, name, z.origin)
+		}
+
+		if soa, ok := rr.(*dns.SOA); ok && name == z.origin {
+			z.soa = soa
+		}
+
+		z.names[name] = append(z.names[name], rr)
+
+		// Add the empty non-terminals between the name and the origin, so
+		// that they are answered with no data instead of NXDOMAIN.
+		for off, end := dns.NextLabel(name, 0); !end && name[off:] != z.origin && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+			if _, ok := z.names[name[off:]]; !ok {
+				z.names[name[off:]] = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseZone parses an RFC 1035 zone file, using the given origin for
+// relative names, unless the file sets its own with $ORIGIN. If origin is
+// empty, the owner of the file's SOA record is used. The file name is only
+// used in error messages. The zone must have an SOA record.
+func ParseZone(r io.Reader, origin, file string) (*Zone, error) {
+	zp := dns.NewZoneParser(r, origin, file)
+
+	var rrs []dns.RR
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidZone, err)
+	}
+
+	i := slices.IndexFunc(rrs, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeSOA
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s has no SOA record", ErrInvalidZone, file)
+	}
+
+	if origin == "" {
+		origin = rrs[i].Header().Name
+	}
+
+	zone := NewZone(origin)
+
+	if err := zone.Add(rrs...); err != nil {
+		return nil, err
+	}
+
+	if zone.soa == nil {
+		return nil, fmt.Errorf("%w: %s has no SOA record at %s", ErrInvalidZone, file, zone.origin)
+	}
+
+	return zone, nil
+}
+
+// ParseHosts parses an /etc/hosts style file into a zone without an SOA
+// record, with A and AAAA records for each host name and alias, and a PTR
+// record for the reverse lookup of each address to its host name.
+func ParseHosts(r io.Reader) (*Zone, error) {
+	zone := NewZone(".")
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		reverse, err := dns.ReverseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+
+		for i, field := range fields[1:] {
+			name, ok := parseDomain(field)
+			if !ok {
+				continue
+			}
+
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: DefaultHostsTTL}
+
+			var rr dns.RR
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rr = &dns.A{Hdr: hdr, A: ip4}
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+			}
+
+			rrs := []dns.RR{rr}
+
+			// Only the host name, not its aliases, is used for the reverse
+			// lookup of the address.
+			if i == 0 {
+				rrs = append(rrs, &dns.PTR{
+					Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: DefaultHostsTTL},
+					Ptr: name,
+				})
+			}
+
+			if err := zone.Add(rrs...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("doh: failed to read hosts file: %w", err)
+	}
+
+	return zone, nil
+}
+
+// ZoneHandler returns a DoH handler that answers queries for names in the
+// given zones itself, and passes all other queries to the next handler. When
+// zones overlap, the zone with the longest matching origin is used. CNAME
+// records are followed within a zone, and wildcard records are expanded as
+// described in [RFC 4592].
+//
+// [RFC 4592]: https://datatracker.ietf.org/doc/html/rfc4592
+func ZoneHandler(next Handler, zones ...*Zone) Handler {
+	zones = slices.Clone(zones)
+
+	// Try the most specific zones first.
+	slices.SortStableFunc(zones, func(a, b *Zone) int {
+		return dns.CountLabel(b.origin) - dns.CountLabel(a.origin)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		if len(req.Question) != 1 {
+			return next(w, r, req)
+		}
+
+		q := req.Question[0]
+		name := dns.CanonicalName(q.Name)
+
+		for _, zone := range zones {
+			if !dns.IsSubDomain(zone.origin, name) {
+				continue
+			}
+
+			if resp, ok := zone.answer(req, name, q.Qtype); ok {
+				return resp, nil
+			}
+		}
+
+		return next(w, r, req)
+	}
+}
+
+// answer returns the zone's response to the given query, or false if the
+// zone is not authoritative for the name.
+func (z *Zone) answer(req *dns.Msg, name string, qtype uint16) (*dns.Msg, bool) {
+	resp := new(dns.Msg).SetReply(req)
+	resp.Authoritative = z.soa != nil
+	resp.RecursionAvailable = true
+
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+	}
+
+	for range maxCNAMEChain {
+		rrs, ok := z.lookup(name)
+		if !ok {
+			if z.soa == nil && len(resp.Answer) == 0 {
+				return nil, false
+			}
+
+			resp.Rcode = dns.RcodeNameError
+			z.addNegativeSOA(resp)
+
+			return resp, true
+		}
+
+		answers := filterRRs(rrs, qtype)
+		if len(answers) > 0 {
+			resp.Answer = append(resp.Answer, answers...)
+			return resp, true
+		}
+
+		cnames := filterRRs(rrs, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			z.addNegativeSOA(resp)
+			return resp, true
+		}
+
+		resp.Answer = append(resp.Answer, cnames[0])
+
+		name = dns.CanonicalName(cnames[0].(*dns.CNAME).Target)
+
+		// Targets outside of the zone are left for the client to resolve.
+		if !dns.IsSubDomain(z.origin, name) {
+			return resp, true
+		}
+	}
+
+	return resp, true
+}
+
+// lookup returns the records for the given name, expanding a matching
+// wildcard if the name has no records, or false if the name does not exist.
+func (z *Zone) lookup(name string) ([]dns.RR, bool) {
+	rrs, ok := z.names[name]
+
+	// Zones without an SOA record don't answer for empty non-terminals,
+	// since they are not authoritative for them.
+	if z.soa == nil {
+		return rrs, len(rrs) > 0
+	}
+
+	if ok {
+		return rrs, true
+	}
+
+	// Find the closest encloser of the name, whose wildcard child is the
+	// source of synthesis for the name.
+	for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(z.origin, name[off:]); off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+
+		if _, ok := z.names[encloser]; !ok && encloser != z.origin {
+			continue
+		}
+
+		wildcard, ok := z.names["*."+encloser]
+		if !ok {
+			return nil, false
+		}
+
+		rrs = make([]dns.RR, 0, len(wildcard))
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+
+		return rrs, true
+	}
+
+	return nil, false
+}
+
+// addNegativeSOA adds the zone's SOA record to the authority section of a
+// negative response, with the negative caching TTL described in RFC 2308.
+func (z *Zone) addNegativeSOA(resp *dns.Msg) {
+	if z.soa == nil {
+		return
+	}
+
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	resp.Ns = append(resp.Ns, soa)
+}
+
+// filterRRs returns the records of the given type, or all records for ANY
+// queries, excluding empty non-terminals.
+func filterRRs(rrs []dns.RR, qtype uint16) []dns.RR {
+	var filtered []dns.RR
+
+	for _, rr := range rrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,249 @@
+package doh_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/picatz/doh/pkg/doh"
+)
+
+const testZoneFile = `$ORIGIN corp.internal.
+$TTL 3600
+@         IN SOA   ns.corp.internal. hostmaster.corp.internal. 1 7200 3600 1209600 300
+@         IN NS    ns.corp.internal.
+ns        IN A     10.0.0.1
+www       IN A     10.0.0.2
+www       IN AAAA  fd00::2
+alias     IN CNAME www
+chain     IN CNAME alias
+external  IN CNAME example.com.
+dangling  IN CNAME missing
+*.apps    IN A     10.0.0.3
+a.b       IN A     10.0.0.4
+`
+
+const testHostsFile = `# hosts file
+127.0.0.1  localhost
+10.0.1.1   printer.lan printer-alias.lan
+fd00::1:1  printer.lan
+`
+
+func TestParseZone(t *testing.T) {
+	zone, err := doh.ParseZone(strings.NewReader(testZoneFile), "", "corp.internal.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zone.Origin() != "corp.internal." {
+		t.Errorf("got origin %q, want %q", zone.Origin(), "corp.internal.")
+	}
+
+	if zone.SOA() == nil {
+		t.Error("got no soa record")
+	}
+
+	_, err = doh.ParseZone(strings.NewReader("www.example. 300 IN A 192.0.2.1\n"), "", "nosoa.zone")
+	if !errors.Is(err, doh.ErrInvalidZone) {
+		t.Errorf("got error %v, want %v", err, doh.ErrInvalidZone)
+	}
+
+	_, err = doh.ParseZone(strings.NewReader(testZoneFile+"www.example. 300 IN A 192.0.2.1\n"), "", "outside.zone")
+	if !errors.Is(err, doh.ErrNotInZone) {
+		t.Errorf("got error %v, want %v", err, doh.ErrNotInZone)
+	}
+}
+
+func TestZoneHandler(t *testing.T) {
+	zone, err := doh.ParseZone(strings.NewReader(testZoneFile), "", "corp.internal.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := doh.ParseHosts(strings.NewReader(testHostsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded bool
+
+	next := func(w http.ResponseWriter, r *http.Request, req *dns.Msg) (*dns.Msg, error) {
+		forwarded = true
+		return testAnswerHandler(w, r, req)
+	}
+
+	handler := doh.ZoneHandler(next, zone, hosts)
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		wantRcode     int
+		wantAnswers   []string
+		wantSOA       bool
+		wantForwarded bool
+	}{
+		{
+			name:        "answer",
+			qname:       "www.corp.internal.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"www.corp.internal.\t3600\tIN\tA\t10.0.0.2"},
+		},
+		{
+			name:        "case insensitive",
+			qname:       "WWW.Corp.Internal.",
+			qtype:       dns.TypeAAAA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"www.corp.internal.\t3600\tIN\tAAAA\tfd00::2"},
+		},
+		{
+			name:      "nodata",
+			qname:     "www.corp.internal.",
+			qtype:     dns.TypeMX,
+			wantRcode: dns.RcodeSuccess,
+			wantSOA:   true,
+		},
+		{
+			name:      "nxdomain",
+			qname:     "missing.corp.internal.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+			wantSOA:   true,
+		},
+		{
+			name:      "empty non-terminal",
+			qname:     "b.corp.internal.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+			wantSOA:   true,
+		},
+		{
+			name:      "cname chain",
+			qname:     "chain.corp.internal.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+			wantAnswers: []string{
+				"chain.corp.internal.\t3600\tIN\tCNAME\talias.corp.internal.",
+				"alias.corp.internal.\t3600\tIN\tCNAME\twww.corp.internal.",
+				"www.corp.internal.\t3600\tIN\tA\t10.0.0.2",
+			},
+		},
+		{
+			name:        "cname query",
+			qname:       "alias.corp.internal.",
+			qtype:       dns.TypeCNAME,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"alias.corp.internal.\t3600\tIN\tCNAME\twww.corp.internal."},
+		},
+		{
+			name:        "cname outside zone",
+			qname:       "external.corp.internal.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"external.corp.internal.\t3600\tIN\tCNAME\texample.com."},
+		},
+		{
+			name:        "dangling cname",
+			qname:       "dangling.corp.internal.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeNameError,
+			wantAnswers: []string{"dangling.corp.internal.\t3600\tIN\tCNAME\tmissing.corp.internal."},
+			wantSOA:     true,
+		},
+		{
+			name:        "wildcard",
+			qname:       "foo.apps.corp.internal.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"foo.apps.corp.internal.\t3600\tIN\tA\t10.0.0.3"},
+		},
+		{
+			name:        "wildcard multiple labels",
+			qname:       "bar.foo.apps.corp.internal.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"bar.foo.apps.corp.internal.\t3600\tIN\tA\t10.0.0.3"},
+		},
+		{
+			name:      "wildcard nodata",
+			qname:     "foo.apps.corp.internal.",
+			qtype:     dns.TypeTXT,
+			wantRcode: dns.RcodeSuccess,
+			wantSOA:   true,
+		},
+		{
+			name:        "hosts",
+			qname:       "printer-alias.lan.",
+			qtype:       dns.TypeA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"printer-alias.lan.\t60\tIN\tA\t10.0.1.1"},
+		},
+		{
+			name:        "hosts aaaa",
+			qname:       "printer.lan.",
+			qtype:       dns.TypeAAAA,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"printer.lan.\t60\tIN\tAAAA\tfd00::1:1"},
+		},
+		{
+			name:        "hosts reverse",
+			qname:       "1.1.0.10.in-addr.arpa.",
+			qtype:       dns.TypePTR,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: []string{"1.1.0.10.in-addr.arpa.\t60\tIN\tPTR\tprinter.lan."},
+		},
+		{
+			name:          "hosts parent forwarded",
+			qname:         "lan.",
+			qtype:         dns.TypeA,
+			wantRcode:     dns.RcodeSuccess,
+			wantAnswers:   []string{"lan.\t300\tIN\tA\t8.8.8.8"},
+			wantForwarded: true,
+		},
+		{
+			name:          "forwarded",
+			qname:         "example.com.",
+			qtype:         dns.TypeA,
+			wantRcode:     dns.RcodeSuccess,
+			wantAnswers:   []string{"example.com.\t300\tIN\tA\t8.8.8.8"},
+			wantForwarded: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarded = false
+
+			resp := testCacheHandlerCall(t, handler, new(dns.Msg).SetQuestion(test.qname, test.qtype))
+
+			if forwarded != test.wantForwarded {
+				t.Errorf("got forwarded %v, want %v", forwarded, test.wantForwarded)
+			}
+
+			if resp.Rcode != test.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+
+			var answers []string
+			for _, rr := range resp.Answer {
+				answers = append(answers, rr.String())
+			}
+
+			if strings.Join(answers, "\n") != strings.Join(test.wantAnswers, "\n") {
+				t.Errorf("got answers:\n%s\nwant:\n%s", strings.Join(answers, "\n"), strings.Join(test.wantAnswers, "\n"))
+			}
+
+			gotSOA := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA
+			if gotSOA != test.wantSOA {
+				t.Errorf("got soa in authority %v, want %v", gotSOA, test.wantSOA)
+			}
+
+			if gotSOA && resp.Ns[0].Header().Ttl != 300 {
+				t.Errorf("got soa ttl %d, want 300", resp.Ns[0].Header().Ttl)
+			}
+		})
+	}
+}